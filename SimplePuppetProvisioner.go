@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
@@ -13,11 +14,16 @@ import (
 	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
 	"github.com/mbaynton/SimplePuppetProvisioner/lib"
 	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetdb"
 	"github.com/mbaynton/SimplePuppetProvisioner/lib/sppexec"
 	"github.com/mbaynton/go-genericexec"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "autosign-check" {
+		os.Exit(autosignCheck(os.Args[2:]))
+	}
+
 	configFile := flag.String("config", "", "Path to the spp configuration file.")
 	logStdout := flag.Bool("log-stdout", false, "Log to stdout.")
 	flag.Parse()
@@ -32,24 +38,26 @@ func main() {
 
 	appConfig := lib.LoadTheConfig(*configFile, searchDirs)
 	notifier := lib.NewNotifications(&appConfig)
-	csrWatcher, err := fsnotify.NewWatcher()
+	watcher, err := makeCsrWatcher(&appConfig)
 	if err != nil {
-		appConfig.Log.Println("Unable to start certificate signing request watcher. Cannot proceed.")
+		appConfig.Log.Printf("Unable to start certificate signing request watcher: %s. Cannot proceed.\n", err.Error())
 		os.Exit(1)
 	}
-	watcher := interfaces.FsnotifyWatcher{
-		Add:    csrWatcher.Add,
-		Close:  csrWatcher.Close,
-		Remove: csrWatcher.Remove,
-		Events: csrWatcher.Events,
-		Errors: csrWatcher.Errors,
-	}
-	certSigner, err := certsign.NewCertSigner(*appConfig.PuppetConfig, appConfig.Log, &watcher, notifier.Notify)
+	certSigner, err := certsign.NewCertSigner(*appConfig.PuppetConfig, *appConfig.CertSigning, appConfig.Log, watcher, notifier.Notify)
 	if err != nil {
 		appConfig.Log.Println("Unable to start certificate signing manager. Cannot proceed.")
 		os.Exit(1)
 	}
 
+	var autosignServer *lib.AutosignSocketServer
+	if appConfig.AutosignSocket != "" {
+		autosignServer = lib.NewAutosignSocketServer(appConfig.AutosignSocket, certSigner, appConfig.Log)
+		if err := autosignServer.Start(); err != nil {
+			appConfig.Log.Printf("Unable to listen for autosign checks on %s: %s. Cannot proceed.\n", appConfig.AutosignSocket, err.Error())
+			os.Exit(1)
+		}
+	}
+
 	execConfigMap := makeExecTaskConfigsMap(&appConfig)
 	if appConfig.GithubWebhooks.EnableStandardR10kListener {
 		appConfig.GithubWebhooks.Listeners = append(appConfig.GithubWebhooks.Listeners, lib.StandardR10kListenerConfig(appConfig.GithubWebhooks))
@@ -58,7 +66,22 @@ func main() {
 
 	execManager := sppexec.NewSppExecManager(execConfigMap, appConfig.PuppetConfig, appConfig.Log, notifier.Notify)
 
-	server := lib.NewHttpServer(appConfig, notifier, certSigner, execManager)
+	var puppetDb *puppetdb.Client
+	if appConfig.PuppetDb != nil {
+		puppetDb, err = puppetdb.NewClient(appConfig.PuppetDb)
+		if err != nil {
+			appConfig.Log.Printf("Unable to set up the PuppetDB client: %s. Cannot proceed.\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	records, err := lib.NewProvisioningRecords(appConfig.ProvisioningRecords, appConfig.Log)
+	if err != nil {
+		appConfig.Log.Printf("Unable to load provisioning records from %s: %s. Cannot proceed.\n", appConfig.ProvisioningRecords.Store, err.Error())
+		os.Exit(1)
+	}
+
+	server := lib.NewHttpServer(appConfig, notifier, certSigner, execManager, puppetDb, records)
 
 	if *logStdout == false {
 		appConfig.MoveLoggingToFile()
@@ -81,6 +104,11 @@ func main() {
 	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
 	server.Shutdown(ctx)
 	appConfig.Log.Println("HTTP server shutdown.")
+	records.Flush()
+
+	if autosignServer != nil {
+		autosignServer.Shutdown(ctx)
+	}
 
 	certSigner.Shutdown()
 	appConfig.Log.Println("Certificate signing manager shutdown.")
@@ -88,11 +116,70 @@ func main() {
 	appConfig.Log.Println("Process will now exit.")
 }
 
+// autosignCheck implements the autosign-check subcommand, which puppet server runs as its autosign policy
+// executable. It reads the CSR on stdin and exits 0 if the running spp has a matching authorization for certname.
+func autosignCheck(args []string) int {
+	flags := flag.NewFlagSet("autosign-check", flag.ExitOnError)
+	socket := flags.String("socket", lib.DefaultAutosignSocket, "Path to the running spp's AutosignSocket.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: SimplePuppetProvisioner autosign-check [-socket path] <certname>")
+		return 1
+	}
+
+	approved, message, err := lib.AutosignCheck(*socket, flags.Arg(0), os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to ask spp at %s: %s\n", *socket, err.Error())
+		return 1
+	}
+	fmt.Println(message)
+	if approved {
+		return 0
+	}
+	return 1
+}
+
 func makeExecTaskConfigsMap(config *lib.AppConfig) map[string]genericexec.GenericExecConfig {
 	execTaskDefns := config.GenericExecTasks
 	execTaskConfigsByName := make(map[string]genericexec.GenericExecConfig, len(execTaskDefns))
 	for _, configuredTask := range execTaskDefns {
-		execTaskConfigsByName[configuredTask.Name] = *configuredTask
+		execTaskConfigsByName[configuredTask.Name] = configuredTask.GenericExecConfig
 	}
 	return execTaskConfigsByName
 }
+
+// The CSR directory can't be watched when the CA is remote, so CSRs are discovered by polling its API instead.
+func makeCsrWatcher(config *lib.AppConfig) (*interfaces.FsnotifyWatcher, error) {
+	if config.CertSigning.Backend == "ca-api" {
+		return certsign.NewCaApiCsrWatcher(config.CertSigning.CaApi, config.Log)
+	}
+
+	switch config.CertSigning.CsrWatch {
+	case "", "inotify":
+		return makeInotifyWatcher()
+	case "poll":
+		return certsign.NewCsrDirPoller(config.CertSigning.CsrPollInterval, config.Log), nil
+	case "both":
+		inotifyWatcher, err := makeInotifyWatcher()
+		if err != nil {
+			return nil, err
+		}
+		return certsign.MergeCsrWatchers(inotifyWatcher, certsign.NewCsrDirPoller(config.CertSigning.CsrPollInterval, config.Log)), nil
+	default:
+		return nil, fmt.Errorf("CertSigning CsrWatch \"%s\" is unsupported", config.CertSigning.CsrWatch)
+	}
+}
+
+func makeInotifyWatcher() (*interfaces.FsnotifyWatcher, error) {
+	csrWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &interfaces.FsnotifyWatcher{
+		Add:    csrWatcher.Add,
+		Close:  csrWatcher.Close,
+		Remove: csrWatcher.Remove,
+		Events: csrWatcher.Events,
+		Errors: csrWatcher.Errors,
+	}, nil
+}
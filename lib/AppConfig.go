@@ -9,29 +9,50 @@ import (
 	"io/ioutil"
 	"log"
 	"runtime"
+	"time"
 
 	"github.com/go-chat-bot/bot/irc"
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
 	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetconfig"
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetdb"
 	"github.com/mbaynton/go-genericexec"
 	"github.com/spf13/viper"
 )
 
 type AppConfig struct {
-	BindAddress      string
-	LogFile          string
-	HttpAuth         *HttpAuthConfig
-	ProvisionAuth    *HttpAuthConfig
-	PuppetExecutable string
-	PuppetConfDir    string
-	PuppetConfig     *puppetconfig.PuppetConfig
-	GenericExecTasks []*genericexec.GenericExecConfig
-	GithubWebhooks   *WebhooksConfig
+	BindAddress         string
+	LogFile             string
+	HttpAuth            *HttpAuthConfig
+	ProvisionAuth       *HttpAuthConfig
+	ReportsAuth         *HttpAuthConfig
+	PuppetExecutable    string
+	PuppetConfDir       string
+	PuppetConfig        *puppetconfig.PuppetConfig
+	CertSigning         *certsign.CertSignerConfig
+	AutosignSocket      string
+	GenericExecTasks    []*ExecTaskConfig
+	BuiltinTasks        map[string]*BuiltinTaskConfig
+	GithubWebhooks      *WebhooksConfig
+	PuppetDb            *puppetdb.Config
+	Deprovision         *DeprovisionConfig
+	Reports             *ReportsConfig
+	ProvisioningRecords *ProvisioningRecordsConfig
+	MaxProvisionWait    time.Duration
 
 	Notifications []*NotificationsConfig
 	Log           *log.Logger
 	logBuffer     *RingLog
 }
 
+// ExecTaskConfig is an entry in GenericExecTasks: a genericexec task, and how it is run among a request's other tasks.
+type ExecTaskConfig struct {
+	genericexec.GenericExecConfig `mapstructure:",squash"`
+	// Tasks that must succeed before this one starts, when they are requested with it.
+	DependsOn []string
+	// The values the task takes from the request. Requests giving other values for them are refused.
+	Params []*ExecTaskParam
+}
+
 type HttpAuthConfig struct {
 	Type   string
 	Realm  string
@@ -80,6 +101,12 @@ func LoadTheConfig(configName string, configPaths []string) AppConfig {
 		panic(fmt.Errorf("Configuration file error: %s\n", err))
 	}
 
+	for _, task := range C.GenericExecTasks {
+		if err := task.compileParams(); err != nil {
+			panic(fmt.Errorf("Configuration file error: %s\n", err))
+		}
+	}
+
 	C.setDefaults()
 	C.establishLogger()
 
@@ -98,7 +125,10 @@ func (ctx *AppConfig) setDefaults() {
 	if ctx.ProvisionAuth == nil {
 		ctx.ProvisionAuth = ctx.HttpAuth
 	}
-	for _, authConfig := range []*HttpAuthConfig{ctx.HttpAuth, ctx.ProvisionAuth} {
+	if ctx.ReportsAuth == nil {
+		ctx.ReportsAuth = ctx.HttpAuth
+	}
+	for _, authConfig := range []*HttpAuthConfig{ctx.HttpAuth, ctx.ProvisionAuth, ctx.ReportsAuth} {
 		if authConfig != nil && authConfig.Realm == "" {
 			hostname, err := os.Hostname()
 			if err == nil {
@@ -120,6 +150,31 @@ func (ctx *AppConfig) setDefaults() {
 		}
 	}
 
+	if ctx.CertSigning == nil {
+		ctx.CertSigning = &certsign.CertSignerConfig{}
+	}
+	// Pending authorizations are saved unless that is turned off explicitly.
+	if ctx.CertSigning.AuthorizationStore == "" {
+		ctx.CertSigning.AuthorizationStore = "/var/lib/spp/authorizations.json"
+	} else if ctx.CertSigning.AuthorizationStore == "none" {
+		ctx.CertSigning.AuthorizationStore = ""
+	}
+
+	if ctx.PuppetDb != nil && ctx.PuppetDb.ActiveWithin == 0 {
+		ctx.PuppetDb.ActiveWithin = defaultActiveWithin
+	}
+
+	if ctx.MaxProvisionWait == 0 {
+		ctx.MaxProvisionWait = defaultMaxProvisionWait
+	}
+
+	if ctx.ProvisioningRecords == nil {
+		ctx.ProvisioningRecords = &ProvisioningRecordsConfig{}
+	}
+	if ctx.ProvisioningRecords.Store == "" {
+		ctx.ProvisioningRecords.Store = defaultProvisioningRecordFile
+	}
+
 	if ctx.GithubWebhooks == nil {
 		ctx.GithubWebhooks = &WebhooksConfig{
 			EnableStandardR10kListener: false,
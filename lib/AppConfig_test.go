@@ -2,6 +2,7 @@ package lib
 
 import (
 	"testing"
+	"time"
 )
 
 func TestHttpAuthConfig(t *testing.T) {
@@ -36,4 +37,68 @@ func TestGenericExecTasks(t *testing.T) {
 	if testConfig.GenericExecTasks[1].Command != expect {
 		t.Errorf("Expected to read Generic exec task command %s, got %s", expect, testConfig.GenericExecTasks[0].Command)
 	}
+
+	dependencies := configuredDependencies(&testConfig)
+	if len(dependencies) != 2 || len(dependencies["task2"]) != 1 || dependencies["task2"][0] != "task1" || len(dependencies["cert-sign"]) != 1 || dependencies["cert-sign"][0] != "task2" {
+		t.Errorf("Task dependencies were not loaded from config: %v", dependencies)
+	}
+
+	params := testConfig.GenericExecTasks[0].Params
+	if len(params) != 2 || params[0].Name != "environment" || !params[0].Required || len(params[0].Allowed) != 2 || params[0].Type != ParamTypeString {
+		t.Errorf("Task parameters were not loaded from config: %+v", params)
+	}
+	if len(params) == 2 && (params[1].Type != ParamTypeInteger || params[1].Default != "3") {
+		t.Errorf("Task parameter type and default were not loaded from config: %+v", params[1])
+	}
+}
+
+func TestMaxProvisionWait(t *testing.T) {
+	testConfig := LoadTheConfig("../TestFixtures/configs/ExecTasks.conf.yml", []string{})
+	if testConfig.MaxProvisionWait != 30*time.Minute {
+		t.Errorf("Expected MaxProvisionWait of 30m, got %s\n", testConfig.MaxProvisionWait)
+	}
+
+	testConfig = LoadTheConfig("../TestFixtures/configs/NoRealm.conf.yml", []string{})
+	if testConfig.MaxProvisionWait != defaultMaxProvisionWait {
+		t.Errorf("Expected the default MaxProvisionWait, got %s\n", testConfig.MaxProvisionWait)
+	}
+}
+
+func TestCertSigningConfig(t *testing.T) {
+	testConfig := LoadTheConfig("../TestFixtures/configs/CertSigning.conf.yml", []string{})
+	if testConfig.CertSigning.AuthorizationTtl != 2*time.Hour {
+		t.Errorf("Expected AuthorizationTtl of 2h, got %s\n", testConfig.CertSigning.AuthorizationTtl)
+	}
+	if len(testConfig.CertSigning.Policies) != 1 {
+		t.Fatalf("Expected one signing policy, got %d\n", len(testConfig.CertSigning.Policies))
+	}
+	policy := testConfig.CertSigning.Policies[0]
+	if policy.Name != "compute" || policy.Hostname != `^compute-[0-9]+\.cluster\.org$` || policy.Network != "10.20.0.0/16" {
+		t.Errorf("Signing policy was not loaded from config: %+v\n", policy)
+	}
+	if warnings := testConfig.CertSigning.ExpiryWarnings; warnings == nil || len(warnings.Days) != 2 || warnings.Days[0] != 90 || warnings.Days[1] != 14 {
+		t.Errorf("Expected ExpiryWarnings Days of [90 14], got %+v\n", warnings)
+	}
+	if testConfig.CertSigning.AuthorizationStore != "" {
+		t.Errorf("Expected AuthorizationStore none to turn saving off, got %q\n", testConfig.CertSigning.AuthorizationStore)
+	}
+
+	testConfig = LoadTheConfig("../TestFixtures/configs/NoRealm.conf.yml", []string{})
+	if testConfig.CertSigning.AuthorizationStore != "/var/lib/spp/authorizations.json" {
+		t.Errorf("Expected the default AuthorizationStore, got %q\n", testConfig.CertSigning.AuthorizationStore)
+	}
+}
+
+func TestPuppetDbConfig(t *testing.T) {
+	testConfig := LoadTheConfig("../TestFixtures/configs/PuppetDb.conf.yml", []string{})
+	puppetDb := testConfig.PuppetDb
+	if puppetDb == nil || puppetDb.Url != "https://puppetdb.my.org:8081" || puppetDb.Timeout != 10*time.Second || puppetDb.ProvisionCheck != "refuse" {
+		t.Fatalf("PuppetDb was not loaded from config: %+v\n", puppetDb)
+	}
+	if puppetDb.ActiveWithin != 24*time.Hour {
+		t.Errorf("Expected the default ActiveWithin of 24h, got %s\n", puppetDb.ActiveWithin)
+	}
+	if testConfig.Deprovision == nil || len(testConfig.Deprovision.CleanupTasks) != 1 || testConfig.Deprovision.CleanupTasks[0] != "remove-from-enc" {
+		t.Errorf("Deprovision was not loaded from config: %+v\n", testConfig.Deprovision)
+	}
 }
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
+)
+
+// authorizationManager lists and cancels pending signing authorizations. The handler takes it rather than a
+// *certsign.CertSigner so its tests can serve canned authorizations without a CA behind them.
+type authorizationManager interface {
+	PendingAuthorizations() []certsign.PendingAuthorization
+	CancelAuthorization(certSubject string) bool
+}
+
+// AuthorizationsHttpHandler lists pending signing authorizations at /authorizations, and cancels one on
+// DELETE /authorizations/<hostname>.
+type AuthorizationsHttpHandler struct {
+	authorizations authorizationManager
+	log            *log.Logger
+}
+
+func NewAuthorizationsHttpHandler(authorizations authorizationManager, log *log.Logger) *AuthorizationsHttpHandler {
+	return &AuthorizationsHttpHandler{authorizations: authorizations, log: log}
+}
+
+func (ctx AuthorizationsHttpHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	hostname := strings.Trim(strings.TrimPrefix(request.URL.Path, "/authorizations"), "/")
+
+	switch request.Method {
+	case http.MethodGet:
+		authorizations := ctx.authorizations.PendingAuthorizations()
+		var responseBody interface{} = authorizations
+		if hostname != "" {
+			responseBody = nil
+			for _, authorization := range authorizations {
+				if authorization.Subject == hostname {
+					responseBody = authorization
+				}
+			}
+			if responseBody == nil {
+				response.WriteHeader(http.StatusNotFound)
+				response.Write([]byte(fmt.Sprintf("There is no pending authorization for %s.", hostname)))
+				return
+			}
+		}
+
+		response.Header().Set("Content-Type", "application/json")
+		jsonWriter := json.NewEncoder(response)
+		if err := jsonWriter.Encode(responseBody); err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+		}
+	case http.MethodDelete:
+		if hostname == "" {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Write([]byte("No hostname provided."))
+			return
+		}
+		if !ctx.authorizations.CancelAuthorization(hostname) {
+			response.WriteHeader(http.StatusNotFound)
+			response.Write([]byte(fmt.Sprintf("There is no pending authorization for %s.", hostname)))
+			return
+		}
+		ctx.log.Printf("Pending authorization for %s was cancelled through the API.\n", hostname)
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		response.Write([]byte("This API accepts only HTTP GET and DELETE method requests."))
+	}
+}
@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
+)
+
+type mockAuthorizationManager struct {
+	pending   []certsign.PendingAuthorization
+	cancelled []string
+}
+
+func (ctx *mockAuthorizationManager) PendingAuthorizations() []certsign.PendingAuthorization {
+	return ctx.pending
+}
+
+func (ctx *mockAuthorizationManager) CancelAuthorization(certSubject string) bool {
+	for i, authorization := range ctx.pending {
+		if authorization.Subject == certSubject {
+			ctx.pending = append(ctx.pending[:i], ctx.pending[i+1:]...)
+			ctx.cancelled = append(ctx.cancelled, certSubject)
+			return true
+		}
+	}
+	return false
+}
+
+func authorizationsSutFactory() (*AuthorizationsHttpHandler, *mockAuthorizationManager) {
+	expires := time.Date(2018, 3, 2, 12, 0, 0, 0, time.UTC)
+	manager := &mockAuthorizationManager{pending: []certsign.PendingAuthorization{
+		{Subject: "foo.bar.com", Created: expires.Add(-24 * time.Hour), Expires: &expires, ExpectedAttributes: []string{"pp_uuid"}},
+	}}
+	return NewAuthorizationsHttpHandler(manager, log.New(&bytes.Buffer{}, "", 0)), manager
+}
+
+func TestAuthorizationsHttpHandler_List(t *testing.T) {
+	sut, _ := authorizationsSutFactory()
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/authorizations", nil))
+
+	if monitor.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, got %d", monitor.Code)
+	}
+	var listing []certsign.PendingAuthorization
+	if err := json.Unmarshal(monitor.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 1 || listing[0].Subject != "foo.bar.com" || listing[0].ExpectedAttributes[0] != "pp_uuid" {
+		t.Errorf("Unexpected listing %s", monitor.Body.String())
+	}
+}
+
+func TestAuthorizationsHttpHandler_Get(t *testing.T) {
+	sut, _ := authorizationsSutFactory()
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/authorizations/foo.bar.com", nil))
+	if monitor.Code != http.StatusOK {
+		t.Errorf("Expected HTTP 200, got %d", monitor.Code)
+	}
+
+	monitor = httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/authorizations/nope.bar.com", nil))
+	if monitor.Code != http.StatusNotFound {
+		t.Errorf("Expected HTTP 404 for a subject without an authorization, got %d", monitor.Code)
+	}
+}
+
+func TestAuthorizationsHttpHandler_Cancel(t *testing.T) {
+	sut, manager := authorizationsSutFactory()
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodDelete, "/authorizations/foo.bar.com", nil))
+
+	if monitor.Code != http.StatusNoContent {
+		t.Errorf("Expected HTTP 204, got %d", monitor.Code)
+	}
+	if len(manager.cancelled) != 1 || manager.cancelled[0] != "foo.bar.com" {
+		t.Errorf("Expected foo.bar.com to be cancelled, got %v", manager.cancelled)
+	}
+
+	monitor = httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodDelete, "/authorizations/foo.bar.com", nil))
+	if monitor.Code != http.StatusNotFound {
+		t.Errorf("Expected HTTP 404 cancelling an authorization twice, got %d", monitor.Code)
+	}
+}
+
+func TestAuthorizationsHttpHandler_RejectsOtherMethods(t *testing.T) {
+	sut, _ := authorizationsSutFactory()
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodPost, "/authorizations", nil))
+	if monitor.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected HTTP 405, got %d", monitor.Code)
+	}
+}
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultAutosignSocket is where the autosign-check subcommand looks for the daemon unless told otherwise.
+const DefaultAutosignSocket = "/var/run/spp/autosign.sock"
+
+// autosignChecker decides whether the CA may sign a CSR, explaining the decision. The socket server only relays
+// that decision, so its tests stand in a checker with fixed answers for the CertSigner.
+type autosignChecker interface {
+	AutosignCheck(certSubject string, csrPem []byte) (bool, string)
+}
+
+// AutosignSocketServer answers autosign checks from the autosign-check subcommand over a local Unix socket.
+// A POST to /autosign-check/<certname> with the CSR as the body gets 200 if the CA may sign it, or 403 if not.
+type AutosignSocketServer struct {
+	path    string
+	checker autosignChecker
+	log     *log.Logger
+	server  http.Server
+}
+
+func NewAutosignSocketServer(path string, checker autosignChecker, log *log.Logger) *AutosignSocketServer {
+	socketServer := AutosignSocketServer{path: path, checker: checker, log: log}
+	socketServer.server = http.Server{Handler: &socketServer, ErrorLog: log}
+	return &socketServer
+}
+
+// Start listens on the socket, replacing any left behind by an earlier process, and serves checks until Shutdown.
+func (ctx *AutosignSocketServer) Start() error {
+	if err := os.Remove(ctx.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", ctx.path)
+	if err != nil {
+		return err
+	}
+	// Puppet server runs the autosign executable as its own user, which is normally the user SPP runs as too.
+	if err := os.Chmod(ctx.path, 0660); err != nil {
+		listener.Close()
+		return err
+	}
+
+	ctx.log.Printf("Answering autosign checks on %s\n", ctx.path)
+	go ctx.server.Serve(listener)
+	return nil
+}
+
+func (ctx *AutosignSocketServer) Shutdown(shutdownCtx context.Context) error {
+	return ctx.server.Shutdown(shutdownCtx)
+}
+
+func (ctx *AutosignSocketServer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost || !strings.HasPrefix(request.URL.Path, "/autosign-check/") {
+		response.WriteHeader(http.StatusNotFound)
+		return
+	}
+	certname := strings.TrimPrefix(request.URL.Path, "/autosign-check/")
+	csrPem, err := ioutil.ReadAll(io.LimitReader(request.Body, 64*1024))
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	approved, message := ctx.checker.AutosignCheck(certname, csrPem)
+	if approved {
+		response.WriteHeader(http.StatusOK)
+	} else {
+		response.WriteHeader(http.StatusForbidden)
+	}
+	response.Write([]byte(message))
+}
+
+// AutosignCheck asks the daemon listening on socketPath whether certname's CSR may be signed, returning the
+// daemon's decision and its explanation.
+func AutosignCheck(socketPath string, certname string, csr io.Reader) (bool, string, error) {
+	client := http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(dialCtx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(dialCtx, "unix", socketPath)
+			},
+		},
+	}
+
+	// The host is ignored; the connection always goes to the socket.
+	response, err := client.Post("http://spp/autosign-check/"+url.PathEscape(certname), "application/x-pem-file", csr)
+	if err != nil {
+		return false, "", err
+	}
+	defer response.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, string(message), nil
+	case http.StatusForbidden:
+		return false, string(message), nil
+	default:
+		return false, "", fmt.Errorf("SPP responded HTTP %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type mockAutosignChecker struct {
+	certname string
+	csrPem   []byte
+}
+
+func (ctx *mockAutosignChecker) AutosignCheck(certSubject string, csrPem []byte) (bool, string) {
+	ctx.certname = certSubject
+	ctx.csrPem = csrPem
+	if certSubject == "foo.bar.com" {
+		return true, "foo.bar.com is authorized for signing."
+	}
+	return false, "There is no pending authorization for " + certSubject + "."
+}
+
+func TestAutosignSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spp-autosign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "autosign.sock")
+
+	checker := &mockAutosignChecker{}
+	sut := NewAutosignSocketServer(socketPath, checker, log.New(&bytes.Buffer{}, "", 0))
+	if err := sut.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sut.Shutdown(context.Background())
+
+	approved, message, err := AutosignCheck(socketPath, "foo.bar.com", strings.NewReader("-----BEGIN CERTIFICATE REQUEST-----"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !approved || message != "foo.bar.com is authorized for signing." {
+		t.Errorf("Expected approval, got %v \"%s\"", approved, message)
+	}
+	if checker.certname != "foo.bar.com" || string(checker.csrPem) != "-----BEGIN CERTIFICATE REQUEST-----" {
+		t.Errorf("Checker was passed \"%s\" and \"%s\"", checker.certname, checker.csrPem)
+	}
+
+	approved, message, err = AutosignCheck(socketPath, "baz.bar.com", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approved || message != "There is no pending authorization for baz.bar.com." {
+		t.Errorf("Expected refusal, got %v \"%s\"", approved, message)
+	}
+}
+
+func TestAutosignCheck_DaemonNotListening(t *testing.T) {
+	_, _, err := AutosignCheck("/nonexistent/autosign.sock", "foo.bar.com", strings.NewReader(""))
+	if err == nil {
+		t.Error("Expected an error when no daemon is listening.")
+	}
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
+)
+
+// certInventory provides the combined listing of signed certificates, pending CSRs and pending authorizations that
+// the handler narrows down. Taking an interface keeps filtering testable without a CA on disk.
+type certInventory interface {
+	Inventory() ([]certsign.InventoryEntry, error)
+}
+
+// CertificatesHttpHandler lists the CA's signed certificates, pending CSRs and pending authorizations at /certificates.
+// The listing may be narrowed with a "name" glob pattern such as *.cluster.org, and with one or more "state"s.
+type CertificatesHttpHandler struct {
+	inventory certInventory
+	log       *log.Logger
+}
+
+func NewCertificatesHttpHandler(inventory certInventory, log *log.Logger) *CertificatesHttpHandler {
+	return &CertificatesHttpHandler{inventory: inventory, log: log}
+}
+
+func (ctx CertificatesHttpHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		response.Write([]byte("This API accepts only HTTP GET method requests."))
+		return
+	}
+
+	query := request.URL.Query()
+	namePattern := query.Get("name")
+	if _, err := path.Match(namePattern, ""); err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte(fmt.Sprintf("Invalid name pattern \"%s\".", namePattern)))
+		return
+	}
+	states := make(map[string]bool)
+	for _, stateList := range query["state"] {
+		for _, state := range strings.Split(stateList, ",") {
+			switch state {
+			case certsign.CertStateSigned, certsign.CertStateRequested, certsign.CertStateAuthorized:
+				states[state] = true
+			default:
+				response.WriteHeader(http.StatusBadRequest)
+				response.Write([]byte(fmt.Sprintf("Unknown state \"%s\". Valid states are %s, %s and %s.", state, certsign.CertStateSigned, certsign.CertStateRequested, certsign.CertStateAuthorized)))
+				return
+			}
+		}
+	}
+
+	inventory, err := ctx.inventory.Inventory()
+	if err != nil {
+		ctx.log.Printf("Certificate inventory failed: %s\n", err.Error())
+		response.WriteHeader(http.StatusInternalServerError)
+		response.Write([]byte("Certificate inventory failed. More info in the log."))
+		return
+	}
+
+	listing := make([]certsign.InventoryEntry, 0, len(inventory))
+	for _, entry := range inventory {
+		if len(states) > 0 && !states[entry.State] {
+			continue
+		}
+		if namePattern != "" {
+			if matched, _ := path.Match(namePattern, entry.Subject); !matched {
+				continue
+			}
+		}
+		listing = append(listing, entry)
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	jsonWriter := json.NewEncoder(response)
+	if err := jsonWriter.Encode(listing); err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
+)
+
+type mockCertInventory struct {
+	entries []certsign.InventoryEntry
+	err     error
+}
+
+func (ctx mockCertInventory) Inventory() ([]certsign.InventoryEntry, error) {
+	return ctx.entries, ctx.err
+}
+
+func certificatesSutFactory() *CertificatesHttpHandler {
+	return NewCertificatesHttpHandler(mockCertInventory{entries: []certsign.InventoryEntry{
+		{Subject: "compute-1.cluster.org", State: certsign.CertStateSigned, Serial: "0A", SignedBy: "policy", Policy: "compute"},
+		{Subject: "compute-2.cluster.org", State: certsign.CertStateRequested},
+		{Subject: "compute-2.cluster.org", State: certsign.CertStateAuthorized},
+		{Subject: "web.bar.com", State: certsign.CertStateSigned},
+	}}, log.New(&bytes.Buffer{}, "", 0))
+}
+
+func getCertificates(t *testing.T, sut *CertificatesHttpHandler, url string) []certsign.InventoryEntry {
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, url, nil))
+	if monitor.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200 for %s, got %d", url, monitor.Code)
+	}
+	var listing []certsign.InventoryEntry
+	if err := json.Unmarshal(monitor.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	return listing
+}
+
+func TestCertificatesHttpHandler_Filters(t *testing.T) {
+	sut := certificatesSutFactory()
+
+	if listing := getCertificates(t, sut, "/certificates"); len(listing) != 4 {
+		t.Errorf("Expected 4 entries, got %+v", listing)
+	}
+	if listing := getCertificates(t, sut, "/certificates?name=*.cluster.org"); len(listing) != 3 {
+		t.Errorf("Expected 3 entries matching *.cluster.org, got %+v", listing)
+	}
+	listing := getCertificates(t, sut, "/certificates?name=*.cluster.org&state=signed")
+	if len(listing) != 1 || listing[0].Subject != "compute-1.cluster.org" || listing[0].Policy != "compute" {
+		t.Errorf("Expected only compute-1.cluster.org, got %+v", listing)
+	}
+	if listing := getCertificates(t, sut, "/certificates?state=requested,authorized"); len(listing) != 2 {
+		t.Errorf("Expected 2 pending entries, got %+v", listing)
+	}
+	if listing := getCertificates(t, sut, "/certificates?state=signed&state=requested"); len(listing) != 3 {
+		t.Errorf("Expected 3 signed or requested entries, got %+v", listing)
+	}
+}
+
+func TestCertificatesHttpHandler_BadRequests(t *testing.T) {
+	sut := certificatesSutFactory()
+	for _, url := range []string{"/certificates?state=revoked", "/certificates?name=[web"} {
+		monitor := httptest.NewRecorder()
+		sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, url, nil))
+		if monitor.Code != http.StatusBadRequest {
+			t.Errorf("Expected HTTP 400 for %s, got %d", url, monitor.Code)
+		}
+	}
+
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodPost, "/certificates", nil))
+	if monitor.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected HTTP 405, got %d", monitor.Code)
+	}
+}
+
+func TestCertificatesHttpHandler_InventoryFailure(t *testing.T) {
+	var logBuf bytes.Buffer
+	sut := NewCertificatesHttpHandler(mockCertInventory{err: errors.New("permission denied")}, log.New(&logBuf, "", 0))
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/certificates", nil))
+	if monitor.Code != http.StatusInternalServerError {
+		t.Errorf("Expected HTTP 500, got %d", monitor.Code)
+	}
+	if !bytes.Contains(logBuf.Bytes(), []byte("permission denied")) {
+		t.Error("Inventory failure was not logged.")
+	}
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
+	"github.com/mbaynton/go-genericexec"
+)
+
+// DeprovisionConfig customizes the built-in deprovision task.
+type DeprovisionConfig struct {
+	// Names of GenericExecTasks to run once the certificate is revoked and the node deactivated, for example to
+	// remove the host from an ENC.
+	CleanupTasks []string
+}
+
+// certCleaner queues revoking and deleting a host's certificate, so that a Deprovisioner can be tested against
+// canned revocation results.
+type certCleaner interface {
+	QueueClean(hostname string) (<-chan certsign.SigningResult, error)
+}
+
+// execTaskRunner runs GenericExecTasks by name. Cleanup tasks are named in configuration, so the Deprovisioner checks
+// each is configured before running it; tests supply exit codes instead of running commands.
+type execTaskRunner interface {
+	IsTaskConfigured(name string) bool
+	RunTask(taskName string, argValues genericexec.TemplateGetter) <-chan genericexec.GenericExecResult
+}
+
+// nodeDeactivator deactivates a node through PuppetDB's command API. It is nil when PuppetDB is not configured,
+// which leaves the PuppetDB step out.
+type nodeDeactivator interface {
+	DeactivateNode(certname string) error
+}
+
+// Deprovisioner retires a node: its certificate is revoked, it is deactivated in PuppetDB, and any configured
+// cleanup tasks are run.
+type Deprovisioner struct {
+	certSigner   certCleaner
+	execManager  execTaskRunner
+	puppetDb     nodeDeactivator
+	cleanupTasks []string
+	notify       func(message string)
+	log          *log.Logger
+}
+
+// DeprovisionStep is one of the steps of deprovisioning a node, reported under its own Name in /provision responses.
+type DeprovisionStep struct {
+	Name   string
+	Result <-chan DeprovisionStepResult
+}
+
+// DeprovisionStepResult is the outcome of a DeprovisionStep.
+type DeprovisionStepResult struct {
+	Name string
+	TaskResult
+}
+
+// NewDeprovisioner returns a Deprovisioner. puppetDb may be nil when PuppetDB is not configured, in which case
+// there is no PuppetDB step.
+func NewDeprovisioner(config *DeprovisionConfig, certSigner certCleaner, execManager execTaskRunner, puppetDb nodeDeactivator, notify func(message string), log *log.Logger) *Deprovisioner {
+	deprovisioner := Deprovisioner{
+		certSigner:  certSigner,
+		execManager: execManager,
+		puppetDb:    puppetDb,
+		notify:      notify,
+		log:         log,
+	}
+	if config != nil {
+		deprovisioner.cleanupTasks = config.CleanupTasks
+	}
+	return &deprovisioner
+}
+
+// Deprovision starts deprovisioning hostname and returns its steps, each of which delivers one result when it
+// finishes. The certificate revocation and PuppetDB deactivation, if PuppetDB is configured, run at once; cleanup
+// tasks run after both, whatever their outcome, with argValues available to their templates. Nothing is started if the certificate signing queue
+// is full, in which case certsign.ErrQueueFull is returned.
+func (ctx *Deprovisioner) Deprovision(hostname string, argValues genericexec.TemplateGetter) ([]DeprovisionStep, error) {
+	cleaningResultChan, err := ctx.certSigner.QueueClean(hostname)
+	if err == certsign.ErrQueueFull {
+		return nil, err
+	} else if err != nil {
+		cleaningResultChan = failedSigningResult(err, "revoke")
+	}
+	ctx.notify(fmt.Sprintf("Deprovisioning %s...", hostname))
+
+	var steps []DeprovisionStep
+	var prerequisites sync.WaitGroup
+
+	prerequisites.Add(1)
+	revoke := make(chan DeprovisionStepResult, 1)
+	steps = append(steps, DeprovisionStep{Name: "deprovision-cert-revoke", Result: revoke})
+	go func() {
+		defer prerequisites.Done()
+		result := <-cleaningResultChan
+		revoke <- DeprovisionStepResult{
+			Name:       "deprovision-cert-revoke",
+			TaskResult: TaskResult{Complete: true, Success: result.Success, Message: result.Message},
+		}
+		close(revoke)
+	}()
+
+	if ctx.puppetDb != nil {
+		prerequisites.Add(1)
+		deactivate := make(chan DeprovisionStepResult, 1)
+		steps = append(steps, DeprovisionStep{Name: "deprovision-puppetdb", Result: deactivate})
+		go func() {
+			defer prerequisites.Done()
+			deactivate <- DeprovisionStepResult{Name: "deprovision-puppetdb", TaskResult: ctx.deactivate(hostname)}
+			close(deactivate)
+		}()
+	}
+
+	for _, taskName := range ctx.cleanupTasks {
+		cleanup := make(chan DeprovisionStepResult, 1)
+		stepName := fmt.Sprintf("deprovision-%s", taskName)
+		steps = append(steps, DeprovisionStep{Name: stepName, Result: cleanup})
+		go func(taskName string, stepName string, cleanup chan<- DeprovisionStepResult) {
+			prerequisites.Wait()
+			cleanup <- DeprovisionStepResult{Name: stepName, TaskResult: ctx.runCleanupTask(taskName, argValues)}
+			close(cleanup)
+		}(taskName, stepName, cleanup)
+	}
+
+	return steps, nil
+}
+
+// StepNames lists the names of the steps Deprovision starts, in order.
+func (ctx *Deprovisioner) StepNames() []string {
+	names := []string{"deprovision-cert-revoke"}
+	if ctx.puppetDb != nil {
+		names = append(names, "deprovision-puppetdb")
+	}
+	for _, taskName := range ctx.cleanupTasks {
+		names = append(names, fmt.Sprintf("deprovision-%s", taskName))
+	}
+	return names
+}
+
+func (ctx *Deprovisioner) deactivate(hostname string) TaskResult {
+	if err := ctx.puppetDb.DeactivateNode(hostname); err != nil {
+		info := fmt.Sprintf("ERROR deactivating %s in PuppetDB: %s", hostname, err.Error())
+		ctx.log.Println(info)
+		ctx.notify(info)
+		return TaskResult{Complete: true, Success: false, Message: info}
+	}
+	info := fmt.Sprintf("%s was deactivated in PuppetDB.", hostname)
+	ctx.log.Println(info)
+	ctx.notify(info)
+	return TaskResult{Complete: true, Success: true, Message: info}
+}
+
+func (ctx *Deprovisioner) runCleanupTask(taskName string, argValues genericexec.TemplateGetter) TaskResult {
+	if !ctx.execManager.IsTaskConfigured(taskName) {
+		ctx.log.Printf("Deprovision cleanup task \"%s\" is not one of the GenericExecTasks.\n", taskName)
+		return TaskResult{Complete: true, Success: false, Message: "Task name is not recognized."}
+	}
+	result := <-ctx.execManager.RunTask(taskName, argValues)
+	return TaskResult{Complete: true, Success: result.ExitCode == 0, Message: result.Message}
+}
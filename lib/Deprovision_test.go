@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
+	"github.com/mbaynton/go-genericexec"
+)
+
+type mockCertCleaner struct {
+	result certsign.SigningResult
+	err    error
+}
+
+func (ctx mockCertCleaner) QueueClean(hostname string) (<-chan certsign.SigningResult, error) {
+	if ctx.err != nil {
+		return nil, ctx.err
+	}
+	resultChan := make(chan certsign.SigningResult, 1)
+	resultChan <- ctx.result
+	close(resultChan)
+	return resultChan, nil
+}
+
+type mockExecTaskRunner struct {
+	exitCodes map[string]int
+	ran       []string
+	lock      sync.Mutex
+}
+
+func (ctx *mockExecTaskRunner) IsTaskConfigured(name string) bool {
+	_, configured := ctx.exitCodes[name]
+	return configured
+}
+
+func (ctx *mockExecTaskRunner) RunTask(taskName string, argValues genericexec.TemplateGetter) <-chan genericexec.GenericExecResult {
+	ctx.lock.Lock()
+	ctx.ran = append(ctx.ran, taskName+" "+argValues.Get("hostname"))
+	ctx.lock.Unlock()
+	resultChan := make(chan genericexec.GenericExecResult, 1)
+	resultChan <- genericexec.GenericExecResult{Name: taskName, ExitCode: ctx.exitCodes[taskName], Message: taskName + " ran"}
+	close(resultChan)
+	return resultChan
+}
+
+type mockNodeDeactivator struct {
+	err         error
+	deactivated []string
+	lock        sync.Mutex
+}
+
+func (ctx *mockNodeDeactivator) DeactivateNode(certname string) error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.deactivated = append(ctx.deactivated, certname)
+	return ctx.err
+}
+
+func collectDeprovisionSteps(t *testing.T, steps []DeprovisionStep) map[string]TaskResult {
+	results := map[string]TaskResult{}
+	for _, step := range steps {
+		result := <-step.Result
+		if result.Name != step.Name {
+			t.Errorf("Step %s reported a result named %s", step.Name, result.Name)
+		}
+		results[result.Name] = result.TaskResult
+	}
+	return results
+}
+
+func TestDeprovisioner_Deprovision(t *testing.T) {
+	execManager := &mockExecTaskRunner{exitCodes: map[string]int{"remove-from-enc": 0, "remove-dns": 1}}
+	puppetDb := &mockNodeDeactivator{}
+	var notifications []string
+	var notificationsLock sync.Mutex
+	sut := NewDeprovisioner(
+		&DeprovisionConfig{CleanupTasks: []string{"remove-from-enc", "remove-dns", "missing"}},
+		mockCertCleaner{result: certsign.SigningResult{Action: "revoke", Success: true, Message: "Cleaned foo.bar.com."}},
+		execManager,
+		puppetDb,
+		func(message string) {
+			notificationsLock.Lock()
+			defer notificationsLock.Unlock()
+			notifications = append(notifications, message)
+		},
+		log.New(&bytes.Buffer{}, "", 0),
+	)
+
+	steps, err := sut.Deprovision("foo.bar.com", url.Values{"hostname": {"foo.bar.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := collectDeprovisionSteps(t, steps)
+
+	expect := map[string]TaskResult{
+		"deprovision-cert-revoke":     {Complete: true, Success: true, Message: "Cleaned foo.bar.com."},
+		"deprovision-puppetdb":        {Complete: true, Success: true, Message: "foo.bar.com was deactivated in PuppetDB."},
+		"deprovision-remove-from-enc": {Complete: true, Success: true, Message: "remove-from-enc ran"},
+		"deprovision-remove-dns":      {Complete: true, Success: false, Message: "remove-dns ran"},
+		"deprovision-missing":         {Complete: true, Success: false, Message: "Task name is not recognized."},
+	}
+	if len(results) != len(expect) {
+		t.Errorf("Expected %d steps, got %+v", len(expect), results)
+	}
+	for name, expected := range expect {
+		if results[name] != expected {
+			t.Errorf("Expected %s to report %+v, got %+v", name, expected, results[name])
+		}
+	}
+	if len(puppetDb.deactivated) != 1 || puppetDb.deactivated[0] != "foo.bar.com" {
+		t.Errorf("Expected foo.bar.com to be deactivated, got %v", puppetDb.deactivated)
+	}
+	if len(execManager.ran) != 2 {
+		t.Errorf("Expected the two configured cleanup tasks to run, got %v", execManager.ran)
+	}
+	if len(notifications) != 2 || notifications[0] != "Deprovisioning foo.bar.com..." {
+		t.Errorf("Unexpected notifications %v", notifications)
+	}
+}
+
+func TestDeprovisioner_Deprovision_Failures(t *testing.T) {
+	sut := NewDeprovisioner(
+		nil,
+		mockCertCleaner{result: certsign.SigningResult{Action: "revoke", Success: false, Message: "Cleaning failed."}},
+		&mockExecTaskRunner{},
+		&mockNodeDeactivator{err: errors.New("PuppetDB responded HTTP 503: unavailable")},
+		func(message string) {},
+		log.New(&bytes.Buffer{}, "", 0),
+	)
+
+	steps, err := sut.Deprovision("foo.bar.com", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := collectDeprovisionSteps(t, steps)
+	if len(results) != 2 {
+		t.Errorf("Expected only the revoke and PuppetDB steps, got %+v", results)
+	}
+	if result := results["deprovision-cert-revoke"]; result.Success || result.Message != "Cleaning failed." {
+		t.Errorf("Expected the revocation failure to be reported, got %+v", result)
+	}
+	expect := "ERROR deactivating foo.bar.com in PuppetDB: PuppetDB responded HTTP 503: unavailable"
+	if result := results["deprovision-puppetdb"]; result.Success || result.Message != expect {
+		t.Errorf("Expected the deactivation failure to be reported, got %+v", result)
+	}
+}
+
+func TestDeprovisioner_Deprovision_WithoutPuppetDb(t *testing.T) {
+	sut := NewDeprovisioner(nil, mockCertCleaner{result: certsign.SigningResult{Action: "revoke", Success: true}}, &mockExecTaskRunner{}, nil, func(message string) {}, log.New(&bytes.Buffer{}, "", 0))
+
+	steps, _ := sut.Deprovision("foo.bar.com", url.Values{})
+	if _, found := collectDeprovisionSteps(t, steps)["deprovision-puppetdb"]; found {
+		t.Error("A PuppetDB step was run although PuppetDB is not configured.")
+	}
+	if names := sut.StepNames(); len(names) != 1 || names[0] != "deprovision-cert-revoke" {
+		t.Errorf("Expected only the certificate revocation step, got %v", names)
+	}
+}
+
+func TestDeprovisioner_Deprovision_QueueFull(t *testing.T) {
+	puppetDb := &mockNodeDeactivator{}
+	sut := NewDeprovisioner(nil, mockCertCleaner{err: certsign.ErrQueueFull}, &mockExecTaskRunner{}, puppetDb, func(message string) {}, log.New(&bytes.Buffer{}, "", 0))
+
+	if _, err := sut.Deprovision("foo.bar.com", url.Values{}); err != certsign.ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if len(puppetDb.deactivated) != 0 {
+		t.Error("The node was deactivated although its certificate could not be revoked.")
+	}
+}
@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How often a stream of provisioning progress sends a heartbeat event while no task has finished.
+const sseHeartbeatInterval = 15 * time.Second
+
+// eventStream writes server-sent events, for clients that follow a request's progress as it happens.
+type eventStream struct {
+	response http.ResponseWriter
+	flusher  http.Flusher
+}
+
+// taskEvent is the data of an event reporting a task's result.
+type taskEvent struct {
+	Task string
+	TaskResult
+}
+
+// wantsEventStream reports whether the request asked for server-sent events.
+func wantsEventStream(request *http.Request) bool {
+	return strings.Contains(request.Header.Get("Accept"), "text/event-stream")
+}
+
+// newEventStream starts a response of server-sent events, or returns nil if the response can't be streamed.
+func newEventStream(response http.ResponseWriter) *eventStream {
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		return nil
+	}
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &eventStream{response: response, flusher: flusher}
+}
+
+// send writes an event of the given type, whose data is the JSON encoding of data.
+func (ctx *eventStream) send(event string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(ctx.response, "event: %s\ndata: %s\n\n", event, encoded); err != nil {
+		return err
+	}
+	ctx.flusher.Flush()
+	return nil
+}
+
+func (ctx *eventStream) task(task string, result TaskResult) error {
+	return ctx.send("task", taskEvent{Task: task, TaskResult: result})
+}
+
+func (ctx *eventStream) heartbeat(now time.Time) error {
+	return ctx.send("heartbeat", map[string]time.Time{"Time": now})
+}
@@ -0,0 +1,40 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWantsEventStream(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/provision", nil)
+	if wantsEventStream(request) {
+		t.Error("A request without an Accept header should not be streamed.")
+	}
+	request.Header.Set("Accept", "text/event-stream, application/json;q=0.5")
+	if !wantsEventStream(request) {
+		t.Error("A request accepting text/event-stream should be streamed.")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	monitor := httptest.NewRecorder()
+	sut := newEventStream(monitor)
+	if sut == nil {
+		t.Fatal("Expected the recorder to be streamable.")
+	}
+	sut.task("cert-sign", TaskResult{Complete: true, Success: true, Message: "Signed."})
+	sut.heartbeat(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	sut.send("summary", map[string]bool{"Complete": true})
+
+	if monitor.Code != http.StatusOK || monitor.Header().Get("Content-Type") != "text/event-stream" || !monitor.Flushed {
+		t.Errorf("Unexpected response %d %v, flushed %v", monitor.Code, monitor.Header(), monitor.Flushed)
+	}
+	expect := "event: task\ndata: {\"Task\":\"cert-sign\",\"Complete\":true,\"Success\":true,\"Message\":\"Signed.\"}\n\n" +
+		"event: heartbeat\ndata: {\"Time\":\"2018-05-01T12:00:00Z\"}\n\n" +
+		"event: summary\ndata: {\"Complete\":true}\n\n"
+	if monitor.Body.String() != expect {
+		t.Errorf("Expected\n%s\ngot\n%s", expect, monitor.Body.String())
+	}
+}
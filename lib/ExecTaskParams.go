@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Types of ExecTaskParam values.
+const (
+	ParamTypeString   = "string"
+	ParamTypeInteger  = "integer"
+	ParamTypeBoolean  = "boolean"
+	ParamTypeHostname = "hostname"
+)
+
+// A hostname is dot-separated labels of letters, digits and inner hyphens.
+var hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// ExecTaskParam declares a value a GenericExecTask takes from the request, and what values are accepted.
+type ExecTaskParam struct {
+	Name string
+	// string (default), integer, boolean or hostname.
+	Type string
+	// A regular expression the whole value must match.
+	Regex string
+	// The only values accepted, if given.
+	Allowed  []string
+	Required bool
+	// Used when the request does not give a value.
+	Default string
+
+	regex *regexp.Regexp
+}
+
+// compileParams checks the task's parameter declarations, and prepares their regular expressions.
+func (config *ExecTaskConfig) compileParams() error {
+	for _, param := range config.Params {
+		if param.Name == "" {
+			return fmt.Errorf("A parameter of the %s task has no Name.", config.Name)
+		}
+		switch param.Type {
+		case "":
+			param.Type = ParamTypeString
+		case ParamTypeString, ParamTypeInteger, ParamTypeBoolean, ParamTypeHostname:
+		default:
+			return fmt.Errorf("The %s parameter of the %s task has unknown Type \"%s\".", param.Name, config.Name, param.Type)
+		}
+		if param.Regex != "" {
+			regex, err := regexp.Compile("^(?:" + param.Regex + ")$")
+			if err != nil {
+				return fmt.Errorf("The %s parameter of the %s task has an invalid Regex: %s", param.Name, config.Name, err.Error())
+			}
+			param.regex = regex
+		}
+		if param.Default != "" {
+			if problem := param.check(param.Default); problem != "" {
+				return fmt.Errorf("The Default of the %s parameter of the %s task %s.", param.Name, config.Name, problem)
+			}
+		}
+	}
+	return nil
+}
+
+// validateParams checks values against the task's parameter declarations. It returns the values the task is to be
+// run with, which include the defaults of any parameters not given, and a description of each value that is not
+// accepted.
+func (config *ExecTaskConfig) validateParams(values url.Values) (url.Values, []string) {
+	var violations []string
+	withDefaults := values
+	copied := false
+	for _, param := range config.Params {
+		value := values.Get(param.Name)
+		if value == "" {
+			if param.Default != "" {
+				// The values may be shared with other tasks, which should not see this task's defaults.
+				if !copied {
+					withDefaults = make(url.Values, len(values))
+					for name, given := range values {
+						withDefaults[name] = given
+					}
+					copied = true
+				}
+				withDefaults.Set(param.Name, param.Default)
+			} else if param.Required {
+				violations = append(violations, fmt.Sprintf("The %s task's %s parameter is required.", config.Name, param.Name))
+			}
+			continue
+		}
+		if problem := param.check(value); problem != "" {
+			violations = append(violations, fmt.Sprintf("The %s task's %s parameter %s.", config.Name, param.Name, problem))
+		}
+	}
+	return withDefaults, violations
+}
+
+// check returns why value is not accepted, or "" if it is.
+func (param *ExecTaskParam) check(value string) string {
+	switch param.Type {
+	case ParamTypeInteger:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "must be an integer"
+		}
+	case ParamTypeBoolean:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "must be true or false"
+		}
+	case ParamTypeHostname:
+		if len(value) > 253 || !hostnamePattern.MatchString(value) {
+			return "must be a hostname"
+		}
+	}
+	if param.regex != nil && !param.regex.MatchString(value) {
+		return fmt.Sprintf("must match %s", param.Regex)
+	}
+	if len(param.Allowed) > 0 && !containsString(param.Allowed, value) {
+		return fmt.Sprintf("must be one of %s", strings.Join(param.Allowed, ", "))
+	}
+	return ""
+}
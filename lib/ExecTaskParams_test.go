@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/mbaynton/go-genericexec"
+)
+
+func newParamsTestTask(t *testing.T, name string, params ...*ExecTaskParam) *ExecTaskConfig {
+	task := &ExecTaskConfig{GenericExecConfig: genericexec.GenericExecConfig{Name: name}, Params: params}
+	if err := task.compileParams(); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func TestExecTaskConfig_validateParams(t *testing.T) {
+	sut := newParamsTestTask(t, "environment",
+		&ExecTaskParam{Name: "environment", Required: true, Allowed: []string{"production", "staging"}},
+		&ExecTaskParam{Name: "hostname", Type: ParamTypeHostname},
+		&ExecTaskParam{Name: "ticket", Regex: `[A-Z]+-[0-9]+`},
+		&ExecTaskParam{Name: "retries", Type: ParamTypeInteger, Default: "3"},
+		&ExecTaskParam{Name: "noop", Type: ParamTypeBoolean},
+	)
+
+	given := url.Values{"environment": {"staging"}, "hostname": {"foo.bar.com"}, "ticket": {"OPS-12"}, "noop": {"true"}}
+	values, violations := sut.validateParams(given)
+	if len(violations) != 0 {
+		t.Errorf("Expected valid values, got %v", violations)
+	}
+	if values.Get("retries") != "3" || given.Get("retries") != "" {
+		t.Errorf("Expected the default to be filled in on a copy, got %v and %v", values, given)
+	}
+
+	_, violations = sut.validateParams(url.Values{"hostname": {"foo.bar.com; rm -rf /"}, "ticket": {"OPS-12x"}, "retries": {"many"}, "noop": {"maybe"}})
+	expect := []string{
+		"The environment task's environment parameter is required.",
+		"The environment task's hostname parameter must be a hostname.",
+		"The environment task's ticket parameter must match [A-Z]+-[0-9]+.",
+		"The environment task's retries parameter must be an integer.",
+		"The environment task's noop parameter must be true or false.",
+	}
+	if !reflect.DeepEqual(violations, expect) {
+		t.Errorf("Expected violations %v, got %v", expect, violations)
+	}
+
+	_, violations = sut.validateParams(url.Values{"environment": {"prod"}})
+	if len(violations) != 1 || violations[0] != "The environment task's environment parameter must be one of production, staging." {
+		t.Errorf("Unexpected violations %v", violations)
+	}
+}
+
+func TestExecTaskConfig_compileParams(t *testing.T) {
+	invalid := map[string]*ExecTaskParam{
+		"A parameter of the task task has no Name.":                                                                  {},
+		"The x parameter of the task task has unknown Type \"float\".":                                               {Name: "x", Type: "float"},
+		"The Default of the x parameter of the task task must be an integer.":                                        {Name: "x", Type: ParamTypeInteger, Default: "one"},
+		"The x parameter of the task task has an invalid Regex: error parsing regexp: missing closing ): `^(?:(a)$`": {Name: "x", Regex: "(a"},
+	}
+	for expect, param := range invalid {
+		task := &ExecTaskConfig{GenericExecConfig: genericexec.GenericExecConfig{Name: "task"}, Params: []*ExecTaskParam{param}}
+		if err := task.compileParams(); err == nil || err.Error() != expect {
+			t.Errorf("Expected error %q, got %v", expect, err)
+		}
+	}
+}
+
+func TestProvisionHttpHandler_start_InvalidParams(t *testing.T) {
+	sut := ProvisionHttpHandler{appConfig: &AppConfig{}, execTasks: map[string]*ExecTaskConfig{
+		"environment": newParamsTestTask(t, "environment", &ExecTaskParam{Name: "environment", Allowed: []string{"production"}}),
+		"dns":         newParamsTestTask(t, "dns", &ExecTaskParam{Name: "hostname", Type: ParamTypeHostname}, &ExecTaskParam{Name: "zone", Required: true}),
+	}}
+	form := url.Values{"hostname": {"foo_bar"}, "environment": {"qa"}}
+	tasks := sort.StringSlice{"dns", "environment"}
+
+	started, err := sut.start(&provisionRequest{
+		hostname: "foo_bar",
+		tasks:    tasks,
+		params:   map[string]url.Values{"dns": form, "environment": form},
+	})
+	if started != nil || err == nil || err.status != http.StatusBadRequest {
+		t.Fatalf("Expected the request to be refused with HTTP 400, got %+v", err)
+	}
+	expect := []string{
+		"The dns task's hostname parameter must be a hostname.",
+		"The dns task's zone parameter is required.",
+		"The environment task's environment parameter must be one of production.",
+	}
+	if !reflect.DeepEqual(err.violations, expect) {
+		t.Errorf("Expected violations %v, got %v", expect, err.violations)
+	}
+}
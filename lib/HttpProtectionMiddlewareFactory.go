@@ -3,12 +3,15 @@ package lib
 // Middleware enforcing authentication of requests according to the configuration.
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
 	"github.com/abbot/go-http-auth"
 )
 
+type authenticatedUserKey struct{}
+
 type HttpProtectionMiddlewareFactory struct {
 	config *HttpAuthConfig
 
@@ -54,5 +57,12 @@ func (ctx *HttpProtectionMiddlewareFactory) ServeHTTP(response http.ResponseWrit
 
 // This func exists just because it provides the signature the authenticator.Wrap method is looking for.
 func (ctx *HttpProtectionMiddlewareFactory) handle(w http.ResponseWriter, request *auth.AuthenticatedRequest) {
-	ctx.protectedHandler.ServeHTTP(w, &request.Request)
+	authenticatedRequest := request.Request.WithContext(context.WithValue(request.Request.Context(), authenticatedUserKey{}, request.Username))
+	ctx.protectedHandler.ServeHTTP(w, authenticatedRequest)
+}
+
+// AuthenticatedUser gives the username the request was authenticated as, or "" if it passed through no authentication.
+func AuthenticatedUser(request *http.Request) string {
+	username, _ := request.Context().Value(authenticatedUserKey{}).(string)
+	return username
 }
@@ -81,8 +81,10 @@ func TestValidAuthResultsInProperlyServedResponse(t *testing.T) {
 	appConfig := LoadTheConfig("NoRealm.conf", []string{"../TestFixtures/configs"})
 	sut := NewHttpProtectionMiddlewareFactory(appConfig.HttpAuth)
 	var called = false
+	var username string
 	testHandler := func(response http.ResponseWriter, request *http.Request) {
 		called = true
+		username = AuthenticatedUser(request)
 	}
 	protectedHandler := sut.WrapInProtectionMiddleware(http.HandlerFunc(testHandler))
 	testRequest, _ := http.NewRequest("POST", "http://0.0.0.0/", strings.NewReader(""))
@@ -93,6 +95,9 @@ func TestValidAuthResultsInProperlyServedResponse(t *testing.T) {
 	if monitor.Code != 200 || called == false {
 		t.Errorf("Enabled http authentication middleware did not allow properly authenticated request through (HTTP %d).\n", monitor.Code)
 	}
+	if username != "test" {
+		t.Errorf("Expected the authenticated user to be \"test\", got \"%s\".\n", username)
+	}
 }
 
 func expectMiddlewareThrows(sut HttpProtectionMiddlewareFactory, t *testing.T, expect string) {
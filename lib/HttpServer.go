@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetdb"
 	"github.com/mbaynton/SimplePuppetProvisioner/lib/sppexec"
 )
 
@@ -16,16 +17,23 @@ type HttpServer struct {
 	notifier    *Notifications
 	certSigner  *certsign.CertSigner
 	execManager *sppexec.SppExecManager
+	puppetDb    *puppetdb.Client
+	records     *ProvisioningRecords
+	jobs        *ProvisionJobs
 	server      http.Server
 	startTime   time.Time
 }
 
-func NewHttpServer(config AppConfig, notifier *Notifications, certSigner *certsign.CertSigner, execManager *sppexec.SppExecManager) *HttpServer {
+// NewHttpServer returns an HttpServer. puppetDb is nil when PuppetDB is not configured.
+func NewHttpServer(config AppConfig, notifier *Notifications, certSigner *certsign.CertSigner, execManager *sppexec.SppExecManager, puppetDb *puppetdb.Client, records *ProvisioningRecords) *HttpServer {
 	server := new(HttpServer)
 	server.appConfig = config
 	server.notifier = notifier
 	server.certSigner = certSigner
 	server.execManager = execManager
+	server.puppetDb = puppetDb
+	server.records = records
+	server.jobs = NewProvisionJobs()
 
 	return server
 }
@@ -48,23 +56,58 @@ func (c *HttpServer) createRoutes(router *http.ServeMux) {
 	router.Handle("/webhook", NewGithubWebhookHttpHandler(c.appConfig.GithubWebhooks, c.execManager, c.appConfig.Log))
 
 	provisionProtectionMiddlewareFactory := NewHttpProtectionMiddlewareFactory(c.appConfig.ProvisionAuth)
-	provisionHandler := NewProvisionHttpHandler(&c.appConfig, c.notifier, c.certSigner, c.execManager)
+	// Leave the interfaces nil, rather than holding a nil *puppetdb.Client, when PuppetDB is not configured.
+	var deactivator nodeDeactivator
+	var finder nodeFinder
+	if c.puppetDb != nil {
+		deactivator = c.puppetDb
+		finder = c.puppetDb
+	}
+	deprovisioner := NewDeprovisioner(c.appConfig.Deprovision, c.certSigner, c.execManager, deactivator, c.notifier.Notify, c.appConfig.Log)
+	provisionHandler := NewProvisionHttpHandler(&c.appConfig, c.notifier, c.certSigner, c.execManager, deprovisioner, finder, c.records, c.jobs)
 
 	router.Handle("/provision", provisionProtectionMiddlewareFactory.WrapInProtectionMiddleware(provisionHandler))
 
+	// Each factory protects a single handler.
+	provisionV2ProtectionMiddlewareFactory := NewHttpProtectionMiddlewareFactory(c.appConfig.ProvisionAuth)
+	router.Handle("/v2/provision", provisionV2ProtectionMiddlewareFactory.WrapInProtectionMiddleware(NewProvisionV2HttpHandler(provisionHandler)))
+
+	// Whoever started a job can follow it.
+	jobsProtectionMiddlewareFactory := NewHttpProtectionMiddlewareFactory(c.appConfig.ProvisionAuth)
+	router.Handle("/jobs/", jobsProtectionMiddlewareFactory.WrapInProtectionMiddleware(NewJobsHttpHandler(c.jobs)))
+
+	reportsProtectionMiddlewareFactory := NewHttpProtectionMiddlewareFactory(c.appConfig.ReportsAuth)
+	reportsHandler := NewReportsHttpHandler(c.appConfig.Reports, c.records, c.notifier.Notify, c.appConfig.Log)
+	router.Handle("/reports", reportsProtectionMiddlewareFactory.WrapInProtectionMiddleware(reportsHandler))
+
 	protectionMiddlewareFactory := NewHttpProtectionMiddlewareFactory(c.appConfig.HttpAuth)
 	protectedRoutes := http.NewServeMux()
 
 	protectedRoutes.Handle("/log", http.HandlerFunc(c.logHandler))
 
+	authorizationsHandler := NewAuthorizationsHttpHandler(c.certSigner, c.appConfig.Log)
+	protectedRoutes.Handle("/authorizations", authorizationsHandler)
+	protectedRoutes.Handle("/authorizations/", authorizationsHandler)
+	protectedRoutes.Handle("/unsolicited-csrs", NewUnsolicitedCsrsHttpHandler(c.certSigner))
+	protectedRoutes.Handle("/certificates", NewCertificatesHttpHandler(c.certSigner, c.appConfig.Log))
+	nodesHandler := NewNodesHttpHandler(c.records)
+	protectedRoutes.Handle("/nodes", nodesHandler)
+	protectedRoutes.Handle("/nodes/", nodesHandler)
+	if c.puppetDb != nil {
+		protectedRoutes.Handle("/puppetdb/nodes/", NewPuppetDbNodesHttpHandler(c.puppetDb, c.appConfig.Log))
+	}
+
 	// If it didn't match an unprotected route, it goes through the protection middleware.
 	router.Handle("/", protectionMiddlewareFactory.WrapInProtectionMiddleware(protectedRoutes))
 }
 
 func (c *HttpServer) internalStatsHandler(response http.ResponseWriter, request *http.Request) {
 	type statsResponseType struct {
-		Uptime             string `json:"uptime"`
-		CertSigningBacklog int    `json:"cert-signing-backlog"`
+		Uptime             string         `json:"uptime"`
+		CertSigningBacklog int            `json:"cert-signing-backlog"`
+		CertsExpiring      map[string]int `json:"certs-expiring"`
+		CertsExpired       int            `json:"certs-expired"`
+		CaCertExpires      *time.Time     `json:"ca-cert-expires,omitempty"`
 	}
 
 	statsResponse := new(statsResponseType)
@@ -75,6 +118,14 @@ func (c *HttpServer) internalStatsHandler(response http.ResponseWriter, request
 
 	statsResponse.CertSigningBacklog = c.certSigner.ProcessingBacklogLength()
 
+	expiryCounts := c.certSigner.ExpiryCounts()
+	statsResponse.CertsExpiring = make(map[string]int, len(expiryCounts.ExpiringWithin))
+	for days, count := range expiryCounts.ExpiringWithin {
+		statsResponse.CertsExpiring[fmt.Sprintf("%dd", days)] = count
+	}
+	statsResponse.CertsExpired = expiryCounts.Expired
+	statsResponse.CaCertExpires = expiryCounts.CaNotAfter
+
 	response.Header().Set("Content-Type", "application/json")
 	jsonWriter := json.NewEncoder(response)
 	if err := jsonWriter.Encode(&statsResponse); err != nil {
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The longest a GET /jobs/<id> request may wait for the job to complete.
+const maxJobPollWait = 5 * time.Minute
+
+// jobReader looks up jobs, optionally waiting for one to finish. Only /provision creates and updates jobs, so the
+// jobs API is given no way to.
+type jobReader interface {
+	Get(id string) (ProvisionJob, bool)
+	Wait(waitContext context.Context, id string) (ProvisionJob, bool)
+}
+
+// JobsHttpHandler shows the live task results of a /provision request at /jobs/<id>. With a "wait" duration, the
+// response is held until the job is complete or the duration passes.
+type JobsHttpHandler struct {
+	jobs jobReader
+}
+
+func NewJobsHttpHandler(jobs jobReader) *JobsHttpHandler {
+	return &JobsHttpHandler{jobs: jobs}
+}
+
+func (ctx JobsHttpHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		response.Write([]byte("This API accepts only HTTP GET method requests."))
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(request.URL.Path, "/jobs"), "/")
+	var wait time.Duration
+	if waitParam := request.URL.Query().Get("wait"); waitParam != "" {
+		var err error
+		wait, err = time.ParseDuration(waitParam)
+		if err != nil || wait < 0 {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Write([]byte("wait must be a duration, such as \"30s\"."))
+			return
+		}
+		if wait > maxJobPollWait {
+			wait = maxJobPollWait
+		}
+	}
+
+	var job ProvisionJob
+	var found bool
+	if wait > 0 {
+		waitContext, cancel := context.WithTimeout(request.Context(), wait)
+		job, found = ctx.jobs.Wait(waitContext, id)
+		cancel()
+	} else {
+		job, found = ctx.jobs.Get(id)
+	}
+	if !found {
+		response.WriteHeader(http.StatusNotFound)
+		response.Write([]byte(fmt.Sprintf("There is no job %s.", id)))
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	jsonWriter := json.NewEncoder(response)
+	if err := jsonWriter.Encode(job); err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getJob(t *testing.T, sut *JobsHttpHandler, url string) ProvisionJob {
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, url, nil))
+	if monitor.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200 for %s, got %d", url, monitor.Code)
+	}
+	var job ProvisionJob
+	if err := json.Unmarshal(monitor.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestJobsHttpHandler_Get(t *testing.T) {
+	jobs := NewProvisionJobs()
+	id, _ := jobs.Start("foo.bar.com", []string{"cert-sign"})
+	sut := NewJobsHttpHandler(jobs)
+
+	job := getJob(t, sut, "/jobs/"+id)
+	if job.Id != id || job.Hostname != "foo.bar.com" || job.Complete || job.Tasks["cert-sign"].Complete {
+		t.Errorf("Unexpected job %+v", job)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		jobs.Update(id, "cert-sign", TaskResult{Complete: true, Success: true, Message: "Signed."})
+	}()
+	job = getJob(t, sut, "/jobs/"+id+"?wait=30s")
+	if !job.Complete || !job.Tasks["cert-sign"].Success {
+		t.Errorf("Expected the long poll to return the completed job, got %+v", job)
+	}
+
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/jobs/0123456789abcdef", nil))
+	if monitor.Code != http.StatusNotFound {
+		t.Errorf("Expected HTTP 404 for an unknown job, got %d", monitor.Code)
+	}
+
+	monitor = httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/jobs/"+id+"?wait=soon", nil))
+	if monitor.Code != http.StatusBadRequest {
+		t.Errorf("Expected HTTP 400 for an invalid wait, got %d", monitor.Code)
+	}
+}
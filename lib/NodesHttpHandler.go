@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// provisioningRecordReader gives read-only access to the provisioning records, which the nodes API only lists.
+type provisioningRecordReader interface {
+	Get(hostname string) (ProvisioningRecord, bool)
+	List() []ProvisioningRecord
+}
+
+var provisioningStates = []string{
+	ProvisioningRequested,
+	ProvisioningAwaitingCsr,
+	ProvisioningSigned,
+	ProvisioningFirstRunReported,
+	ProvisioningComplete,
+	ProvisioningFailed,
+}
+
+// NodesHttpHandler shows a host's provisioning record at /nodes/<hostname>, and lists records at /nodes. The
+// listing may be narrowed with a "name" glob pattern, one or more "state"s, "requested-by", and "idle", a duration
+// the records must not have changed for, to find hosts that are stuck.
+type NodesHttpHandler struct {
+	records provisioningRecordReader
+	now     func() time.Time
+}
+
+func NewNodesHttpHandler(records provisioningRecordReader) *NodesHttpHandler {
+	return &NodesHttpHandler{records: records, now: time.Now}
+}
+
+func (ctx NodesHttpHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		response.Write([]byte("This API accepts only HTTP GET method requests."))
+		return
+	}
+
+	var responseBody interface{}
+	hostname := strings.Trim(strings.TrimPrefix(request.URL.Path, "/nodes"), "/")
+	if hostname != "" {
+		record, found := ctx.records.Get(hostname)
+		if !found {
+			response.WriteHeader(http.StatusNotFound)
+			response.Write([]byte(fmt.Sprintf("There is no provisioning record for %s.", hostname)))
+			return
+		}
+		responseBody = record
+	} else {
+		listing, err := ctx.list(request)
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Write([]byte(err.Error()))
+			return
+		}
+		responseBody = listing
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	jsonWriter := json.NewEncoder(response)
+	if err := jsonWriter.Encode(responseBody); err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (ctx NodesHttpHandler) list(request *http.Request) ([]ProvisioningRecord, error) {
+	query := request.URL.Query()
+	namePattern := query.Get("name")
+	if _, err := path.Match(namePattern, ""); err != nil {
+		return nil, fmt.Errorf("Invalid name pattern \"%s\".", namePattern)
+	}
+	states := make(map[string]bool)
+	for _, stateList := range query["state"] {
+		for _, state := range strings.Split(stateList, ",") {
+			if !containsString(provisioningStates, state) {
+				return nil, fmt.Errorf("Unknown state \"%s\". Valid states are %s.", state, strings.Join(provisioningStates, ", "))
+			}
+			states[state] = true
+		}
+	}
+	var idleSince time.Time
+	if idle := query.Get("idle"); idle != "" {
+		duration, err := time.ParseDuration(idle)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("idle must be a duration, such as \"2h\".")
+		}
+		idleSince = ctx.now().Add(-duration)
+	}
+	requestedBy, filterRequestedBy := query["requested-by"]
+
+	listing := []ProvisioningRecord{}
+	for _, record := range ctx.records.List() {
+		if len(states) > 0 && !states[record.State] {
+			continue
+		}
+		if namePattern != "" {
+			if matched, _ := path.Match(namePattern, record.Hostname); !matched {
+				continue
+			}
+		}
+		if filterRequestedBy && record.RequestedBy != requestedBy[0] {
+			continue
+		}
+		if !idleSince.IsZero() && record.Updated.After(idleSince) {
+			continue
+		}
+		listing = append(listing, record)
+	}
+	return listing, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, candidate := range list {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func nodesSutFactory(t *testing.T) *NodesHttpHandler {
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	records, _ := NewProvisioningRecords(nil, log.New(&bytes.Buffer{}, "", 0))
+	records.now = func() time.Time { return now }
+	records.Start("compute-1.cluster.org", "provision-user", []string{"cert-sign"})
+	records.AwaitCsr("compute-1.cluster.org")
+	now = now.Add(3 * time.Hour)
+	records.Start("compute-2.cluster.org", "provision-user", []string{"cert-sign"})
+	records.AwaitCsr("compute-2.cluster.org")
+	records.Start("web.bar.com", "", []string{"environment"})
+	records.RecordTaskResult("web.bar.com", "environment", TaskResult{Complete: true, Success: true})
+
+	sut := NewNodesHttpHandler(records)
+	sut.now = func() time.Time { return now }
+	return sut
+}
+
+func getNodes(t *testing.T, sut *NodesHttpHandler, url string) []ProvisioningRecord {
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, url, nil))
+	if monitor.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200 for %s, got %d", url, monitor.Code)
+	}
+	var listing []ProvisioningRecord
+	if err := json.Unmarshal(monitor.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	return listing
+}
+
+func TestNodesHttpHandler_Get(t *testing.T) {
+	sut := nodesSutFactory(t)
+
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/nodes/compute-1.cluster.org", nil))
+	if monitor.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, got %d", monitor.Code)
+	}
+	var record ProvisioningRecord
+	if err := json.Unmarshal(monitor.Body.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Hostname != "compute-1.cluster.org" || record.State != ProvisioningAwaitingCsr || record.RequestedBy != "provision-user" {
+		t.Errorf("Unexpected record %+v", record)
+	}
+	if _, found := record.Tasks["cert-sign"]; !found {
+		t.Errorf("Expected the record to list the cert-sign task, got %+v", record.Tasks)
+	}
+
+	monitor = httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/nodes/baz.bar.com", nil))
+	if monitor.Code != http.StatusNotFound {
+		t.Errorf("Expected HTTP 404 for a host without a record, got %d", monitor.Code)
+	}
+}
+
+func TestNodesHttpHandler_List(t *testing.T) {
+	sut := nodesSutFactory(t)
+
+	if listing := getNodes(t, sut, "/nodes"); len(listing) != 3 {
+		t.Errorf("Expected 3 records, got %+v", listing)
+	}
+	if listing := getNodes(t, sut, "/nodes?state=awaiting-csr"); len(listing) != 2 {
+		t.Errorf("Expected 2 records awaiting CSRs, got %+v", listing)
+	}
+	if listing := getNodes(t, sut, "/nodes?state=complete,failed&name=*.bar.com"); len(listing) != 1 || listing[0].Hostname != "web.bar.com" {
+		t.Errorf("Expected web.bar.com, got %+v", listing)
+	}
+	if listing := getNodes(t, sut, "/nodes?state=awaiting-csr&idle=2h"); len(listing) != 1 || listing[0].Hostname != "compute-1.cluster.org" {
+		t.Errorf("Expected only the stuck host, got %+v", listing)
+	}
+	if listing := getNodes(t, sut, "/nodes?requested-by=provision-user"); len(listing) != 2 {
+		t.Errorf("Expected 2 records requested by provision-user, got %+v", listing)
+	}
+	if listing := getNodes(t, sut, "/nodes?name=*.example.org"); listing == nil || len(listing) != 0 {
+		t.Errorf("Expected an empty listing, got %+v", listing)
+	}
+
+	for _, url := range []string{"/nodes?state=stuck", "/nodes?idle=forever", "/nodes?name=["} {
+		monitor := httptest.NewRecorder()
+		sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, url, nil))
+		if monitor.Code != http.StatusBadRequest {
+			t.Errorf("Expected HTTP 400 for %s, got %d", url, monitor.Code)
+		}
+	}
+}
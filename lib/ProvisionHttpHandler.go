@@ -2,36 +2,97 @@ package lib
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"reflect"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
-	"github.com/mbaynton/SimplePuppetProvisioner/lib/sppexec"
 	"github.com/mbaynton/go-genericexec"
 )
 
+// Longest a /provision request waits on its tasks, unless MaxProvisionWait is configured.
+const defaultMaxProvisionWait = 10 * time.Minute
+
+// Seconds a client turned away because the certificate signing queue is full is asked to wait before retrying.
+const queueFullRetryAfter = "30"
+
+// certQueuer queues the certificate operations of cert-revoke and cert-sign, failing with certsign.ErrQueueFull
+// rather than blocking when there is no room. Tests use it to provoke a full queue or a failed signing.
+type certQueuer interface {
+	certCleaner
+	QueueSign(hostname string, cleanExistingCert bool, options certsign.SignOptions) (<-chan certsign.SigningResult, error)
+}
+
 type ProvisionHttpHandler struct {
-	appConfig   *AppConfig
-	notifier    *Notifications
-	certSigner  *certsign.CertSigner
-	execManager *sppexec.SppExecManager
+	appConfig     *AppConfig
+	notifier      *Notifications
+	certSigner    certQueuer
+	execManager   execTaskRunner
+	deprovisioner *Deprovisioner
+	puppetDb      nodeFinder
+	records       *ProvisioningRecords
+	jobs          *ProvisionJobs
+	// Configured prerequisites of each task.
+	dependencies map[string][]string
+	execTasks    map[string]*ExecTaskConfig
 }
 
 type TaskResult struct {
 	Complete bool
 	Success  bool
 	Message  string
+	// Set when the task was not run because a prerequisite did not succeed.
+	Skipped bool `json:",omitempty"`
 }
 
-func NewProvisionHttpHandler(appConfig *AppConfig, notifier *Notifications, certSigner *certsign.CertSigner, execManager *sppexec.SppExecManager) *ProvisionHttpHandler {
-	handler := ProvisionHttpHandler{appConfig: appConfig, notifier: notifier, certSigner: certSigner, execManager: execManager}
+func NewProvisionHttpHandler(appConfig *AppConfig, notifier *Notifications, certSigner certQueuer, execManager execTaskRunner, deprovisioner *Deprovisioner, puppetDb nodeFinder, records *ProvisioningRecords, jobs *ProvisionJobs) *ProvisionHttpHandler {
+	handler := ProvisionHttpHandler{appConfig: appConfig, notifier: notifier, certSigner: certSigner, execManager: execManager, deprovisioner: deprovisioner, puppetDb: puppetDb, records: records, jobs: jobs}
+	handler.dependencies = configuredDependencies(appConfig)
+	handler.execTasks = make(map[string]*ExecTaskConfig, len(appConfig.GenericExecTasks))
+	for _, task := range appConfig.GenericExecTasks {
+		handler.execTasks[task.Name] = task
+	}
 
 	return &handler
 }
 
+// provisionRequest is a request to provision a host, from either version of the API.
+type provisionRequest struct {
+	hostname    string
+	requestedBy string
+	tasks       sort.StringSlice
+	waits       sort.StringSlice
+	// Each task's parameters, available to its templates.
+	params map[string]url.Values
+	// How long to wait on the tasks in waits. Zero waits as long as is allowed.
+	timeout time.Duration
+	// Prerequisites given in the request, in addition to those configured.
+	dependsOn map[string][]string
+}
+
+// provisionError is why a request was turned away, with the HTTP status to respond with.
+type provisionError struct {
+	status     int
+	message    string
+	retryAfter string
+	// Each of the request's values that was not accepted, when that is why.
+	violations []string
+}
+
+// provisioning follows a request's tasks once they have been started.
+type provisioning struct {
+	request       *provisionRequest
+	job           ProvisionJob
+	results       map[string]TaskResult
+	prerequisites map[string][]string
+	completions   *taskCompletions
+}
+
 func (ctx ProvisionHttpHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodPost {
 		response.WriteHeader(http.StatusMethodNotAllowed)
@@ -47,8 +108,6 @@ func (ctx ProvisionHttpHandler) ServeHTTP(response http.ResponseWriter, request
 		return
 	}
 
-	responseWrapper := map[string]TaskResult{}
-
 	var tasks sort.StringSlice
 	tasks = strings.Split(request.Form.Get("tasks"), ",")
 	tasks.Sort()
@@ -62,31 +121,104 @@ func (ctx ProvisionHttpHandler) ServeHTTP(response http.ResponseWriter, request
 	waits = strings.Split(request.Form.Get("waits"), ",")
 	waits.Sort()
 
+	provisionRequest := provisionRequest{
+		hostname:    hostname,
+		requestedBy: AuthenticatedUser(request),
+		tasks:       tasks,
+		waits:       waits,
+		params:      make(map[string]url.Values, len(tasks)),
+	}
+	// Every task sees all the posted fields.
+	for _, task := range tasks {
+		provisionRequest.params[task] = request.Form
+	}
+	if timeout := request.Form.Get("timeout"); timeout != "" {
+		var err error
+		provisionRequest.timeout, err = parseWaitTimeout(timeout)
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	started, provisionErr := ctx.start(&provisionRequest)
+	if started != nil {
+		response.Header().Set("X-Job-Id", started.job.Id)
+	}
+	if provisionErr != nil {
+		if provisionErr.retryAfter != "" {
+			response.Header().Set("Retry-After", provisionErr.retryAfter)
+		}
+		response.WriteHeader(provisionErr.status)
+		response.Write([]byte(provisionErr.message))
+		return
+	}
+
+	// With Accept: text/event-stream, results are sent as they arrive.
+	var stream *eventStream
+	if wantsEventStream(request) {
+		stream = newEventStream(response)
+	}
+	if !ctx.wait(started, request.Context().Done(), stream) {
+		return
+	}
+
+	if stream != nil {
+		// The summary is the job, so it includes tasks that were not waited for.
+		summary, _ := ctx.jobs.Get(started.job.Id)
+		stream.send("summary", summary)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	jsonWriter := json.NewEncoder(response)
+	if err := jsonWriter.Encode(&started.results); err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// start validates the request and starts its tasks. Once the request's job is created, the returned provisioning
+// is not nil, even if the request is then turned away.
+func (ctx ProvisionHttpHandler) start(req *provisionRequest) (*provisioning, *provisionError) {
+	hostname := req.hostname
+	responseWrapper := map[string]TaskResult{}
+
 	var environment = ""
 
 	// Some special treatment for the environment task, which only enables environment-aware notifications.
-	// How you say "contains" in Go...
-	if i := tasks.Search("environment"); i < len(tasks) && tasks[i] == "environment" {
-		environment = request.Form.Get("environment")
+	if req.has("environment") {
+		environment = req.params["environment"].Get("environment")
 
 		if environment == "" {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte("Environment provisioning was listed in tasks, but the target environment was not given."))
-			return
+			return nil, &provisionError{status: http.StatusBadRequest, message: "Environment provisioning was listed in tasks, but the target environment was not given."}
 		}
 	}
-	info := fmt.Sprintf("Provisioning %s", hostname)
-	if environment != "" {
-		info = info + fmt.Sprintf(" in the %s environment", environment)
+	signOptions := certsign.SignOptions{RequestedBy: req.requestedBy}
+	if req.has("cert-sign") {
+		form := req.params["cert-sign"]
+		var err error
+		signOptions.ExpectedAttributes, err = expectedCsrAttributes(form)
+		if err != nil {
+			return nil, &provisionError{status: http.StatusBadRequest, message: err.Error()}
+		}
+		if ttl := form.Get("authorization-ttl"); ttl != "" {
+			signOptions.Ttl, err = time.ParseDuration(ttl)
+			if err != nil || signOptions.Ttl <= 0 {
+				return nil, &provisionError{status: http.StatusBadRequest, message: "authorization-ttl must be a positive duration, such as \"2h\"."}
+			}
+		}
+		if names := form.Get("dns-alt-names"); names != "" {
+			for _, name := range strings.Split(names, ",") {
+				signOptions.DnsAltNames = append(signOptions.DnsAltNames, strings.TrimSpace(name))
+			}
+		}
 	}
-	ctx.notifier.Notify(fmt.Sprintf("%s...", info))
-
-	// Set up slice for response channels we've been asked to wait on.
-	waitResultChans := []reflect.SelectCase{}
 
 	// Cert-related tasks
-	var certSign, certRevoke = false, false
+	var certSign, certRevoke, deprovision = false, false, false
 
+	tasks := append(sort.StringSlice{}, req.tasks...)
 	for i := len(tasks) - 1; i >= 0; i-- {
 		if tasks[i] == "cert-sign" {
 			certSign = true
@@ -96,51 +228,201 @@ func (ctx ProvisionHttpHandler) ServeHTTP(response http.ResponseWriter, request
 			certRevoke = true
 			// Remove the cert task from the remaining tasks list.
 			tasks = append(tasks[0:i], tasks[i+1:]...)
+		} else if tasks[i] == "deprovision" {
+			deprovision = true
+			tasks = append(tasks[0:i], tasks[i+1:]...)
+		}
+	}
+
+	if deprovision && (certSign || certRevoke) {
+		return nil, &provisionError{status: http.StatusBadRequest, message: "The deprovision task revokes the certificate itself, and cannot be combined with cert-sign or cert-revoke."}
+	}
+
+	prerequisites, err := prerequisiteGraph(req.tasks, ctx.dependencies, req.dependsOn)
+	if err != nil {
+		return nil, &provisionError{status: http.StatusBadRequest, message: err.Error()}
+	}
+
+	// The values given to GenericExecTasks are checked, and defaults filled in, before anything is started.
+	var violations []string
+	for _, task := range tasks {
+		if config, found := ctx.execTasks[task]; found {
+			var taskViolations []string
+			req.params[task], taskViolations = config.validateParams(req.params[task])
+			violations = append(violations, taskViolations...)
+		}
+	}
+	if deprovision {
+		// Cleanup tasks are given the deprovision task's values.
+		for _, task := range ctx.deprovisioner.cleanupTasks {
+			if config, found := ctx.execTasks[task]; found {
+				var taskViolations []string
+				req.params["deprovision"], taskViolations = config.validateParams(req.params["deprovision"])
+				violations = append(violations, taskViolations...)
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return nil, &provisionError{
+			status:     http.StatusBadRequest,
+			message:    "The request was refused, as some of its values are not valid:\n" + strings.Join(violations, "\n"),
+			violations: violations,
+		}
+	}
+
+	// Signing a certificate for a hostname PuppetDB still sees reporting is likely a mistake, unless the old
+	// certificate is being revoked in the same breath.
+	if certSign && !certRevoke && ctx.puppetDb != nil && ctx.appConfig.PuppetDb.ProvisionCheck != "" {
+		conflict, err := checkActiveNode(ctx.puppetDb, hostname, time.Now().Add(-ctx.appConfig.PuppetDb.ActiveWithin))
+		if err != nil {
+			ctx.appConfig.Log.Printf("Unable to check PuppetDB for an active node named %s: %s\n", hostname, err.Error())
+			responseWrapper["puppetdb-check"] = TaskResult{
+				Complete: true,
+				Success:  false,
+				Message:  "PuppetDB could not be checked for an active node with this hostname. More info in the log.",
+			}
+		} else if conflict != "" && ctx.appConfig.PuppetDb.ProvisionCheck == "refuse" {
+			ctx.notifier.Notify(fmt.Sprintf("Refused to provision %s: %s.", hostname, conflict))
+			return nil, &provisionError{
+				status:  http.StatusConflict,
+				message: fmt.Sprintf("%s. Deprovision it, or include cert-revoke in tasks if the hostname is being reused on purpose; nothing was done.", conflict),
+			}
+		} else if conflict != "" {
+			ctx.notifier.Notify(fmt.Sprintf("WARNING provisioning %s: %s.", hostname, conflict))
+			responseWrapper["puppetdb-check"] = TaskResult{
+				Complete: true,
+				Success:  false,
+				Message:  conflict + ".",
+			}
 		}
 	}
 
+	recordedTasks := append([]string{}, tasks...)
+	if certSign {
+		recordedTasks = append(recordedTasks, "cert-sign")
+	}
 	if certRevoke {
-		cleaningResultChan := ctx.certSigner.Clean(hostname)
-		if i := waits.Search("cert-revoke"); i < len(waits) && waits[i] == "cert-revoke" {
-			waitResultChans = append(waitResultChans, reflect.SelectCase{
-				Dir:  reflect.SelectRecv,
-				Chan: reflect.ValueOf(cleaningResultChan),
-			})
-		} else {
-			responseWrapper["cert-revoke"] = TaskResult{
+		recordedTasks = append(recordedTasks, "cert-revoke")
+	}
+	if deprovision {
+		recordedTasks = append(recordedTasks, ctx.deprovisioner.StepNames()...)
+	}
+	jobId, err := ctx.jobs.Start(hostname, recordedTasks)
+	if err != nil {
+		ctx.appConfig.Log.Printf("Unable to create a job for provisioning %s: %s\n", hostname, err.Error())
+		return nil, &provisionError{status: http.StatusInternalServerError, message: "Unable to create a job for the request; nothing was done."}
+	}
+	job := ProvisionJob{Id: jobId, Hostname: hostname}
+	started := &provisioning{
+		request:       req,
+		job:           job,
+		results:       responseWrapper,
+		prerequisites: prerequisites,
+		completions: newTaskCompletions(req.tasks, func(task string) []string {
+			if task == "deprovision" {
+				return ctx.deprovisioner.StepNames()
+			}
+			return []string{task}
+		}),
+	}
+	ctx.records.Start(hostname, req.requestedBy, recordedTasks)
+
+	// Tasks are started in this order, each once its prerequisites have succeeded. If a task without
+	// prerequisites cannot be queued, the request is turned away and later tasks are not started.
+	if deprovision {
+		err := ctx.run(started, "deprovision", func() error {
+			steps, err := ctx.deprovisioner.Deprovision(hostname, req.params["deprovision"])
+			if err != nil {
+				return err
+			}
+			for _, step := range steps {
+				ctx.recordDeprovisionStepResult(started, step.Result)
+			}
+			return nil
+		})
+		if err == certsign.ErrQueueFull {
+			return started, ctx.queueFull(started, "The certificate revocation could not be queued; nothing was done.")
+		}
+		if !req.waitsFor("deprovision") {
+			for _, name := range started.completions.names("deprovision") {
+				responseWrapper[name] = started.pending("deprovision", TaskResult{
+					Complete: false,
+					Success:  true,
+					Message:  "Deprovisioning step was started. To see the results in this response, include \"deprovision\" in the waits list.",
+				})
+			}
+		}
+	}
+
+	if certRevoke {
+		err := ctx.run(started, "cert-revoke", func() error {
+			cleaningResultChan, err := ctx.certSigner.QueueClean(hostname)
+			if err == certsign.ErrQueueFull {
+				return err
+			} else if err != nil {
+				cleaningResultChan = failedSigningResult(err, "revoke")
+			}
+			ctx.recordSigningResult(started, cleaningResultChan)
+			return nil
+		})
+		if err == certsign.ErrQueueFull {
+			return started, ctx.queueFull(started, "The certificate revocation could not be queued; nothing was done.")
+		}
+		if !req.waitsFor("cert-revoke") {
+			responseWrapper["cert-revoke"] = started.pending("cert-revoke", TaskResult{
 				Complete: false,
 				Success:  true,
 				Message:  "Certificate cleaning operation was queued. To see the results in this response, include \"cert-revoke\" in the waits list.",
-			}
+			})
 		}
 	}
 
 	if certSign {
-		signingResultChan := ctx.certSigner.Sign(hostname, false)
-		if i := waits.Search("cert-sign"); i < len(waits) && waits[i] == "cert-sign" {
-			waitResultChans = append(waitResultChans, reflect.SelectCase{
-				Dir:  reflect.SelectRecv,
-				Chan: reflect.ValueOf(signingResultChan),
-			})
-		} else {
-			responseWrapper["cert-sign"] = TaskResult{
+		err := ctx.run(started, "cert-sign", func() error {
+			// A host being given a certificate is a new node, whose first puppet run will be looked for at /reports.
+			ctx.records.AwaitCsr(hostname)
+			signingResultChan, err := ctx.certSigner.QueueSign(hostname, false, signOptions)
+			if err == certsign.ErrQueueFull {
+				return err
+			} else if err != nil {
+				signingResultChan = failedSigningResult(err, "sign")
+			}
+			ctx.recordSigningResult(started, signingResultChan)
+			return nil
+		})
+		if err == certsign.ErrQueueFull {
+			if certRevoke {
+				return started, ctx.queueFull(started, "The certificate revocation was queued, but signing could not be; other tasks were not started.")
+			}
+			return started, ctx.queueFull(started, "Certificate signing could not be queued; nothing was done.")
+		}
+		if !req.waitsFor("cert-sign") {
+			responseWrapper["cert-sign"] = started.pending("cert-sign", TaskResult{
 				Complete: false,
 				Success:  true,
 				Message:  "Certificate signing operation was queued. To see the results in this response, include \"cert-sign\" in the waits list.",
-			}
+			})
 		}
+	}
 
+	if !deprovision || len(tasks) > 0 {
+		info := fmt.Sprintf("Provisioning %s", hostname)
+		if environment != "" {
+			info = info + fmt.Sprintf(" in the %s environment", environment)
+		}
+		ctx.notifier.Notify(fmt.Sprintf("%s...", info))
 	}
 
 	// Process generic exec tasks
 	for _, requestTask := range tasks {
 		if ctx.execManager.IsTaskConfigured(requestTask) {
-			execResultChan := ctx.execManager.RunTask(requestTask, &request.Form)
-			if i := waits.Search(requestTask); i < len(waits) && waits[i] == requestTask {
-				waitResultChans = append(waitResultChans, reflect.SelectCase{
-					Dir:  reflect.SelectRecv,
-					Chan: reflect.ValueOf(execResultChan),
-				})
+			requestTask := requestTask
+			ctx.run(started, requestTask, func() error {
+				ctx.recordExecResult(started, ctx.execManager.RunTask(requestTask, req.params[requestTask]))
+				return nil
+			})
+			if !req.waitsFor(requestTask) && len(prerequisites[requestTask]) > 0 {
+				responseWrapper[requestTask] = started.pending(requestTask, TaskResult{})
 			}
 		} else {
 			responseWrapper[requestTask] = TaskResult{
@@ -148,36 +430,292 @@ func (ctx ProvisionHttpHandler) ServeHTTP(response http.ResponseWriter, request
 				Complete: true,
 				Message:  "Task name is not recognized.",
 			}
+			started.completions.begin(requestTask)
+			ctx.recordTaskResult(started, requestTask, responseWrapper[requestTask])
+		}
+	}
+
+	return started, nil
+}
+
+// run starts task with launch once its prerequisites have succeeded, or skips it if one of them does not. A task
+// without prerequisites is started at once, and the error starting it, if any, is returned. If launch returns an
+// error the task fails.
+func (ctx ProvisionHttpHandler) run(started *provisioning, task string, launch func() error) error {
+	prerequisites := started.prerequisites[task]
+	if len(prerequisites) == 0 {
+		started.completions.begin(task)
+		return ctx.launch(started, task, launch)
+	}
+
+	go func() {
+		for _, prerequisite := range prerequisites {
+			if failure := started.completions.await(prerequisite); failure != "" {
+				ctx.settle(started, task, TaskResult{
+					Complete: true,
+					Success:  false,
+					Skipped:  true,
+					Message:  fmt.Sprintf("Skipped because %s %s.", prerequisite, failure),
+				})
+				return
+			}
+		}
+		if started.completions.begin(task) {
+			ctx.launch(started, task, launch)
+		}
+	}()
+	return nil
+}
+
+func (ctx ProvisionHttpHandler) launch(started *provisioning, task string, launch func() error) error {
+	err := launch()
+	if err != nil {
+		for _, name := range started.completions.names(task) {
+			ctx.recordTaskResult(started, name, TaskResult{Complete: true, Success: false, Message: err.Error()})
+		}
+	}
+	return err
+}
+
+// settle gives each of the results of task that has not been started, so that it never will be.
+func (ctx ProvisionHttpHandler) settle(started *provisioning, task string, result TaskResult) {
+	if !started.completions.begin(task) {
+		return
+	}
+	for _, name := range started.completions.names(task) {
+		ctx.recordTaskResult(started, name, result)
+	}
+}
+
+// pending returns the response for task when it is not waited for: queued, unless it is still waiting on its
+// prerequisites.
+func (started *provisioning) pending(task string, queued TaskResult) TaskResult {
+	if prerequisites := started.prerequisites[task]; len(prerequisites) > 0 {
+		return TaskResult{
+			Complete: false,
+			Success:  true,
+			Message:  fmt.Sprintf("The task will start once its prerequisites (%s) have succeeded.", strings.Join(prerequisites, ", ")),
+		}
+	}
+	return queued
+}
+
+// wait collects the results of the tasks the request waits for, until they are all in, the request's timeout
+// passes, or done is closed because the client went away. If stream is not nil, every task is followed rather than
+// just those waited for, and results are sent to it as they arrive, starting with those already known. It returns
+// false if the client went away.
+func (ctx ProvisionHttpHandler) wait(started *provisioning, done <-chan struct{}, stream *eventStream) bool {
+	job := started.job
+	responseWrapper := started.results
+
+	var heartbeat <-chan time.Time
+	// The results last sent to the stream, so that results already known are not sent again.
+	sent := map[string]TaskResult{}
+	if stream != nil {
+		ticker := time.NewTicker(sseHeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+		current, _ := ctx.jobs.Get(job.Id)
+		for task, result := range responseWrapper {
+			current.Tasks[task] = result
+		}
+		for _, task := range sortedTaskNames(current.Tasks) {
+			stream.task(task, current.Tasks[task])
+			sent[task] = current.Tasks[task]
+		}
+	}
+
+	// Waits end at the deadline even if some tasks are still running; their results are left to /jobs.
+	waitTimeout := ctx.appConfig.MaxProvisionWait
+	if waitTimeout <= 0 {
+		waitTimeout = defaultMaxProvisionWait
+	}
+	if started.request.timeout > 0 && started.request.timeout < waitTimeout {
+		waitTimeout = started.request.timeout
+	}
+	deadline := time.NewTimer(waitTimeout)
+	defer deadline.Stop()
+
+	// Wait for all tasks we need to wait on, until the deadline or the client goes away. The first select cases
+	// are the heartbeat, the deadline and the request's cancellation.
+	selectCases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(heartbeat)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(deadline.C)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+	}
+	var waitedTasks []string
+	for _, task := range started.request.tasks {
+		if stream != nil || started.request.waitsFor(task) {
+			waitedTasks = append(waitedTasks, task)
+			selectCases = append(selectCases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(started.completions.done(task)),
+			})
 		}
 	}
-	// Wait for all operations we need to wait on
 	waitsComplete := 0
-	for waitsComplete < len(waitResultChans) {
-		chosen, rvalue, ok := reflect.Select(waitResultChans)
-		if !ok {
-			waitResultChans[chosen].Chan = reflect.ValueOf(nil)
+	deadlinePassed := false
+	for waitsComplete < len(waitedTasks) && !deadlinePassed {
+		chosen, rvalue, _ := reflect.Select(selectCases)
+		switch chosen {
+		case 0:
+			stream.heartbeat(rvalue.Interface().(time.Time))
+			continue
+		case 1:
+			deadlinePassed = true
 			continue
+		case 2:
+			// Nobody is left to respond to. The job and the provisioning record still get the results.
+			ctx.appConfig.Log.Printf("Client went away while waiting on provisioning tasks for %s.\n", job.Hostname)
+			return false
 		}
-		switch value := rvalue.Interface().(type) {
-		case certsign.SigningResult:
-			responseWrapper[fmt.Sprintf("cert-%s", value.Action)] = TaskResult{
-				Complete: true,
-				Success:  value.Success,
-				Message:  value.Message,
-			}
-		case genericexec.GenericExecResult:
-			responseWrapper[value.Name] = TaskResult{
-				Complete: true,
-				Success:  value.ExitCode == 0,
-				Message:  value.Message,
+		selectCases[chosen].Chan = reflect.ValueOf(nil)
+		results := started.completions.results(waitedTasks[chosen-3])
+		for _, task := range sortedTaskNames(results) {
+			responseWrapper[task] = results[task]
+			if stream != nil && sent[task] != results[task] {
+				stream.task(task, results[task])
+				sent[task] = results[task]
 			}
 		}
 		waitsComplete++
 	}
 
-	response.Header().Set("Content-Type", "application/json")
-	jsonWriter := json.NewEncoder(response)
-	if err := jsonWriter.Encode(&responseWrapper); err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
+	// The job shows the queued tasks' messages until their results arrive.
+	for task, result := range responseWrapper {
+		ctx.jobs.Update(job.Id, task, result)
+	}
+
+	// Tasks waited for but not received by the deadline are reported as they stand in the job.
+	if deadlinePassed {
+		current, _ := ctx.jobs.Get(job.Id)
+		for task, result := range current.Tasks {
+			if _, found := responseWrapper[task]; found {
+				continue
+			}
+			if !result.Complete {
+				result.Message = fmt.Sprintf("The task is still running. Its result will be available at /jobs/%s.", job.Id)
+			}
+			responseWrapper[task] = result
+		}
+	}
+	return true
+}
+
+// has reports whether task is one of the request's tasks.
+func (req *provisionRequest) has(task string) bool {
+	i := req.tasks.Search(task)
+	return i < len(req.tasks) && req.tasks[i] == task
+}
+
+// waitsFor reports whether the response waits for the result of task.
+func (req *provisionRequest) waitsFor(task string) bool {
+	i := req.waits.Search(task)
+	return i < len(req.waits) && req.waits[i] == task
+}
+
+// parseWaitTimeout parses the timeout a request gives for its waits.
+func parseWaitTimeout(timeout string) (time.Duration, error) {
+	duration, err := time.ParseDuration(timeout)
+	if err != nil || duration <= 0 {
+		return 0, errors.New("timeout must be a positive duration, such as \"5m\".")
+	}
+	return duration, nil
+}
+
+// queueFull turns the request away when a task could not be queued because the certificate signing queue is full.
+// Tasks that have not started yet never will.
+func (ctx ProvisionHttpHandler) queueFull(started *provisioning, detail string) *provisionError {
+	for _, task := range started.request.tasks {
+		ctx.settle(started, task, TaskResult{
+			Complete: true,
+			Success:  false,
+			Skipped:  true,
+			Message:  "The task was not started because the certificate signing queue is full.",
+		})
+	}
+	return &provisionError{
+		status:     http.StatusServiceUnavailable,
+		message:    fmt.Sprintf("%s %s", certsign.ErrQueueFull.Error(), detail),
+		retryAfter: queueFullRetryAfter,
+	}
+}
+
+// recordTaskResult adds a task's result to the request's job and the host's provisioning record, and lets tasks
+// waiting on it know.
+func (ctx ProvisionHttpHandler) recordTaskResult(started *provisioning, task string, result TaskResult) {
+	ctx.jobs.Update(started.job.Id, task, result)
+	ctx.records.RecordTaskResult(started.job.Hostname, task, result)
+	started.completions.completed(task, result)
+}
+
+// recordSigningResult adds the results resultChan delivers to the job and the host's provisioning record, whether
+// or not the request waits for them.
+func (ctx ProvisionHttpHandler) recordSigningResult(started *provisioning, resultChan <-chan certsign.SigningResult) {
+	go func() {
+		for result := range resultChan {
+			ctx.recordTaskResult(started, fmt.Sprintf("cert-%s", result.Action), TaskResult{
+				Complete: true,
+				Success:  result.Success,
+				Message:  result.Message,
+			})
+		}
+	}()
+}
+
+// recordExecResult is recordSigningResult for GenericExecTasks.
+func (ctx ProvisionHttpHandler) recordExecResult(started *provisioning, resultChan <-chan genericexec.GenericExecResult) {
+	go func() {
+		result := <-resultChan
+		ctx.recordTaskResult(started, result.Name, TaskResult{
+			Complete: true,
+			Success:  result.ExitCode == 0,
+			Message:  result.Message,
+		})
+	}()
+}
+
+// recordDeprovisionStepResult is recordSigningResult for deprovisioning steps.
+func (ctx ProvisionHttpHandler) recordDeprovisionStepResult(started *provisioning, resultChan <-chan DeprovisionStepResult) {
+	go func() {
+		result := <-resultChan
+		ctx.recordTaskResult(started, result.Name, result.TaskResult)
+	}()
+}
+
+// failedSigningResult returns a closed channel holding a failed SigningResult for action.
+func failedSigningResult(err error, action string) <-chan certsign.SigningResult {
+	resultChan := make(chan certsign.SigningResult, 1)
+	resultChan <- certsign.SigningResult{Action: action, Success: false, Message: err.Error()}
+	close(resultChan)
+	return resultChan
+}
+
+// sortedTaskNames returns the task names in results, in order.
+func sortedTaskNames(results map[string]TaskResult) []string {
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expectedCsrAttributes collects the attributes the request says the host's CSR will carry, so that a CSR from
+// some other machine claiming the same hostname is not signed.
+func expectedCsrAttributes(form url.Values) (*certsign.CsrAttributes, error) {
+	attributes := certsign.CsrAttributes{
+		ChallengePassword:    form.Get("challenge-password"),
+		PublicKeyFingerprint: form.Get("public-key-fingerprint"),
+		Extensions:           map[string]string{},
+	}
+	for field := range form {
+		if strings.HasPrefix(field, "pp_") {
+			if !certsign.IsKnownExtensionName(field) {
+				return nil, fmt.Errorf("%s is not a known puppet certificate extension.", field)
+			}
+			attributes.Extensions[field] = form.Get(field)
+		}
 	}
+	return &attributes, nil
 }
@@ -0,0 +1,330 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
+	"github.com/mbaynton/go-genericexec"
+)
+
+type mockCertQueuer struct {
+	mockCertCleaner
+	signErr error
+}
+
+func (ctx mockCertQueuer) QueueSign(hostname string, cleanExistingCert bool, options certsign.SignOptions) (<-chan certsign.SigningResult, error) {
+	if ctx.signErr != nil {
+		return nil, ctx.signErr
+	}
+	resultChan := make(chan certsign.SigningResult, 1)
+	resultChan <- certsign.SigningResult{Action: "sign", Success: true, Message: "Signed."}
+	close(resultChan)
+	return resultChan, nil
+}
+
+// mockSlowExecTaskRunner is mockExecTaskRunner, except that the slow tasks don't finish until release is closed.
+type mockSlowExecTaskRunner struct {
+	mockExecTaskRunner
+	slow    map[string]bool
+	release chan struct{}
+}
+
+func (ctx *mockSlowExecTaskRunner) RunTask(taskName string, argValues genericexec.TemplateGetter) <-chan genericexec.GenericExecResult {
+	if !ctx.slow[taskName] {
+		return ctx.mockExecTaskRunner.RunTask(taskName, argValues)
+	}
+	resultChan := make(chan genericexec.GenericExecResult, 1)
+	go func() {
+		<-ctx.release
+		resultChan <- <-ctx.mockExecTaskRunner.RunTask(taskName, argValues)
+		close(resultChan)
+	}()
+	return resultChan
+}
+
+func newProvisionTestHandler(tasks []*ExecTaskConfig, execManager execTaskRunner, certSigner certQueuer) *ProvisionHttpHandler {
+	appConfig := &AppConfig{GenericExecTasks: tasks, MaxProvisionWait: time.Minute, Log: log.New(&bytes.Buffer{}, "", 0)}
+	records, _ := NewProvisioningRecords(nil, appConfig.Log)
+	deprovisioner := NewDeprovisioner(nil, certSigner, execManager, nil, func(message string) {}, appConfig.Log)
+	return NewProvisionHttpHandler(appConfig, NewNotifications(appConfig), certSigner, execManager, deprovisioner, nil, records, NewProvisionJobs())
+}
+
+func newProvisionRequest(form url.Values) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/provision", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request
+}
+
+func TestProvisionHttpHandler_QueueFull(t *testing.T) {
+	execManager := &mockExecTaskRunner{exitCodes: map[string]int{"environment": 0}}
+	sut := newProvisionTestHandler(nil, execManager, mockCertQueuer{signErr: certsign.ErrQueueFull})
+
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, newProvisionRequest(url.Values{
+		"hostname":    {"foo.bar.com"},
+		"tasks":       {"cert-sign,environment"},
+		"environment": {"production"},
+		"waits":       {"cert-sign,environment"},
+	}))
+
+	if monitor.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected HTTP 503, got %d", monitor.Code)
+	}
+	if retryAfter := monitor.Header().Get("Retry-After"); retryAfter != queueFullRetryAfter {
+		t.Errorf("Expected Retry-After %s, got %q", queueFullRetryAfter, retryAfter)
+	}
+	expect := certsign.ErrQueueFull.Error() + " Certificate signing could not be queued; nothing was done."
+	if monitor.Body.String() != expect {
+		t.Errorf("Expected body %q, got %q", expect, monitor.Body.String())
+	}
+
+	// Signing failed, and the task after it was settled in the job without being run.
+	job, found := sut.jobs.Get(monitor.Header().Get("X-Job-Id"))
+	if !found {
+		t.Fatal("The request's job was not found.")
+	}
+	if result := job.Tasks["cert-sign"]; !result.Complete || result.Success || result.Message != certsign.ErrQueueFull.Error() {
+		t.Errorf("Expected cert-sign to fail, got %+v", result)
+	}
+	if result := job.Tasks["environment"]; !result.Complete || result.Success || !result.Skipped {
+		t.Errorf("Expected environment to be skipped, got %+v", result)
+	}
+	if len(execManager.ran) != 0 {
+		t.Errorf("Expected no tasks to run, got %v", execManager.ran)
+	}
+}
+
+func TestProvisionHttpHandler_WaitTimeout(t *testing.T) {
+	execManager := &mockSlowExecTaskRunner{
+		mockExecTaskRunner: mockExecTaskRunner{exitCodes: map[string]int{"dns": 0, "ldap": 0}},
+		slow:               map[string]bool{"ldap": true},
+		release:            make(chan struct{}),
+	}
+	defer close(execManager.release)
+	sut := newProvisionTestHandler(nil, execManager, mockCertQueuer{})
+
+	monitor := httptest.NewRecorder()
+	started := time.Now()
+	sut.ServeHTTP(monitor, newProvisionRequest(url.Values{
+		"hostname": {"foo.bar.com"},
+		"tasks":    {"dns,ldap"},
+		"waits":    {"dns,ldap"},
+		"timeout":  {"100ms"},
+	}))
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("Expected the response at the 100ms deadline, got it after %s", elapsed)
+	}
+
+	var results map[string]TaskResult
+	if monitor.Code != http.StatusOK || json.Unmarshal(monitor.Body.Bytes(), &results) != nil {
+		t.Fatalf("Expected a json response, got %d %s", monitor.Code, monitor.Body.String())
+	}
+	if result := results["dns"]; !result.Complete || !result.Success {
+		t.Errorf("Expected dns to have completed, got %+v", result)
+	}
+	expect := fmt.Sprintf("The task is still running. Its result will be available at /jobs/%s.", monitor.Header().Get("X-Job-Id"))
+	if result := results["ldap"]; result.Complete || result.Message != expect {
+		t.Errorf("Expected ldap to be reported as still running, got %+v", result)
+	}
+}
+
+func TestProvisionHttpHandler_ClientGoesAway(t *testing.T) {
+	execManager := &mockSlowExecTaskRunner{
+		mockExecTaskRunner: mockExecTaskRunner{exitCodes: map[string]int{"ldap": 0}},
+		slow:               map[string]bool{"ldap": true},
+		release:            make(chan struct{}),
+	}
+	sut := newProvisionTestHandler(nil, execManager, mockCertQueuer{})
+
+	requestContext, cancel := context.WithCancel(context.Background())
+	request := newProvisionRequest(url.Values{"hostname": {"foo.bar.com"}, "tasks": {"ldap"}, "waits": {"ldap"}}).WithContext(requestContext)
+	monitor := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		sut.ServeHTTP(monitor, request)
+		close(served)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The handler kept waiting after the client went away.")
+	}
+	if monitor.Body.Len() != 0 {
+		t.Errorf("Expected no response body, got %s", monitor.Body.String())
+	}
+
+	// The task carries on, and its result is recorded in the job.
+	jobId := monitor.Header().Get("X-Job-Id")
+	if job, _ := sut.jobs.Get(jobId); job.Tasks["ldap"].Complete {
+		t.Errorf("Expected ldap to still be running, got %+v", job.Tasks["ldap"])
+	}
+	close(execManager.release)
+	waitContext, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	job, _ := sut.jobs.Wait(waitContext, jobId)
+	if result := job.Tasks["ldap"]; !result.Complete || !result.Success {
+		t.Errorf("Expected ldap to complete in the job, got %+v", result)
+	}
+}
+
+func TestProvisionHttpHandler_EventStream(t *testing.T) {
+	execManager := &mockSlowExecTaskRunner{
+		mockExecTaskRunner: mockExecTaskRunner{exitCodes: map[string]int{"dns": 0, "ldap": 0}},
+		slow:               map[string]bool{"ldap": true},
+		release:            make(chan struct{}),
+	}
+	sut := newProvisionTestHandler(nil, execManager, mockCertQueuer{})
+
+	// No waits: the stream follows every task regardless.
+	request := newProvisionRequest(url.Values{"hostname": {"foo.bar.com"}, "tasks": {"dns,ldap"}})
+	request.Header.Set("Accept", "text/event-stream")
+	monitor := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		sut.ServeHTTP(monitor, request)
+		close(served)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(execManager.release)
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The stream did not end once every task was complete.")
+	}
+
+	if contentType := monitor.Header().Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Expected an event stream, got Content-Type %q", contentType)
+	}
+	completed := map[string]int{}
+	var summary ProvisionJob
+	events := strings.Split(strings.TrimSuffix(monitor.Body.String(), "\n\n"), "\n\n")
+	for i, event := range events {
+		lines := strings.SplitN(event, "\n", 2)
+		if len(lines) != 2 || !strings.HasPrefix(lines[1], "data: ") {
+			t.Fatalf("Malformed event %q", event)
+		}
+		data := []byte(strings.TrimPrefix(lines[1], "data: "))
+		switch lines[0] {
+		case "event: task":
+			var result taskEvent
+			if err := json.Unmarshal(data, &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Complete {
+				completed[result.Task]++
+			}
+		case "event: summary":
+			if i != len(events)-1 {
+				t.Error("The summary was not the last event.")
+			}
+			if err := json.Unmarshal(data, &summary); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if completed["dns"] != 1 || completed["ldap"] != 1 {
+		t.Errorf("Expected one event with each task's result, got %v in %s", completed, monitor.Body.String())
+	}
+	if !summary.Complete || !summary.Tasks["ldap"].Complete {
+		t.Errorf("Expected a summary of the complete job, got %+v", summary)
+	}
+}
+
+func TestProvisionHttpHandler_SkipsDependentsOfFailedTasks(t *testing.T) {
+	execManager := &mockExecTaskRunner{exitCodes: map[string]int{"dns": 1, "ldap": 0}}
+	tasks := []*ExecTaskConfig{{GenericExecConfig: genericexec.GenericExecConfig{Name: "ldap"}, DependsOn: []string{"dns"}}}
+	sut := newProvisionTestHandler(tasks, execManager, mockCertQueuer{})
+	expect := TaskResult{Complete: true, Success: false, Skipped: true, Message: "Skipped because dns failed."}
+
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, newProvisionRequest(url.Values{"hostname": {"foo.bar.com"}, "tasks": {"dns,ldap"}, "waits": {"dns,ldap"}}))
+	var results map[string]TaskResult
+	if err := json.Unmarshal(monitor.Body.Bytes(), &results); err != nil {
+		t.Fatalf("Expected a json response, got %d %s", monitor.Code, monitor.Body.String())
+	}
+	if results["ldap"] != expect {
+		t.Errorf("Expected /provision to report ldap as %+v, got %+v", expect, results["ldap"])
+	}
+
+	// At /v2/provision, the prerequisite may also be given in the request.
+	execManager = &mockExecTaskRunner{exitCodes: map[string]int{"dns": 1, "ldap": 0, "mail": 0}}
+	sutV2 := NewProvisionV2HttpHandler(newProvisionTestHandler(tasks, execManager, mockCertQueuer{}))
+	body := `{"Hostname": "foo.bar.com", "Tasks": [{"Name": "dns", "Wait": true}, {"Name": "ldap", "Wait": true}, {"Name": "mail", "Wait": true, "DependsOn": ["ldap"]}]}`
+	monitor = httptest.NewRecorder()
+	sutV2.ServeHTTP(monitor, httptest.NewRequest(http.MethodPost, "/v2/provision", strings.NewReader(body)))
+	var response ProvisionV2Response
+	if err := json.Unmarshal(monitor.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Expected a json response, got %d %s", monitor.Code, monitor.Body.String())
+	}
+	if response.Tasks["ldap"] != expect {
+		t.Errorf("Expected /v2/provision to report ldap as %+v, got %+v", expect, response.Tasks["ldap"])
+	}
+	expect.Message = "Skipped because ldap was skipped."
+	if response.Tasks["mail"] != expect {
+		t.Errorf("Expected /v2/provision to report mail as %+v, got %+v", expect, response.Tasks["mail"])
+	}
+	execManager.lock.Lock()
+	defer execManager.lock.Unlock()
+	if len(execManager.ran) != 1 || execManager.ran[0] != "dns foo.bar.com" {
+		t.Errorf("Expected only dns to run, got %v", execManager.ran)
+	}
+}
+
+func TestProvisionHttpHandler_InvalidParams(t *testing.T) {
+	execManager := &mockExecTaskRunner{exitCodes: map[string]int{"dns": 0, "environment": 0}}
+	tasks := []*ExecTaskConfig{
+		{GenericExecConfig: genericexec.GenericExecConfig{Name: "dns"}, Params: []*ExecTaskParam{{Name: "ttl", Type: ParamTypeInteger}}},
+		{GenericExecConfig: genericexec.GenericExecConfig{Name: "environment"}, Params: []*ExecTaskParam{{Name: "environment", Allowed: []string{"production", "staging"}}}},
+	}
+	for _, task := range tasks {
+		if err := task.compileParams(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sut := newProvisionTestHandler(tasks, execManager, mockCertQueuer{})
+	violations := []string{
+		"The dns task's ttl parameter must be an integer.",
+		"The environment task's environment parameter must be one of production, staging.",
+	}
+
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, newProvisionRequest(url.Values{
+		"hostname":    {"foo.bar.com"},
+		"tasks":       {"dns,environment"},
+		"ttl":         {"an hour"},
+		"environment": {"qa"},
+	}))
+	expect := "The request was refused, as some of its values are not valid:\n" + strings.Join(violations, "\n")
+	if monitor.Code != http.StatusBadRequest || monitor.Body.String() != expect {
+		t.Errorf("Expected HTTP 400 %q, got %d %q", expect, monitor.Code, monitor.Body.String())
+	}
+
+	monitor = httptest.NewRecorder()
+	body := `{"Hostname": "foo.bar.com", "Tasks": [{"Name": "dns", "Params": {"ttl": "an hour"}}, {"Name": "environment", "Params": {"environment": "qa"}}]}`
+	NewProvisionV2HttpHandler(sut).ServeHTTP(monitor, httptest.NewRequest(http.MethodPost, "/v2/provision", strings.NewReader(body)))
+	var response provisionV2Error
+	if err := json.Unmarshal(monitor.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Expected a json response, got %d %s", monitor.Code, monitor.Body.String())
+	}
+	if monitor.Code != http.StatusBadRequest || response.Error != expect || !reflect.DeepEqual(response.Violations, violations) {
+		t.Errorf("Expected HTTP 400 listing %v, got %d %+v", violations, monitor.Code, response)
+	}
+
+	if len(execManager.ran) != 0 {
+		t.Errorf("Expected nothing to run, got %v", execManager.ran)
+	}
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Jobs are forgotten this long after they start.
+const jobRetention = 24 * time.Hour
+
+// ProvisionJob follows the tasks of one /provision request as they finish, including those the request didn't wait
+// for.
+type ProvisionJob struct {
+	Id       string
+	Hostname string
+	Created  time.Time
+	Complete bool
+	Tasks    map[string]TaskResult
+}
+
+type provisionJob struct {
+	ProvisionJob
+	// Closed and replaced whenever a task result changes, waking anyone waiting on the job.
+	changed chan struct{}
+}
+
+// ProvisionJobs keeps the jobs of recent /provision requests in memory.
+type ProvisionJobs struct {
+	jobs map[string]*provisionJob
+	lock sync.Mutex
+	now  func() time.Time
+}
+
+func NewProvisionJobs() *ProvisionJobs {
+	return &ProvisionJobs{jobs: make(map[string]*provisionJob), now: time.Now}
+}
+
+// Start creates a job for the request to provision hostname with tasks, and returns its ID.
+func (ctx *ProvisionJobs) Start(hostname string, tasks []string) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	now := ctx.now()
+	for id, job := range ctx.jobs {
+		if now.Sub(job.Created) > jobRetention {
+			delete(ctx.jobs, id)
+		}
+	}
+
+	job := provisionJob{
+		ProvisionJob: ProvisionJob{
+			Id:       hex.EncodeToString(idBytes),
+			Hostname: hostname,
+			Created:  now,
+			Tasks:    make(map[string]TaskResult, len(tasks)),
+		},
+		changed: make(chan struct{}),
+	}
+	for _, task := range tasks {
+		job.Tasks[task] = TaskResult{Complete: false, Success: true, Message: "The task is still running."}
+	}
+	ctx.jobs[job.Id] = &job
+	return job.Id, nil
+}
+
+// Update sets the result of one of the job's tasks. A result that is not complete does not replace one that is.
+func (ctx *ProvisionJobs) Update(id string, task string, result TaskResult) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	job, found := ctx.jobs[id]
+	if !found {
+		return
+	}
+	if earlier, found := job.Tasks[task]; found && earlier.Complete && !result.Complete {
+		return
+	}
+	job.Tasks[task] = result
+	close(job.changed)
+	job.changed = make(chan struct{})
+}
+
+// Get returns a copy of the job, if there is one with the ID.
+func (ctx *ProvisionJobs) Get(id string) (ProvisionJob, bool) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	job, found := ctx.jobs[id]
+	if !found {
+		return ProvisionJob{}, false
+	}
+	return job.copy(), true
+}
+
+// Wait returns a copy of the job once all its tasks are complete, or when waitContext is done.
+func (ctx *ProvisionJobs) Wait(waitContext context.Context, id string) (ProvisionJob, bool) {
+	for {
+		ctx.lock.Lock()
+		job, found := ctx.jobs[id]
+		if !found {
+			ctx.lock.Unlock()
+			return ProvisionJob{}, false
+		}
+		snapshot := job.copy()
+		changed := job.changed
+		ctx.lock.Unlock()
+
+		if snapshot.Complete {
+			return snapshot, true
+		}
+		select {
+		case <-changed:
+		case <-waitContext.Done():
+			return snapshot, true
+		}
+	}
+}
+
+// copy returns a copy of the job that shares nothing mutable with it. The caller must hold the lock.
+func (job *provisionJob) copy() ProvisionJob {
+	result := job.ProvisionJob
+	result.Complete = true
+	result.Tasks = make(map[string]TaskResult, len(job.Tasks))
+	for task, taskResult := range job.Tasks {
+		result.Tasks[task] = taskResult
+		if !taskResult.Complete {
+			result.Complete = false
+		}
+	}
+	return result
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProvisionJobs_Update(t *testing.T) {
+	sut := NewProvisionJobs()
+	id, err := sut.Start("foo.bar.com", []string{"cert-sign", "environment"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 32 {
+		t.Errorf("Expected a 128-bit hex job ID, got %s", id)
+	}
+
+	job, found := sut.Get(id)
+	if !found || job.Hostname != "foo.bar.com" || job.Complete || len(job.Tasks) != 2 || job.Tasks["cert-sign"].Complete {
+		t.Errorf("Expected a new job with two pending tasks, got %+v", job)
+	}
+
+	sut.Update(id, "environment", TaskResult{Complete: true, Success: true, Message: "foo.bar.com added to production."})
+	sut.Update(id, "environment", TaskResult{Complete: false, Success: true, Message: "Queued."})
+	sut.Update(id, "cert-sign", TaskResult{Complete: true, Success: true, Message: "Signed."})
+	job, _ = sut.Get(id)
+	if !job.Complete || job.Tasks["environment"].Message != "foo.bar.com added to production." {
+		t.Errorf("Expected a complete job, got %+v", job)
+	}
+
+	if _, found := sut.Get("nonexistent"); found {
+		t.Error("Found a job that doesn't exist.")
+	}
+}
+
+func TestProvisionJobs_Wait(t *testing.T) {
+	sut := NewProvisionJobs()
+	id, _ := sut.Start("foo.bar.com", []string{"cert-sign"})
+
+	// Times out while the task is pending.
+	waitContext, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	job, found := sut.Wait(waitContext, id)
+	cancel()
+	if !found || job.Complete {
+		t.Errorf("Expected the pending job when the wait times out, got %+v", job)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sut.Update(id, "cert-sign", TaskResult{Complete: true, Success: true, Message: "Signed."})
+	}()
+	waitContext, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	job, _ = sut.Wait(waitContext, id)
+	if !job.Complete || job.Tasks["cert-sign"].Message != "Signed." {
+		t.Errorf("Expected the wait to end with the late signature, got %+v", job)
+	}
+}
+
+func TestProvisionJobs_Expire(t *testing.T) {
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	sut := NewProvisionJobs()
+	sut.now = func() time.Time { return now }
+	old, _ := sut.Start("foo.bar.com", nil)
+	now = now.Add(25 * time.Hour)
+	sut.Start("baz.bar.com", nil)
+	if _, found := sut.Get(old); found {
+		t.Error("Expected the day-old job to be forgotten.")
+	}
+}
@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Tasks handled by the provisioner itself rather than a GenericExecTask.
+var builtinProvisionTasks = []string{"cert-sign", "cert-revoke", "deprovision"}
+
+// ProvisionV2HttpHandler serves /v2/provision, which takes the request as a JSON document and responds with the
+// request's job.
+type ProvisionV2HttpHandler struct {
+	provisioner *ProvisionHttpHandler
+	isTask      func(name string) bool
+}
+
+// provisionV2Request is the JSON document posted to /v2/provision.
+type provisionV2Request struct {
+	Hostname string
+	Tasks    []provisionV2Task
+	// How long to wait on the tasks marked Wait, such as "5m". Limited to MaxProvisionWait.
+	Timeout string
+}
+
+type provisionV2Task struct {
+	Name string
+	// Values available to the task, in addition to the hostname.
+	Params map[string]string
+	// Whether the response waits for the task's result.
+	Wait bool
+	// Other tasks in the request that must succeed before this one starts, in addition to any configured.
+	DependsOn []string
+}
+
+// ProvisionV2Response is the response to a /v2/provision request: its job as it stands once the waits are over.
+type ProvisionV2Response struct {
+	ProvisionJob
+	// Whether no task has failed so far.
+	Success bool
+}
+
+type provisionV2Error struct {
+	Error string
+	// Each of the request's values that was not accepted, when that is why it was refused.
+	Violations []string `json:",omitempty"`
+}
+
+// NewProvisionV2HttpHandler returns a handler that runs requests with provisioner, which also serves /provision.
+func NewProvisionV2HttpHandler(provisioner *ProvisionHttpHandler) *ProvisionV2HttpHandler {
+	return &ProvisionV2HttpHandler{provisioner: provisioner, isTask: provisioner.execManager.IsTaskConfigured}
+}
+
+func (ctx ProvisionV2HttpHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		respondV2Error(response, http.StatusMethodNotAllowed, provisionV2Error{Error: "This API accepts only HTTP POST method requests."})
+		return
+	}
+
+	var body provisionV2Request
+	decoder := json.NewDecoder(io.LimitReader(request.Body, 1024*1024))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		respondV2Error(response, http.StatusBadRequest, provisionV2Error{Error: fmt.Sprintf("The request body is not a valid provisioning request: %s", err.Error())})
+		return
+	}
+	provisionRequest, err := ctx.parse(body)
+	if err != nil {
+		respondV2Error(response, http.StatusBadRequest, provisionV2Error{Error: err.Error()})
+		return
+	}
+	provisionRequest.requestedBy = AuthenticatedUser(request)
+
+	started, provisionErr := ctx.provisioner.start(provisionRequest)
+	if started != nil {
+		response.Header().Set("X-Job-Id", started.job.Id)
+	}
+	if provisionErr != nil {
+		if provisionErr.retryAfter != "" {
+			response.Header().Set("Retry-After", provisionErr.retryAfter)
+		}
+		respondV2Error(response, provisionErr.status, provisionV2Error{Error: provisionErr.message, Violations: provisionErr.violations})
+		return
+	}
+	if !ctx.provisioner.wait(started, request.Context().Done(), nil) {
+		return
+	}
+
+	job, _ := ctx.provisioner.jobs.Get(started.job.Id)
+	// Tasks that timed out are incomplete in the job, without the explanation in the results.
+	for task, result := range started.results {
+		if earlier, found := job.Tasks[task]; !found || !earlier.Complete {
+			job.Tasks[task] = result
+		}
+	}
+	respondV2(response, job)
+}
+
+// parse turns the JSON document into a provisioning request, or explains why it can't be run.
+func (ctx ProvisionV2HttpHandler) parse(body provisionV2Request) (*provisionRequest, error) {
+	if body.Hostname == "" {
+		return nil, errors.New("No hostname provided.")
+	}
+	if len(body.Tasks) == 0 {
+		return nil, errors.New("No tasks provided.")
+	}
+
+	req := provisionRequest{
+		hostname:  body.Hostname,
+		params:    make(map[string]url.Values, len(body.Tasks)),
+		dependsOn: make(map[string][]string),
+	}
+	for _, task := range body.Tasks {
+		if task.Name == "" {
+			return nil, errors.New("Every task must have a name.")
+		}
+		if _, duplicate := req.params[task.Name]; duplicate {
+			return nil, fmt.Errorf("The %s task is listed more than once.", task.Name)
+		}
+		if !ctx.isTask(task.Name) && !containsString(builtinProvisionTasks, task.Name) {
+			return nil, fmt.Errorf("%s is not a recognized task.", task.Name)
+		}
+
+		params := url.Values{"hostname": {body.Hostname}}
+		for name, value := range task.Params {
+			if name != "hostname" {
+				params.Set(name, value)
+			}
+		}
+		req.params[task.Name] = params
+		req.tasks = append(req.tasks, task.Name)
+		if task.Wait {
+			req.waits = append(req.waits, task.Name)
+		}
+		if len(task.DependsOn) > 0 {
+			req.dependsOn[task.Name] = task.DependsOn
+		}
+	}
+	for _, task := range body.Tasks {
+		for _, prerequisite := range task.DependsOn {
+			if _, requested := req.params[prerequisite]; !requested {
+				return nil, fmt.Errorf("%s depends on %s, which is not in the request.", task.Name, prerequisite)
+			}
+		}
+	}
+	sort.Sort(req.tasks)
+	sort.Sort(req.waits)
+
+	if body.Timeout != "" {
+		var err error
+		if req.timeout, err = parseWaitTimeout(body.Timeout); err != nil {
+			return nil, err
+		}
+	}
+	return &req, nil
+}
+
+// respondV2 sends the job with a status reflecting the outcome: 202 while some tasks are still running, 200 once all
+// have succeeded, and 422 once all are complete but some failed. A failed task is the request's outcome rather than
+// a fault of the server, so it is not given a 5xx status.
+func respondV2(response http.ResponseWriter, job ProvisionJob) {
+	body := ProvisionV2Response{ProvisionJob: job, Success: true}
+	for task, result := range job.Tasks {
+		// The PuppetDB check only warns; provisioning went ahead.
+		if task != "puppetdb-check" && !result.Success {
+			body.Success = false
+		}
+	}
+
+	status := http.StatusOK
+	if !body.Complete {
+		status = http.StatusAccepted
+	} else if !body.Success {
+		status = http.StatusUnprocessableEntity
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(&body)
+}
+
+func respondV2Error(response http.ResponseWriter, status int, body provisionV2Error) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(&body)
+}
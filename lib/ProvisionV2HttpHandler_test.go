@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newV2TestHandler() *ProvisionV2HttpHandler {
+	return &ProvisionV2HttpHandler{
+		provisioner: &ProvisionHttpHandler{},
+		isTask:      func(name string) bool { return name == "environment" || name == "dns" },
+	}
+}
+
+func TestProvisionV2HttpHandler_parse(t *testing.T) {
+	sut := newV2TestHandler()
+	req, err := sut.parse(provisionV2Request{
+		Hostname: "foo.bar.com",
+		Tasks: []provisionV2Task{
+			{Name: "environment", Params: map[string]string{"environment": "production", "hostname": "evil.bar.com"}, Wait: true},
+			{Name: "cert-sign", Params: map[string]string{"pp_role": "web"}, Wait: true, DependsOn: []string{"environment"}},
+			{Name: "dns"},
+		},
+		Timeout: "2m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(req.tasks, ",") != "cert-sign,dns,environment" || strings.Join(req.waits, ",") != "cert-sign,environment" {
+		t.Errorf("Unexpected tasks %v and waits %v", req.tasks, req.waits)
+	}
+	if len(req.dependsOn) != 1 || req.dependsOn["cert-sign"][0] != "environment" {
+		t.Errorf("Unexpected dependencies %v", req.dependsOn)
+	}
+	if req.timeout != 2*time.Minute {
+		t.Errorf("Expected a timeout of 2m, got %s", req.timeout)
+	}
+	if env := req.params["environment"]; env.Get("environment") != "production" || env.Get("hostname") != "foo.bar.com" {
+		t.Errorf("Unexpected environment task params %v", env)
+	}
+	if sign := req.params["cert-sign"]; sign.Get("pp_role") != "web" || sign.Get("environment") != "" {
+		t.Errorf("Unexpected cert-sign task params %v", sign)
+	}
+
+	invalid := map[string]provisionV2Request{
+		"No hostname provided.":                                    {Tasks: []provisionV2Task{{Name: "dns"}}},
+		"No tasks provided.":                                       {Hostname: "foo.bar.com"},
+		"Every task must have a name.":                             {Hostname: "foo.bar.com", Tasks: []provisionV2Task{{}}},
+		"The dns task is listed more than once.":                   {Hostname: "foo.bar.com", Tasks: []provisionV2Task{{Name: "dns"}, {Name: "dns", Wait: true}}},
+		"ldap is not a recognized task.":                           {Hostname: "foo.bar.com", Tasks: []provisionV2Task{{Name: "ldap"}}},
+		"dns depends on environment, which is not in the request.": {Hostname: "foo.bar.com", Tasks: []provisionV2Task{{Name: "dns", DependsOn: []string{"environment"}}}},
+		"timeout must be a positive duration, such as \"5m\".":     {Hostname: "foo.bar.com", Tasks: []provisionV2Task{{Name: "dns"}}, Timeout: "-1s"},
+	}
+	for expect, body := range invalid {
+		if _, err := sut.parse(body); err == nil || err.Error() != expect {
+			t.Errorf("Expected error %q, got %v", expect, err)
+		}
+	}
+}
+
+func TestProvisionV2HttpHandler_InvalidRequests(t *testing.T) {
+	sut := newV2TestHandler()
+	cases := map[string]int{
+		`{"hostname": "foo.bar.com", "tasks": [{"name": "dns"}], "waits": ["dns"]}`: http.StatusBadRequest,
+		`hostname=foo.bar.com&tasks=dns`:                                            http.StatusBadRequest,
+		`{"hostname": "foo.bar.com", "tasks": []}`:                                  http.StatusBadRequest,
+	}
+	for body, status := range cases {
+		monitor := httptest.NewRecorder()
+		sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodPost, "/v2/provision", strings.NewReader(body)))
+		var response provisionV2Error
+		if monitor.Code != status || json.Unmarshal(monitor.Body.Bytes(), &response) != nil || response.Error == "" {
+			t.Errorf("Expected HTTP %d with an error for %s, got %d %s", status, body, monitor.Code, monitor.Body.String())
+		}
+	}
+
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/v2/provision", nil))
+	if monitor.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected HTTP 405 for a GET, got %d", monitor.Code)
+	}
+}
+
+func TestRespondV2(t *testing.T) {
+	cases := []struct {
+		tasks   map[string]TaskResult
+		status  int
+		success bool
+	}{
+		{map[string]TaskResult{"dns": {Complete: true, Success: true}}, http.StatusOK, true},
+		{map[string]TaskResult{"dns": {Complete: true, Success: true}, "cert-sign": {Complete: false, Success: true}}, http.StatusAccepted, true},
+		{map[string]TaskResult{"dns": {Complete: true, Success: false}, "cert-sign": {Complete: false, Success: true}}, http.StatusAccepted, false},
+		{map[string]TaskResult{"dns": {Complete: true, Success: false}, "cert-sign": {Complete: true, Success: true}}, http.StatusUnprocessableEntity, false},
+		{map[string]TaskResult{"dns": {Complete: true, Success: true}, "puppetdb-check": {Complete: true, Success: false}}, http.StatusOK, true},
+	}
+	for _, c := range cases {
+		job := ProvisionJob{Id: "abc", Hostname: "foo.bar.com", Complete: true, Tasks: c.tasks}
+		for _, result := range c.tasks {
+			job.Complete = job.Complete && result.Complete
+		}
+		monitor := httptest.NewRecorder()
+		respondV2(monitor, job)
+
+		var response ProvisionV2Response
+		if err := json.Unmarshal(monitor.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if monitor.Code != c.status || response.Success != c.success || response.Id != "abc" || len(response.Tasks) != len(c.tasks) {
+			t.Errorf("Expected HTTP %d and Success %v for %+v, got %d %+v", c.status, c.success, c.tasks, monitor.Code, response)
+		}
+	}
+}
+
+func TestProvisionV2HttpHandler_FailedTask(t *testing.T) {
+	execManager := &mockExecTaskRunner{exitCodes: map[string]int{"dns": 0, "ldap": 1}}
+	sut := NewProvisionV2HttpHandler(newProvisionTestHandler(nil, execManager, mockCertQueuer{}))
+
+	body := `{"Hostname": "foo.bar.com", "Tasks": [{"Name": "dns", "Wait": true}, {"Name": "ldap", "Params": {"ou": "web"}, "Wait": true}]}`
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodPost, "/v2/provision", strings.NewReader(body)))
+
+	var response ProvisionV2Response
+	if err := json.Unmarshal(monitor.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Expected a json response, got %s", monitor.Body.String())
+	}
+	if monitor.Code != http.StatusUnprocessableEntity || response.Success || !response.Complete {
+		t.Errorf("Expected HTTP 422 for a complete job with Success false, got %d %+v", monitor.Code, response)
+	}
+	if response.Id == "" || response.Id != monitor.Header().Get("X-Job-Id") {
+		t.Errorf("Expected the job's ID in the body and X-Job-Id, got %q and %q", response.Id, monitor.Header().Get("X-Job-Id"))
+	}
+	if result := response.Tasks["ldap"]; !result.Complete || result.Success {
+		t.Errorf("Expected ldap to have failed, got %+v", result)
+	}
+	if result := response.Tasks["dns"]; !result.Complete || !result.Success {
+		t.Errorf("Expected dns to have succeeded, got %+v", result)
+	}
+}
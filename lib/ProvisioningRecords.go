@@ -0,0 +1,296 @@
+package lib
+
+import (
+	"encoding/json"
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/atomicfile"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Provisioning record states. A host asked for a certificate moves from requested through awaiting-csr, signed
+// and first-run-reported to complete or failed, according to the outcome of its first puppet run. Other requests
+// are complete once all their tasks succeed. Any failed task fails the record, even one finishing after it was
+// complete.
+const (
+	ProvisioningRequested         = "requested"
+	ProvisioningAwaitingCsr       = "awaiting-csr"
+	ProvisioningSigned            = "signed"
+	ProvisioningFirstRunReported  = "first-run-reported"
+	ProvisioningComplete          = "complete"
+	ProvisioningFailed            = "failed"
+	defaultProvisioningRecordFile = "/var/lib/spp/provisioning-records.json"
+	defaultProvisioningRetention  = 90 * 24 * time.Hour
+	defaultProvisioningSaveDelay  = time.Second
+)
+
+// ProvisioningRecordsConfig customizes how provisioning records are kept.
+type ProvisioningRecordsConfig struct {
+	// The file records are saved in. Default /var/lib/spp/provisioning-records.json.
+	Store string
+	// How long a record is kept after it last changed. Default 2160h (90 days).
+	Retention time.Duration
+}
+
+// FirstRun summarizes the report of a newly provisioned node's first puppet run.
+type FirstRun struct {
+	Reported        time.Time
+	Status          string
+	FailedResources int
+}
+
+// StateChange is an entry in a provisioning record's history.
+type StateChange struct {
+	State string
+	Time  time.Time
+}
+
+// ProvisioningRecord follows a host from its most recent /provision request to the report of its first puppet run.
+type ProvisioningRecord struct {
+	Hostname    string
+	State       string
+	RequestedBy string
+	Requested   time.Time
+	Updated     time.Time
+	Tasks       map[string]TaskResult
+	FirstRun    *FirstRun
+	Finished    *time.Time
+	History     []StateChange
+}
+
+// ProvisioningRecords keeps the most recent provisioning record for each host, saved in a JSON file so that the
+// history survives a restart. Changes are saved together shortly after the first of them, rather than one by one,
+// so that a burst of task results and reports costs one write of the file.
+type ProvisioningRecords struct {
+	records       map[string]*ProvisioningRecord
+	path          string // Records aren't saved if empty.
+	retention     time.Duration
+	log           *log.Logger
+	lock          sync.Mutex
+	now           func() time.Time
+	saveDelay     time.Duration
+	saveScheduled bool
+	saveLock      sync.Mutex // Held while writing the file, so that writes land in the order they were taken.
+}
+
+// NewProvisioningRecords loads the records saved in config's Store, if it exists yet.
+func NewProvisioningRecords(config *ProvisioningRecordsConfig, log *log.Logger) (*ProvisioningRecords, error) {
+	records := ProvisioningRecords{
+		records:   make(map[string]*ProvisioningRecord),
+		retention: defaultProvisioningRetention,
+		log:       log,
+		now:       time.Now,
+		saveDelay: defaultProvisioningSaveDelay,
+	}
+	if config != nil {
+		records.path = config.Store
+		if config.Retention > 0 {
+			records.retention = config.Retention
+		}
+	}
+	if records.path == "" {
+		return &records, nil
+	}
+
+	data, err := ioutil.ReadFile(records.path)
+	if os.IsNotExist(err) {
+		return &records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved []*ProvisioningRecord
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for _, record := range saved {
+		records.records[record.Hostname] = record
+	}
+	return &records, nil
+}
+
+// Start opens a new provisioning record for hostname, replacing any earlier one. The record waits for a result
+// from each of tasks.
+func (ctx *ProvisioningRecords) Start(hostname string, requestedBy string, tasks []string) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	now := ctx.now()
+	record := ProvisioningRecord{
+		Hostname:    hostname,
+		State:       ProvisioningRequested,
+		RequestedBy: requestedBy,
+		Requested:   now,
+		Updated:     now,
+		Tasks:       make(map[string]TaskResult, len(tasks)),
+		History:     []StateChange{{State: ProvisioningRequested, Time: now}},
+	}
+	for _, task := range tasks {
+		record.Tasks[task] = TaskResult{Complete: false, Success: true}
+	}
+	ctx.records[hostname] = &record
+	ctx.prune(now)
+	ctx.scheduleSave()
+}
+
+// AwaitCsr notes that the host's certificate is to be signed once its CSR arrives.
+func (ctx *ProvisioningRecords) AwaitCsr(hostname string) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if record, found := ctx.records[hostname]; found && record.State == ProvisioningRequested {
+		ctx.transition(record, ProvisioningAwaitingCsr)
+		ctx.scheduleSave()
+	}
+}
+
+// RecordTaskResult adds the result of one of the host's tasks to its record. A result that is not complete does not
+// replace one that is.
+func (ctx *ProvisioningRecords) RecordTaskResult(hostname string, task string, result TaskResult) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	record, found := ctx.records[hostname]
+	if !found {
+		return
+	}
+	if earlier, found := record.Tasks[task]; found && earlier.Complete && !result.Complete {
+		return
+	}
+	record.Tasks[task] = result
+	record.Updated = ctx.now()
+
+	switch {
+	case record.State == ProvisioningFailed:
+	case result.Complete && !result.Success:
+		ctx.transition(record, ProvisioningFailed)
+	case record.State == ProvisioningComplete:
+	case task == "cert-sign" && result.Complete && record.State == ProvisioningAwaitingCsr:
+		ctx.transition(record, ProvisioningSigned)
+	case record.State == ProvisioningRequested && record.tasksSucceeded():
+		ctx.transition(record, ProvisioningComplete)
+	}
+	ctx.scheduleSave()
+}
+
+// RecordFirstRun completes the provisioning record for hostname with the outcome of its first puppet run, if the
+// host was given a certificate within the given duration and has not reported before. It returns the updated
+// record and whether the run was recorded.
+func (ctx *ProvisioningRecords) RecordFirstRun(hostname string, run FirstRun, within time.Duration) (ProvisioningRecord, bool) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	record, found := ctx.records[hostname]
+	if !found || (record.State != ProvisioningAwaitingCsr && record.State != ProvisioningSigned) || ctx.now().Sub(record.Requested) > within {
+		return ProvisioningRecord{}, false
+	}
+
+	record.FirstRun = &run
+	ctx.transition(record, ProvisioningFirstRunReported)
+	if run.Status == "failed" || run.FailedResources > 0 {
+		ctx.transition(record, ProvisioningFailed)
+	} else {
+		ctx.transition(record, ProvisioningComplete)
+	}
+	ctx.scheduleSave()
+	return record.copy(), true
+}
+
+// Get returns a copy of the provisioning record for hostname, if there is one.
+func (ctx *ProvisioningRecords) Get(hostname string) (ProvisioningRecord, bool) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	record, found := ctx.records[hostname]
+	if !found {
+		return ProvisioningRecord{}, false
+	}
+	return record.copy(), true
+}
+
+// List returns copies of all the provisioning records, ordered by hostname.
+func (ctx *ProvisioningRecords) List() []ProvisioningRecord {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	list := make([]ProvisioningRecord, 0, len(ctx.records))
+	for _, record := range ctx.records {
+		list = append(list, record.copy())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Hostname < list[j].Hostname })
+	return list
+}
+
+// transition moves record to state. The caller must hold the lock.
+func (ctx *ProvisioningRecords) transition(record *ProvisioningRecord, state string) {
+	now := ctx.now()
+	record.State = state
+	record.Updated = now
+	record.History = append(record.History, StateChange{State: state, Time: now})
+	if state == ProvisioningComplete || state == ProvisioningFailed {
+		record.Finished = &now
+	}
+}
+
+// prune forgets records that haven't changed within the retention period. The caller must hold the lock.
+func (ctx *ProvisioningRecords) prune(now time.Time) {
+	for hostname, record := range ctx.records {
+		if now.Sub(record.Updated) > ctx.retention {
+			delete(ctx.records, hostname)
+		}
+	}
+}
+
+// Flush saves any changes not saved yet. It is called once the service stops taking requests, so that changes
+// made in the last moments aren't lost.
+func (ctx *ProvisioningRecords) Flush() {
+	ctx.saveLock.Lock()
+	defer ctx.saveLock.Unlock()
+
+	ctx.lock.Lock()
+	if !ctx.saveScheduled {
+		ctx.lock.Unlock()
+		return
+	}
+	ctx.saveScheduled = false
+	records := make([]*ProvisioningRecord, 0, len(ctx.records))
+	for _, record := range ctx.records {
+		records = append(records, record)
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	ctx.lock.Unlock()
+
+	if err == nil {
+		err = atomicfile.WriteFile(ctx.path, data, 0600)
+	}
+	if err != nil {
+		ctx.log.Printf("Unable to save provisioning records to %s: %s\n", ctx.path, err.Error())
+	}
+}
+
+// scheduleSave arranges for the records to be saved, if they are saved, unless that is already arranged. The
+// caller must hold the lock.
+func (ctx *ProvisioningRecords) scheduleSave() {
+	if ctx.path == "" || ctx.saveScheduled {
+		return
+	}
+	ctx.saveScheduled = true
+	time.AfterFunc(ctx.saveDelay, ctx.Flush)
+}
+
+// tasksSucceeded reports whether every task the record lists completed successfully.
+func (record *ProvisioningRecord) tasksSucceeded() bool {
+	for _, result := range record.Tasks {
+		if !result.Complete || !result.Success {
+			return false
+		}
+	}
+	return true
+}
+
+// copy returns a copy of record that shares nothing mutable with it.
+func (record *ProvisioningRecord) copy() ProvisioningRecord {
+	result := *record
+	result.Tasks = make(map[string]TaskResult, len(record.Tasks))
+	for task, taskResult := range record.Tasks {
+		result.Tasks[task] = taskResult
+	}
+	result.History = append([]StateChange(nil), record.History...)
+	return result
+}
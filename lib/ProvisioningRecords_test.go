@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func provisioningRecordsSutFactory(t *testing.T, config *ProvisioningRecordsConfig, now *time.Time) *ProvisioningRecords {
+	sut, err := NewProvisioningRecords(config, log.New(&bytes.Buffer{}, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sut.now = func() time.Time { return *now }
+	return sut
+}
+
+func recordStates(record ProvisioningRecord) []string {
+	var states []string
+	for _, change := range record.History {
+		states = append(states, change.State)
+	}
+	return states
+}
+
+func TestProvisioningRecords_NewNode(t *testing.T) {
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	sut := provisioningRecordsSutFactory(t, nil, &now)
+
+	if _, recorded := sut.RecordFirstRun("foo.bar.com", FirstRun{Status: "changed"}, time.Hour); recorded {
+		t.Error("A first run was recorded for a host that was never provisioned.")
+	}
+
+	sut.Start("foo.bar.com", "provision-user", []string{"cert-sign", "environment"})
+	sut.AwaitCsr("foo.bar.com")
+	sut.RecordTaskResult("foo.bar.com", "environment", TaskResult{Complete: true, Success: true, Message: "foo.bar.com added to production."})
+	// The queued result the response reports does not replace the one already recorded.
+	sut.RecordTaskResult("foo.bar.com", "environment", TaskResult{Complete: false, Success: true})
+	if record, _ := sut.Get("foo.bar.com"); record.State != ProvisioningAwaitingCsr || !record.Tasks["environment"].Complete {
+		t.Errorf("Expected a record awaiting its CSR, with the environment task complete, got %+v", record)
+	}
+
+	sut.RecordTaskResult("foo.bar.com", "cert-sign", TaskResult{Complete: true, Success: true})
+	record, recorded := sut.RecordFirstRun("foo.bar.com", FirstRun{Status: "changed"}, time.Hour)
+	if !recorded || record.State != ProvisioningComplete || record.RequestedBy != "provision-user" || record.FirstRun.Status != "changed" {
+		t.Errorf("Expected a complete record, got %+v", record)
+	}
+	expect := []string{ProvisioningRequested, ProvisioningAwaitingCsr, ProvisioningSigned, ProvisioningFirstRunReported, ProvisioningComplete}
+	if states := recordStates(record); len(states) != len(expect) || states[2] != ProvisioningSigned || states[4] != ProvisioningComplete {
+		t.Errorf("Expected history %v, got %v", expect, states)
+	}
+
+	if _, recorded := sut.RecordFirstRun("foo.bar.com", FirstRun{Status: "failed"}, time.Hour); recorded {
+		t.Error("A second run was recorded as the first.")
+	}
+}
+
+func TestProvisioningRecords_Failures(t *testing.T) {
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	sut := provisioningRecordsSutFactory(t, nil, &now)
+
+	sut.Start("foo.bar.com", "", []string{"cert-sign"})
+	sut.AwaitCsr("foo.bar.com")
+	sut.RecordTaskResult("foo.bar.com", "cert-sign", TaskResult{Complete: true, Success: false, Message: "The authorization expired."})
+	if record, _ := sut.Get("foo.bar.com"); record.State != ProvisioningFailed || record.Finished == nil {
+		t.Errorf("Expected a failed record, got %+v", record)
+	}
+
+	sut.Start("baz.bar.com", "", []string{"cert-sign"})
+	sut.AwaitCsr("baz.bar.com")
+	now = now.Add(2 * time.Hour)
+	if _, recorded := sut.RecordFirstRun("baz.bar.com", FirstRun{Status: "changed"}, time.Hour); recorded {
+		t.Error("A report long after provisioning was recorded as the first run.")
+	}
+	record, recorded := sut.RecordFirstRun("baz.bar.com", FirstRun{Status: "changed", FailedResources: 2}, 3*time.Hour)
+	if !recorded || record.State != ProvisioningFailed || !record.Finished.Equal(now) {
+		t.Errorf("Expected a failed record, got %+v", record)
+	}
+}
+
+func TestProvisioningRecords_TasksOnly(t *testing.T) {
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	sut := provisioningRecordsSutFactory(t, nil, &now)
+
+	sut.Start("foo.bar.com", "", []string{"environment", "example"})
+	sut.RecordTaskResult("foo.bar.com", "environment", TaskResult{Complete: true, Success: true})
+	if record, _ := sut.Get("foo.bar.com"); record.State != ProvisioningRequested {
+		t.Errorf("The record was complete before all its tasks were, got %+v", record)
+	}
+	sut.RecordTaskResult("foo.bar.com", "example", TaskResult{Complete: true, Success: true})
+	if record, _ := sut.Get("foo.bar.com"); record.State != ProvisioningComplete {
+		t.Errorf("Expected a complete record, got %+v", record)
+	}
+	if _, recorded := sut.RecordFirstRun("foo.bar.com", FirstRun{Status: "changed"}, time.Hour); recorded {
+		t.Error("A first run was recorded for a host that wasn't given a certificate.")
+	}
+}
+
+func TestProvisioningRecords_Persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spp-records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &ProvisioningRecordsConfig{Store: filepath.Join(dir, "spp", "provisioning-records.json"), Retention: 24 * time.Hour}
+
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	sut := provisioningRecordsSutFactory(t, config, &now)
+	sut.Start("old.bar.com", "", nil)
+	now = now.Add(12 * time.Hour)
+	sut.Start("foo.bar.com", "provision-user", []string{"cert-sign"})
+	sut.AwaitCsr("foo.bar.com")
+	sut.Flush()
+
+	reloaded := provisioningRecordsSutFactory(t, config, &now)
+	record, found := reloaded.Get("foo.bar.com")
+	if !found || record.State != ProvisioningAwaitingCsr || record.RequestedBy != "provision-user" || len(record.History) != 2 {
+		t.Fatalf("The record was not reloaded, got %+v", record)
+	}
+
+	// Records that haven't changed within the retention period are forgotten.
+	now = now.Add(13 * time.Hour)
+	reloaded.Start("baz.bar.com", "", nil)
+	if listing := reloaded.List(); len(listing) != 2 || listing[0].Hostname != "baz.bar.com" || listing[1].Hostname != "foo.bar.com" {
+		t.Errorf("Expected the old record to be pruned, got %+v", listing)
+	}
+}
+
+func TestProvisioningRecords_SavesChangesTogether(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spp-records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &ProvisioningRecordsConfig{Store: filepath.Join(dir, "provisioning-records.json")}
+
+	now := time.Now()
+	sut := provisioningRecordsSutFactory(t, config, &now)
+	sut.saveDelay = 20 * time.Millisecond
+	sut.Start("foo.bar.com", "", []string{"a", "b"})
+	sut.RecordTaskResult("foo.bar.com", "a", TaskResult{Complete: true, Success: true})
+	if _, err := os.Stat(config.Store); !os.IsNotExist(err) {
+		t.Fatalf("Expected the records not to be saved straight away, got %v", err)
+	}
+
+	sut.RecordTaskResult("foo.bar.com", "b", TaskResult{Complete: true, Success: true})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reloaded := provisioningRecordsSutFactory(t, config, &now)
+		if record, found := reloaded.Get("foo.bar.com"); found && record.State == ProvisioningComplete {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The records were never saved with all the changes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,33 @@
+package lib
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetdb"
+)
+
+// Default for PuppetDb ActiveWithin.
+const defaultActiveWithin = 24 * time.Hour
+
+// nodeFinder fetches a node's status from PuppetDB, failing with puppetdb.ErrNodeNotFound for unknown nodes.
+// /provision holds a nil nodeFinder when PuppetDB is not configured, and skips the active node check.
+type nodeFinder interface {
+	Node(certname string) (*puppetdb.Node, error)
+}
+
+// checkActiveNode looks in PuppetDB for an active node named hostname that has reported since the given time,
+// which suggests a new host is being given a hostname that is still in use. It returns a description of the node
+// found, or "" if there is none.
+func checkActiveNode(puppetDb nodeFinder, hostname string, since time.Time) (string, error) {
+	node, err := puppetDb.Node(hostname)
+	if err == puppetdb.ErrNodeNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if !node.ReportedSince(since) {
+		return "", nil
+	}
+	return fmt.Sprintf("%s is an active node in PuppetDB that last reported at %s", hostname, node.ReportTimestamp.Format(time.RFC3339)), nil
+}
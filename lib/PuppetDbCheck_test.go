@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetdb"
+)
+
+type mockNodeFinder struct {
+	nodes map[string]puppetdb.Node
+	facts map[string]interface{}
+	err   error
+}
+
+func (ctx mockNodeFinder) Node(certname string) (*puppetdb.Node, error) {
+	if ctx.err != nil {
+		return nil, ctx.err
+	}
+	node, found := ctx.nodes[certname]
+	if !found {
+		return nil, puppetdb.ErrNodeNotFound
+	}
+	return &node, nil
+}
+
+func (ctx mockNodeFinder) Facts(certname string) (map[string]interface{}, error) {
+	return ctx.facts, nil
+}
+
+func TestCheckActiveNode(t *testing.T) {
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	recently := now.Add(-time.Hour)
+	longAgo := now.Add(-72 * time.Hour)
+	puppetDb := mockNodeFinder{nodes: map[string]puppetdb.Node{
+		"active.bar.com":      {Certname: "active.bar.com", ReportTimestamp: &recently},
+		"quiet.bar.com":       {Certname: "quiet.bar.com", ReportTimestamp: &longAgo},
+		"deactivated.bar.com": {Certname: "deactivated.bar.com", ReportTimestamp: &recently, Deactivated: &recently},
+	}}
+	since := now.Add(-24 * time.Hour)
+
+	conflict, err := checkActiveNode(puppetDb, "active.bar.com", since)
+	if err != nil || conflict != "active.bar.com is an active node in PuppetDB that last reported at 2018-10-01T11:00:00Z" {
+		t.Errorf("Expected the active node to be found, got \"%s\", %v", conflict, err)
+	}
+	for _, hostname := range []string{"quiet.bar.com", "deactivated.bar.com", "new.bar.com"} {
+		if conflict, err := checkActiveNode(puppetDb, hostname, since); conflict != "" || err != nil {
+			t.Errorf("Expected no conflict for %s, got \"%s\", %v", hostname, conflict, err)
+		}
+	}
+
+	if _, err := checkActiveNode(mockNodeFinder{err: errors.New("connection refused")}, "active.bar.com", since); err == nil {
+		t.Error("Expected the PuppetDB error to be returned.")
+	}
+}
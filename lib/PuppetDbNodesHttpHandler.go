@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetdb"
+)
+
+// nodeLookup adds a node's facts to its status, both fetched from PuppetDB, so the handler can be tested without a
+// PuppetDB to query.
+type nodeLookup interface {
+	nodeFinder
+	Facts(certname string) (map[string]interface{}, error)
+}
+
+// PuppetDbNodesHttpHandler shows what PuppetDB knows about a node at /puppetdb/nodes/<hostname>.
+type PuppetDbNodesHttpHandler struct {
+	puppetDb nodeLookup
+	log      *log.Logger
+}
+
+type puppetDbNodeResponse struct {
+	puppetdb.Node
+	Facts map[string]interface{}
+}
+
+func NewPuppetDbNodesHttpHandler(puppetDb nodeLookup, log *log.Logger) *PuppetDbNodesHttpHandler {
+	return &PuppetDbNodesHttpHandler{puppetDb: puppetDb, log: log}
+}
+
+func (ctx PuppetDbNodesHttpHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		response.Write([]byte("This API accepts only HTTP GET method requests."))
+		return
+	}
+
+	hostname := strings.TrimPrefix(request.URL.Path, "/puppetdb/nodes/")
+	if hostname == "" || strings.Contains(hostname, "/") {
+		response.WriteHeader(http.StatusNotFound)
+		response.Write([]byte("Request a node as /puppetdb/nodes/<hostname>."))
+		return
+	}
+
+	node, err := ctx.puppetDb.Node(hostname)
+	if err == puppetdb.ErrNodeNotFound {
+		response.WriteHeader(http.StatusNotFound)
+		response.Write([]byte(fmt.Sprintf("PuppetDB has no information about %s.", hostname)))
+		return
+	}
+	var facts map[string]interface{}
+	if err == nil {
+		facts, err = ctx.puppetDb.Facts(hostname)
+	}
+	if err != nil {
+		ctx.log.Printf("PuppetDB lookup of %s failed: %s\n", hostname, err.Error())
+		response.WriteHeader(http.StatusBadGateway)
+		response.Write([]byte("PuppetDB could not be queried. More info in the log."))
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	jsonWriter := json.NewEncoder(response)
+	if err := jsonWriter.Encode(puppetDbNodeResponse{Node: *node, Facts: facts}); err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetdb"
+)
+
+func TestPuppetDbNodesHttpHandler_Get(t *testing.T) {
+	reported := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	sut := NewPuppetDbNodesHttpHandler(mockNodeFinder{
+		nodes: map[string]puppetdb.Node{"foo.bar.com": {Certname: "foo.bar.com", ReportTimestamp: &reported, LatestReportStatus: "changed"}},
+		facts: map[string]interface{}{"osfamily": "RedHat"},
+	}, log.New(&bytes.Buffer{}, "", 0))
+
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/puppetdb/nodes/foo.bar.com", nil))
+	if monitor.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, got %d", monitor.Code)
+	}
+	var node struct {
+		Certname           string
+		ReportTimestamp    time.Time
+		LatestReportStatus string
+		Facts              map[string]string
+	}
+	if err := json.Unmarshal(monitor.Body.Bytes(), &node); err != nil {
+		t.Fatal(err)
+	}
+	if node.Certname != "foo.bar.com" || !node.ReportTimestamp.Equal(reported) || node.LatestReportStatus != "changed" || node.Facts["osfamily"] != "RedHat" {
+		t.Errorf("Unexpected response %s", monitor.Body.String())
+	}
+
+	monitor = httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/puppetdb/nodes/baz.bar.com", nil))
+	if monitor.Code != http.StatusNotFound || monitor.Body.String() != "PuppetDB has no information about baz.bar.com." {
+		t.Errorf("Expected HTTP 404 for an unknown node, got %d: %s", monitor.Code, monitor.Body.String())
+	}
+}
+
+func TestPuppetDbNodesHttpHandler_Errors(t *testing.T) {
+	sut := NewPuppetDbNodesHttpHandler(mockNodeFinder{err: errors.New("connection refused")}, log.New(&bytes.Buffer{}, "", 0))
+
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/puppetdb/nodes/foo.bar.com", nil))
+	if monitor.Code != http.StatusBadGateway {
+		t.Errorf("Expected HTTP 502 when PuppetDB fails, got %d", monitor.Code)
+	}
+
+	monitor = httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodPost, "/puppetdb/nodes/foo.bar.com", nil))
+	if monitor.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected HTTP 405 for POST, got %d", monitor.Code)
+	}
+}
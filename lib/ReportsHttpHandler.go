@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Default for Reports FirstRunWithin.
+const defaultFirstRunWithin = 24 * time.Hour
+
+// ReportsConfig customizes the /reports endpoint.
+type ReportsConfig struct {
+	// How long after a /provision request the host's first report is still looked for. Default 24h.
+	FirstRunWithin time.Duration
+}
+
+// firstRunRecorder decides whether a report is a newly provisioned host's first run and, if it is, completes the
+// host's record with it. Taking only this keeps the reports API from changing records in any other way.
+type firstRunRecorder interface {
+	RecordFirstRun(hostname string, run FirstRun, within time.Duration) (ProvisioningRecord, bool)
+}
+
+// ReportsHttpHandler receives the reports Puppet's http report processor posts to /reports, and completes the
+// provisioning records of hosts reporting for the first time.
+type ReportsHttpHandler struct {
+	config  *ReportsConfig
+	records firstRunRecorder
+	notify  func(message string)
+	log     *log.Logger
+}
+
+// puppetReport holds the parts of a Puppet::Transaction::Report that are used. The report processor sends it as
+// YAML, or as JSON in recent puppet versions, with the same keys.
+type puppetReport struct {
+	Host             string                          `json:"host" yaml:"host"`
+	Status           string                          `json:"status" yaml:"status"`
+	Noop             bool                            `json:"noop" yaml:"noop"`
+	Metrics          map[string]puppetReportMetric   `json:"metrics" yaml:"metrics"`
+	ResourceStatuses map[string]puppetResourceStatus `json:"resource_statuses" yaml:"resource_statuses"`
+}
+
+// puppetReportMetric values are [name, label, value] triples.
+type puppetReportMetric struct {
+	Values [][]interface{} `json:"values" yaml:"values"`
+}
+
+type puppetResourceStatus struct {
+	Failed bool `json:"failed" yaml:"failed"`
+}
+
+func NewReportsHttpHandler(config *ReportsConfig, records firstRunRecorder, notify func(message string), log *log.Logger) *ReportsHttpHandler {
+	handler := ReportsHttpHandler{config: config, records: records, notify: notify, log: log}
+	if handler.config == nil {
+		handler.config = &ReportsConfig{}
+	}
+	if handler.config.FirstRunWithin == 0 {
+		handler.config.FirstRunWithin = defaultFirstRunWithin
+	}
+	return &handler
+}
+
+func (ctx ReportsHttpHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		response.Write([]byte("This API accepts only HTTP POST method requests."))
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, 64*1024*1024))
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var report puppetReport
+	if strings.Contains(request.Header.Get("Content-Type"), "json") {
+		err = json.Unmarshal(body, &report)
+	} else {
+		err = yaml.Unmarshal(body, &report)
+	}
+	if err != nil || report.Host == "" {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte("The request body is not a puppet report."))
+		return
+	}
+
+	// A noop run doesn't show whether the node's configuration can be applied.
+	if !report.Noop {
+		run := FirstRun{Reported: time.Now(), Status: report.Status, FailedResources: report.failedResources()}
+		if record, recorded := ctx.records.RecordFirstRun(report.Host, run, ctx.config.FirstRunWithin); recorded {
+			var info string
+			if record.State == ProvisioningComplete {
+				info = fmt.Sprintf("First puppet run on %s succeeded.", report.Host)
+			} else {
+				info = fmt.Sprintf("First puppet run on %s failed (%d failed resources).", report.Host, run.FailedResources)
+			}
+			ctx.log.Println(info)
+			ctx.notify(info)
+		}
+	}
+
+	response.WriteHeader(http.StatusOK)
+}
+
+// failedResources counts the report's failed resources, from its resources metric when it has one.
+func (report *puppetReport) failedResources() int {
+	if metric, found := report.Metrics["resources"]; found {
+		for _, value := range metric.Values {
+			if len(value) == 3 && value[0] == "failed" {
+				switch count := value[2].(type) {
+				case int:
+					return count
+				case float64:
+					return int(count)
+				}
+			}
+		}
+	}
+	failed := 0
+	for _, status := range report.ResourceStatuses {
+		if status.Failed {
+			failed++
+		}
+	}
+	return failed
+}
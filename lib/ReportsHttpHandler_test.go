@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An abridged report, as puppet 5's http report processor sends it.
+const testYamlReport = `--- !ruby/object:Puppet::Transaction::Report
+host: foo.bar.com
+time: 2018-10-01 12:00:00.123456789 -05:00
+configuration_version: 1538413200
+transaction_uuid: 6a3b6b1c-0a5e-4c4e-9f5e-2a0b6a6d1c2f
+report_format: 9
+puppet_version: 5.5.6
+status: failed
+noop: false
+environment: production
+metrics:
+  resources: !ruby/object:Puppet::Util::Metric
+    name: resources
+    label: Resources
+    values:
+    - - total
+      - Total
+      - 12
+    - - failed
+      - Failed
+      - 2
+resource_statuses:
+  Package[httpd]: !ruby/object:Puppet::Resource::Status
+    title: httpd
+    failed: true
+`
+
+const testJsonReport = `{"host": "baz.bar.com", "status": "changed", "noop": false,
+	"metrics": {"resources": {"name": "resources", "label": "Resources", "values": [["total", "Total", 12], ["failed", "Failed", 0]]}},
+	"resource_statuses": {"Package[httpd]": {"title": "httpd", "failed": false}}}`
+
+func reportsSutFactory() (*ReportsHttpHandler, *ProvisioningRecords, *[]string) {
+	records, _ := NewProvisioningRecords(nil, log.New(&bytes.Buffer{}, "", 0))
+	notifications := []string{}
+	sut := NewReportsHttpHandler(nil, records, func(message string) { notifications = append(notifications, message) }, log.New(&bytes.Buffer{}, "", 0))
+	return sut, records, &notifications
+}
+
+func postReport(sut *ReportsHttpHandler, contentType string, body string) *httptest.ResponseRecorder {
+	monitor := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/reports", strings.NewReader(body))
+	request.Header.Set("Content-Type", contentType)
+	sut.ServeHTTP(monitor, request)
+	return monitor
+}
+
+func TestReportsHttpHandler_Yaml(t *testing.T) {
+	sut, records, notifications := reportsSutFactory()
+	records.Start("foo.bar.com", "", []string{"cert-sign"})
+	records.AwaitCsr("foo.bar.com")
+
+	if monitor := postReport(sut, "application/x-yaml", testYamlReport); monitor.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, got %d: %s", monitor.Code, monitor.Body.String())
+	}
+	record, _ := records.Get("foo.bar.com")
+	if record.State != ProvisioningFailed || record.FirstRun == nil || record.FirstRun.FailedResources != 2 || record.FirstRun.Status != "failed" {
+		t.Errorf("Expected a failed provisioning record, got %+v", record)
+	}
+	if len(*notifications) != 1 || (*notifications)[0] != "First puppet run on foo.bar.com failed (2 failed resources)." {
+		t.Errorf("Unexpected notifications %v", *notifications)
+	}
+
+	// Later runs are not first runs.
+	postReport(sut, "application/x-yaml", testYamlReport)
+	if len(*notifications) != 1 {
+		t.Errorf("Expected no notification for a later run, got %v", *notifications)
+	}
+}
+
+func TestReportsHttpHandler_Json(t *testing.T) {
+	sut, records, notifications := reportsSutFactory()
+	records.Start("baz.bar.com", "", []string{"cert-sign"})
+	records.AwaitCsr("baz.bar.com")
+
+	if monitor := postReport(sut, "application/json", testJsonReport); monitor.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, got %d: %s", monitor.Code, monitor.Body.String())
+	}
+	record, _ := records.Get("baz.bar.com")
+	if record.State != ProvisioningComplete || record.FirstRun.Reported.IsZero() || time.Since(record.FirstRun.Reported) > time.Minute {
+		t.Errorf("Expected a complete provisioning record, got %+v", record)
+	}
+	if len(*notifications) != 1 || (*notifications)[0] != "First puppet run on baz.bar.com succeeded." {
+		t.Errorf("Unexpected notifications %v", *notifications)
+	}
+}
+
+func TestReportsHttpHandler_Ignores(t *testing.T) {
+	sut, records, notifications := reportsSutFactory()
+	records.Start("baz.bar.com", "", []string{"cert-sign"})
+	records.AwaitCsr("baz.bar.com")
+
+	noop := strings.Replace(testJsonReport, `"noop": false`, `"noop": true`, 1)
+	postReport(sut, "application/json", noop)
+	if record, _ := records.Get("baz.bar.com"); record.State != ProvisioningAwaitingCsr {
+		t.Errorf("A noop run was recorded as the first run: %+v", record)
+	}
+	// Hosts that weren't provisioned report all the time.
+	postReport(sut, "application/x-yaml", testYamlReport)
+	if len(*notifications) != 0 {
+		t.Errorf("Unexpected notifications %v", *notifications)
+	}
+
+	if monitor := postReport(sut, "application/json", `{"status": "changed"}`); monitor.Code != http.StatusBadRequest {
+		t.Errorf("Expected HTTP 400 for a report without a host, got %d", monitor.Code)
+	}
+}
@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BuiltinTaskConfig customizes one of the tasks handled by the provisioner itself: cert-sign, cert-revoke or
+// deprovision.
+type BuiltinTaskConfig struct {
+	// Tasks that must succeed before this one starts, when they are requested with it.
+	DependsOn []string
+}
+
+// configuredDependencies collects the DependsOn lists of the GenericExecTasks and built-in tasks, by task name.
+func configuredDependencies(appConfig *AppConfig) map[string][]string {
+	dependencies := map[string][]string{}
+	for _, task := range appConfig.GenericExecTasks {
+		if len(task.DependsOn) > 0 {
+			dependencies[task.Name] = task.DependsOn
+		}
+	}
+	for name, task := range appConfig.BuiltinTasks {
+		if task != nil && len(task.DependsOn) > 0 {
+			dependencies[name] = task.DependsOn
+		}
+	}
+	return dependencies
+}
+
+// prerequisiteGraph returns the prerequisites of each of tasks: those of its dependencies, from any of the
+// dependency maps, that are among tasks. Dependencies on tasks that were not requested are ignored. It returns an
+// error if the prerequisites form a cycle.
+func prerequisiteGraph(tasks []string, dependencies ...map[string][]string) (map[string][]string, error) {
+	requested := make(map[string]bool, len(tasks))
+	for _, task := range tasks {
+		requested[task] = true
+	}
+	graph := make(map[string][]string, len(tasks))
+	for _, task := range tasks {
+		var prerequisites []string
+		for _, dependencyMap := range dependencies {
+			for _, prerequisite := range dependencyMap[task] {
+				if requested[prerequisite] && prerequisite != task && !containsString(prerequisites, prerequisite) {
+					prerequisites = append(prerequisites, prerequisite)
+				}
+			}
+		}
+		sort.Strings(prerequisites)
+		graph[task] = prerequisites
+	}
+
+	// Depth-first search for a task that is its own prerequisite, remembering the path to report it.
+	const visiting, visited = 1, 2
+	state := make(map[string]int, len(tasks))
+	var path []string
+	var visit func(task string) error
+	visit = func(task string) error {
+		switch state[task] {
+		case visited:
+			return nil
+		case visiting:
+			for i, onPath := range path {
+				if onPath == task {
+					return fmt.Errorf("Task dependencies form a cycle: %s, %s.", strings.Join(path[i:], ", "), task)
+				}
+			}
+		}
+		state[task] = visiting
+		path = append(path, task)
+		for _, prerequisite := range graph[task] {
+			if err := visit(prerequisite); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[task] = visited
+		return nil
+	}
+	sorted := append([]string{}, tasks...)
+	sort.Strings(sorted)
+	for _, task := range sorted {
+		if err := visit(task); err != nil {
+			return nil, err
+		}
+	}
+	return graph, nil
+}
+
+// taskCompletion tracks the results of one of a request's tasks, which may report more than one, as with the
+// deprovisioning steps.
+type taskCompletion struct {
+	names   []string
+	results map[string]TaskResult
+	// Set once the task is started, or settled without being run.
+	started bool
+	// Closed once every result is in.
+	done chan struct{}
+	// Why the task did not succeed, such as "failed", or "" if it did.
+	failure string
+}
+
+// taskCompletions tracks the completion of each of a request's tasks, so that tasks can wait on their
+// prerequisites and the response on the tasks it waits for.
+type taskCompletions struct {
+	byTask   map[string]*taskCompletion
+	byResult map[string]*taskCompletion
+	lock     sync.Mutex
+}
+
+// newTaskCompletions tracks tasks, which report results under the names resultNames gives.
+func newTaskCompletions(tasks []string, resultNames func(task string) []string) *taskCompletions {
+	completions := taskCompletions{
+		byTask:   make(map[string]*taskCompletion, len(tasks)),
+		byResult: make(map[string]*taskCompletion, len(tasks)),
+	}
+	for _, task := range tasks {
+		completion := taskCompletion{
+			names:   resultNames(task),
+			results: map[string]TaskResult{},
+			done:    make(chan struct{}),
+		}
+		completions.byTask[task] = &completion
+		for _, name := range completion.names {
+			completions.byResult[name] = &completion
+		}
+	}
+	return &completions
+}
+
+// begin marks task started, and returns false if it already was.
+func (ctx *taskCompletions) begin(task string) bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	completion := ctx.byTask[task]
+	if completion.started {
+		return false
+	}
+	completion.started = true
+	return true
+}
+
+// completed adds a result, completing its task once all the task's results are in. Incomplete results and those of
+// tasks that are not tracked are ignored.
+func (ctx *taskCompletions) completed(name string, result TaskResult) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	completion, found := ctx.byResult[name]
+	if !found || !result.Complete || len(completion.results) == len(completion.names) {
+		return
+	}
+	completion.results[name] = result
+	if !result.Success && completion.failure == "" {
+		completion.failure = "failed"
+		if result.Skipped {
+			completion.failure = "was skipped"
+		}
+	}
+	if len(completion.results) == len(completion.names) {
+		close(completion.done)
+	}
+}
+
+// await waits for task to complete, and returns why it did not succeed, or "" if it did.
+func (ctx *taskCompletions) await(task string) string {
+	completion := ctx.byTask[task]
+	<-completion.done
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return completion.failure
+}
+
+// done returns a channel that is closed once task is complete.
+func (ctx *taskCompletions) done(task string) <-chan struct{} {
+	return ctx.byTask[task].done
+}
+
+// results returns the results task reported.
+func (ctx *taskCompletions) results(task string) map[string]TaskResult {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	results := make(map[string]TaskResult, len(ctx.byTask[task].results))
+	for name, result := range ctx.byTask[task].results {
+		results[name] = result
+	}
+	return results
+}
+
+// names returns the names task reports results under.
+func (ctx *taskCompletions) names(task string) []string {
+	return ctx.byTask[task].names
+}
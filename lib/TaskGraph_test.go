@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrerequisiteGraph(t *testing.T) {
+	configured := map[string][]string{"cert-sign": {"environment", "dns"}, "environment": {"ldap"}}
+	requested := map[string][]string{"report": {"cert-sign"}}
+
+	graph, err := prerequisiteGraph([]string{"cert-sign", "environment", "report"}, configured, requested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string][]string{"cert-sign": {"environment"}, "environment": nil, "report": {"cert-sign"}}
+	if !reflect.DeepEqual(graph, expect) {
+		t.Errorf("Expected prerequisites %v, got %v", expect, graph)
+	}
+
+	_, err = prerequisiteGraph([]string{"cert-sign", "environment"}, configured, map[string][]string{"environment": {"cert-sign"}})
+	if err == nil || err.Error() != "Task dependencies form a cycle: cert-sign, environment, cert-sign." {
+		t.Errorf("Expected a cycle to be reported, got %v", err)
+	}
+}
+
+func newTaskGraphTestSut(t *testing.T, tasks []string, prerequisites map[string][]string) (ProvisionHttpHandler, *provisioning) {
+	jobs := NewProvisionJobs()
+	records, _ := NewProvisioningRecords(nil, log.New(&bytes.Buffer{}, "", 0))
+	id, _ := jobs.Start("foo.bar.com", tasks)
+	records.Start("foo.bar.com", "", tasks)
+	started := &provisioning{
+		request:       &provisionRequest{hostname: "foo.bar.com", tasks: tasks},
+		job:           ProvisionJob{Id: id, Hostname: "foo.bar.com"},
+		prerequisites: prerequisites,
+		completions:   newTaskCompletions(tasks, func(task string) []string { return []string{task} }),
+	}
+	return ProvisionHttpHandler{jobs: jobs, records: records}, started
+}
+
+func awaitTask(t *testing.T, started *provisioning, task string) TaskResult {
+	select {
+	case <-started.completions.done(task):
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s did not complete", task)
+	}
+	return started.completions.results(task)[task]
+}
+
+func TestProvisionHttpHandler_run(t *testing.T) {
+	tasks := []string{"cert-sign", "dns", "environment", "report"}
+	sut, started := newTaskGraphTestSut(t, tasks, map[string][]string{
+		"cert-sign": {"environment"},
+		"report":    {"cert-sign", "dns"},
+	})
+
+	var launched []string
+	var launchedLock sync.Mutex
+	launcher := func(task string, success bool) func() error {
+		return func() error {
+			launchedLock.Lock()
+			launched = append(launched, task)
+			launchedLock.Unlock()
+			go sut.recordTaskResult(started, task, TaskResult{Complete: true, Success: success, Message: task + " ran"})
+			return nil
+		}
+	}
+	sut.run(started, "environment", launcher("environment", true))
+	sut.run(started, "cert-sign", launcher("cert-sign", true))
+	sut.run(started, "dns", launcher("dns", false))
+	sut.run(started, "report", launcher("report", true))
+
+	if result := awaitTask(t, started, "cert-sign"); !result.Success || result.Message != "cert-sign ran" {
+		t.Errorf("Expected cert-sign to run after environment, got %+v", result)
+	}
+	result := awaitTask(t, started, "report")
+	if result.Success || !result.Skipped || result.Message != "Skipped because dns failed." {
+		t.Errorf("Expected report to be skipped, got %+v", result)
+	}
+	launchedLock.Lock()
+	if len(launched) != 3 || launched[0] != "environment" || containsString(launched, "report") {
+		t.Errorf("Unexpected launches %v", launched)
+	}
+	launchedLock.Unlock()
+	if job, _ := sut.jobs.Get(started.job.Id); !job.Complete || job.Tasks["report"] != result {
+		t.Errorf("Expected the skipped task in the job, got %+v", job)
+	}
+	if record, _ := sut.records.Get("foo.bar.com"); record.State != ProvisioningFailed {
+		t.Errorf("Expected the provisioning record to fail, got %s", record.State)
+	}
+}
+
+func TestProvisionHttpHandler_run_QueueFull(t *testing.T) {
+	tasks := []string{"cert-sign", "environment", "report"}
+	sut, started := newTaskGraphTestSut(t, tasks, map[string][]string{"report": {"environment"}})
+	queueFull := errors.New("The certificate signing queue is full.")
+
+	if err := sut.run(started, "cert-sign", func() error { return queueFull }); err != queueFull {
+		t.Fatalf("Expected the launch error, got %v", err)
+	}
+	sut.run(started, "report", func() error {
+		t.Error("report was started although the request was turned away")
+		return nil
+	})
+	sut.queueFull(started, "")
+
+	if result := awaitTask(t, started, "cert-sign"); result.Skipped || result.Message != queueFull.Error() {
+		t.Errorf("Expected cert-sign to fail, got %+v", result)
+	}
+	for _, task := range []string{"environment", "report"} {
+		if result := awaitTask(t, started, task); !result.Skipped || result.Success {
+			t.Errorf("Expected %s not to be started, got %+v", task, result)
+		}
+	}
+}
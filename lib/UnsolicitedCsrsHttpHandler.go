@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
+)
+
+// unsolicitedCsrLister lists the CSRs the CertSigner is tracking as unsolicited. Tests list a fixed set through it,
+// since getting the CertSigner to track one takes a CSR arriving on a running signer.
+type unsolicitedCsrLister interface {
+	UnsolicitedCsrs() []certsign.UnsolicitedCsr
+}
+
+// UnsolicitedCsrsHttpHandler lists CSRs that arrived without an authorization or matching policy at /unsolicited-csrs.
+type UnsolicitedCsrsHttpHandler struct {
+	lister unsolicitedCsrLister
+}
+
+func NewUnsolicitedCsrsHttpHandler(lister unsolicitedCsrLister) *UnsolicitedCsrsHttpHandler {
+	return &UnsolicitedCsrsHttpHandler{lister: lister}
+}
+
+func (ctx UnsolicitedCsrsHttpHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		response.Write([]byte("This API accepts only HTTP GET method requests."))
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	jsonWriter := json.NewEncoder(response)
+	if err := jsonWriter.Encode(ctx.lister.UnsolicitedCsrs()); err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/certsign"
+)
+
+type mockUnsolicitedCsrLister []certsign.UnsolicitedCsr
+
+func (ctx mockUnsolicitedCsrLister) UnsolicitedCsrs() []certsign.UnsolicitedCsr {
+	return ctx
+}
+
+func TestUnsolicitedCsrsHttpHandler(t *testing.T) {
+	seen := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	sut := NewUnsolicitedCsrsHttpHandler(mockUnsolicitedCsrLister{{Subject: "rogue.bar.com", FirstSeen: seen, LastSeen: seen}})
+
+	monitor := httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodGet, "/unsolicited-csrs", nil))
+	if monitor.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, got %d", monitor.Code)
+	}
+	var listing []certsign.UnsolicitedCsr
+	if err := json.Unmarshal(monitor.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 1 || listing[0].Subject != "rogue.bar.com" || !listing[0].FirstSeen.Equal(seen) {
+		t.Errorf("Unexpected listing %s", monitor.Body.String())
+	}
+
+	monitor = httptest.NewRecorder()
+	sut.ServeHTTP(monitor, httptest.NewRequest(http.MethodDelete, "/unsolicited-csrs", nil))
+	if monitor.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected HTTP 405, got %d", monitor.Code)
+	}
+}
@@ -0,0 +1,39 @@
+// Package atomicfile replaces files so that readers, and the file left behind by a crash, only ever see the old or
+// the new contents in full.
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile replaces the contents of the file at path with data, creating the file with the given permissions and
+// any missing parent directories private to the service. The data is written to a temporary file beside path,
+// synced to disk and then renamed over path.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(dir, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Chmod(perm)
+	}
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
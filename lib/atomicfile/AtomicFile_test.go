@@ -0,0 +1,42 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spp-atomicfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a", "b", "file.json")
+
+	for _, contents := range []string{"first", "second"} {
+		if err := WriteFile(path, []byte(contents), 0640); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil || string(data) != contents {
+			t.Errorf("Expected %q, got %q (%v)", contents, data, err)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640, got %v", info.Mode().Perm())
+	}
+	parent, _ := os.Stat(filepath.Dir(path))
+	if parent.Mode().Perm() != 0700 {
+		t.Errorf("Expected new directories to be private, got %v", parent.Mode().Perm())
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Expected no temporary files to be left behind, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,53 @@
+package certsign
+
+import (
+	"encoding/json"
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/atomicfile"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// authorizationStore keeps pending authorizations in a JSON file, so they survive a restart of the service.
+type authorizationStore struct {
+	path string
+}
+
+// storedAuthorization is the durable form of a pendingAuthorization. Its result channel can't be saved; the
+// caller waiting on it will have gone away with the process anyway.
+type storedAuthorization struct {
+	Subject            string
+	Created            time.Time
+	Expires            time.Time
+	RequestedBy        string
+	ExpectedAttributes *CsrAttributes
+	DnsAltNames        []string `json:",omitempty"`
+	Autosigned         bool     `json:",omitempty"`
+	StaleCert          string   `json:",omitempty"`
+}
+
+func (ctx *authorizationStore) load() ([]storedAuthorization, error) {
+	data, err := ioutil.ReadFile(ctx.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []storedAuthorization
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// save replaces the file's contents with records.
+func (ctx *authorizationStore) save(records []storedAuthorization) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Expected attributes include challenge passwords, so the file is private to the service.
+	return atomicfile.WriteFile(ctx.path, data, 0600)
+}
@@ -0,0 +1,187 @@
+package certsign
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
+)
+
+func TestAuthorizationStore_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spp-authorizations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sut := authorizationStore{path: filepath.Join(dir, "state", "authorizations.json")}
+	records, err := sut.load()
+	if err != nil || len(records) != 0 {
+		t.Fatalf("Expected nothing loaded from a nonexistent store, got %v, %v", records, err)
+	}
+
+	created := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	saved := []storedAuthorization{{
+		Subject:            "foo.bar.com",
+		Created:            created,
+		Expires:            created.Add(time.Hour),
+		RequestedBy:        "jdoe",
+		ExpectedAttributes: &CsrAttributes{ChallengePassword: "s3cret"},
+		Autosigned:         true,
+		StaleCert:          "abc123",
+	}}
+	if err := sut.save(saved); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(sut.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the store to be private, got mode %s", info.Mode())
+	}
+
+	records, err = sut.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Subject != "foo.bar.com" || records[0].RequestedBy != "jdoe" ||
+		!records[0].Expires.Equal(created.Add(time.Hour)) || records[0].ExpectedAttributes.ChallengePassword != "s3cret" ||
+		!records[0].Autosigned || records[0].StaleCert != "abc123" {
+		t.Errorf("Loaded records %+v do not match those saved", records)
+	}
+}
+
+func TestCertSigner_RestoresPersistedAuthorizations(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	storePath := filepath.Join(cfg.SslDir, "authorizations.json")
+	certSignerConfig := CertSignerConfig{Backend: "native", AuthorizationStore: storePath}
+
+	newWatcher := func() *interfaces.FsnotifyWatcher {
+		return &interfaces.FsnotifyWatcher{
+			Add:    func(name string) error { return nil },
+			Close:  func() error { return nil },
+			Events: make(chan fsnotify.Event),
+			Errors: make(chan error),
+		}
+	}
+
+	// Authorize two hosts, then stop before either CSR arrives.
+	first, err := NewCertSigner(*cfg, certSignerConfig, log.New(&bytes.Buffer{}, "", 0), newWatcher(), func(message string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.SignWithOptions("foo.bar.com", false, SignOptions{RequestedBy: "jdoe", ExpectedAttributes: &CsrAttributes{ChallengePassword: "s3cret"}})
+	first.SignWithOptions("baz.bar.com", false, SignOptions{})
+	first.Shutdown()
+
+	// One CSR arrives while nothing is watching.
+	ioutil.WriteFile(filepath.Join(cfg.CsrDir, "foo.bar.com.pem"), testCsrPem(t, "foo.bar.com", "s3cret", nil), 0644)
+
+	signed := make(chan struct{}, 1)
+	var logBuf bytes.Buffer
+	second, err := NewCertSigner(*cfg, certSignerConfig, log.New(&logBuf, "", 0), newWatcher(), func(message string) {
+		if message == "Certificate for \"foo.bar.com\" has been signed." {
+			signed <- struct{}{}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-signed:
+		second.Shutdown()
+	case <-time.After(10 * time.Second):
+		second.Shutdown()
+		t.Fatalf("Restored authorization was not signed. Log:\n%s", logBuf.String())
+	}
+	if !strings.Contains(logBuf.String(), "Restored 2 pending certificate signing authorization(s)") {
+		t.Errorf("Expected log of restored authorizations, got:\n%s", logBuf.String())
+	}
+
+	pending := second.PendingAuthorizations()
+	if len(pending) != 1 || pending[0].Subject != "baz.bar.com" {
+		t.Errorf("Expected only baz.bar.com to remain pending, got %+v", pending)
+	}
+	records, _ := second.store.load()
+	if len(records) != 1 || records[0].Subject != "baz.bar.com" {
+		t.Errorf("Expected the store to hold only baz.bar.com, got %+v", records)
+	}
+}
+
+func TestCertSigner_ExpiresStaleRestoredAuthorizations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spp-authorizations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storePath := filepath.Join(dir, "authorizations.json")
+	store := authorizationStore{path: storePath}
+	store.save([]storedAuthorization{{Subject: "foo.bar.com", Created: time.Now().Add(-48 * time.Hour), Expires: time.Now().Add(-24 * time.Hour)}})
+
+	var notifications []string
+	sut, err, _ := sutFactory(nil, func(message string) { notifications = append(notifications, message) }, nil)
+	if err != nil {
+		t.FailNow()
+	}
+	sut.Shutdown()
+
+	// sutFactory doesn't take a CertSignerConfig, so restore into its CertSigner directly.
+	sut.store = &store
+	sut.restoreAuthorizations()
+
+	expect := "Authorization to sign a certificate for \"foo.bar.com\" expired before a matching CSR arrived."
+	if len(notifications) != 1 || notifications[0] != expect {
+		t.Errorf("Expected notification \"%s\", got %v", expect, notifications)
+	}
+	if len(sut.PendingAuthorizations()) != 0 {
+		t.Error("Stale restored authorization is still pending.")
+	}
+}
+
+func TestCertSigner_ResumesRestoredAutosignedAuthorizations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spp-authorizations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := authorizationStore{path: filepath.Join(dir, "authorizations.json")}
+	store.save([]storedAuthorization{{Subject: "foo.bar.com", Created: time.Now(), Autosigned: true, StaleCert: "stale"}})
+
+	signed := make(chan struct{}, 1)
+	sut, err, _ := sutFactory(nil, func(message string) {
+		if message == "Certificate for \"foo.bar.com\" has been signed." {
+			signed <- struct{}{}
+		}
+	}, nil)
+	if err != nil {
+		t.FailNow()
+	}
+	defer sut.Shutdown()
+	// The CA signed the certificate while the service was down.
+	sut.openFileFunc = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return os.Open(os.DevNull)
+	}
+
+	sut.store = &store
+	sut.restoreAuthorizations()
+	sut.reconcileAuthorizations()
+
+	select {
+	case <-signed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The restored autosigned authorization was not completed by the CA's certificate.")
+	}
+	if len(sut.PendingAuthorizations()) != 0 {
+		t.Error("Autosigned authorization is still pending.")
+	}
+}
@@ -0,0 +1,221 @@
+package certsign
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// pendingAuthorization is a subject that has been authorized for signing, waiting on its CSR.
+type pendingAuthorization struct {
+	options    SignOptions
+	resultChan chan<- SigningResult
+	created    time.Time
+	expires    time.Time // Zero if the authorization never expires.
+	autosigned bool      // Approved by AutosignCheck, so the CA will sign it.
+	staleCert  string    // Fingerprint of the certificate the subject had when autosigning was approved.
+}
+
+// PendingAuthorization describes a subject that is authorized for signing but has not been signed yet.
+type PendingAuthorization struct {
+	Subject     string
+	Created     time.Time
+	Expires     *time.Time
+	RequestedBy string
+	// Names of the CSR attributes the authorization is constrained by. Their values are not disclosed.
+	ExpectedAttributes []string
+	DnsAltNames        []string
+}
+
+func (ctx *pendingAuthorization) expired(now time.Time) bool {
+	return !ctx.expires.IsZero() && now.After(ctx.expires)
+}
+
+// PendingAuthorizations lists the current authorizations, ordered by subject.
+func (ctx *CertSigner) PendingAuthorizations() []PendingAuthorization {
+	ctx.authorizationsLock.Lock()
+	defer ctx.authorizationsLock.Unlock()
+
+	authorizations := make([]PendingAuthorization, 0, len(*ctx.authorizedCertSubjects))
+	for subject, authorization := range *ctx.authorizedCertSubjects {
+		listing := PendingAuthorization{
+			Subject:            subject,
+			Created:            authorization.created,
+			RequestedBy:        authorization.options.RequestedBy,
+			ExpectedAttributes: authorization.options.ExpectedAttributes.Names(),
+			DnsAltNames:        authorization.options.DnsAltNames,
+		}
+		if !authorization.expires.IsZero() {
+			expires := authorization.expires
+			listing.Expires = &expires
+		}
+		authorizations = append(authorizations, listing)
+	}
+	sort.Slice(authorizations, func(i, j int) bool { return authorizations[i].Subject < authorizations[j].Subject })
+	return authorizations
+}
+
+// CancelAuthorization withdraws the pending authorization for certSubject, reporting whether there was one.
+func (ctx *CertSigner) CancelAuthorization(certSubject string) bool {
+	resultChan := ctx.takeAuthorization(certSubject)
+	if resultChan == nil {
+		return false
+	}
+	ctx.authorizationWithdrawn(certSubject, resultChan, fmt.Sprintf("Authorization to sign a certificate for \"%s\" was cancelled.", certSubject))
+	return true
+}
+
+// authorize records the subject of message as authorized for signing whenever its CSR turns up.
+func (ctx *CertSigner) authorize(message signChanMessage) {
+	now := ctx.now()
+	ttl := message.options.Ttl
+	if ttl == 0 {
+		ttl = ctx.defaultAuthorizationTtl
+	}
+	authorization := &pendingAuthorization{options: message.options, resultChan: message.resultChan, created: now}
+	if ttl > 0 {
+		authorization.expires = now.Add(ttl)
+	}
+
+	ctx.authorizationsLock.Lock()
+	superseded, present := (*ctx.authorizedCertSubjects)[message.certSubject]
+	(*ctx.authorizedCertSubjects)[message.certSubject] = authorization
+	ctx.persistAuthorizations()
+	ctx.authorizationsLock.Unlock()
+
+	ctx.forgetUnsolicitedCsr(message.certSubject)
+
+	if present {
+		ctx.authorizationWithdrawn(message.certSubject, superseded.resultChan, fmt.Sprintf("Authorization to sign a certificate for \"%s\" was superseded by a newer request.", message.certSubject))
+	}
+}
+
+func (ctx *CertSigner) authorization(certSubject string) (*pendingAuthorization, bool) {
+	ctx.authorizationsLock.Lock()
+	defer ctx.authorizationsLock.Unlock()
+	authorization, present := (*ctx.authorizedCertSubjects)[certSubject]
+	return authorization, present
+}
+
+// takeAuthorization removes the authorization for certSubject, returning its result channel, or nil if there was
+// none. Whoever takes the authorization is responsible for sending its final result and closing the channel.
+func (ctx *CertSigner) takeAuthorization(certSubject string) chan<- SigningResult {
+	ctx.authorizationsLock.Lock()
+	defer ctx.authorizationsLock.Unlock()
+	authorization, present := (*ctx.authorizedCertSubjects)[certSubject]
+	if !present {
+		return nil
+	}
+	delete(*ctx.authorizedCertSubjects, certSubject)
+	ctx.persistAuthorizations()
+	return authorization.resultChan
+}
+
+func (ctx *CertSigner) reapExpiredAuthorizations() {
+	now := ctx.now()
+	expired := map[string]chan<- SigningResult{}
+
+	ctx.authorizationsLock.Lock()
+	for subject, authorization := range *ctx.authorizedCertSubjects {
+		if authorization.expired(now) {
+			expired[subject] = authorization.resultChan
+			delete(*ctx.authorizedCertSubjects, subject)
+		}
+	}
+	if len(expired) > 0 {
+		ctx.persistAuthorizations()
+	}
+	ctx.authorizationsLock.Unlock()
+
+	for subject, resultChan := range expired {
+		ctx.authorizationWithdrawn(subject, resultChan, fmt.Sprintf("Authorization to sign a certificate for \"%s\" expired before a matching CSR arrived.", subject))
+	}
+}
+
+// persistAuthorizations writes the current authorizations to the store, if there is one. The caller must hold
+// authorizationsLock, which keeps writes in the same order as the changes they record.
+func (ctx *CertSigner) persistAuthorizations() {
+	if ctx.store == nil {
+		return
+	}
+	records := make([]storedAuthorization, 0, len(*ctx.authorizedCertSubjects))
+	for subject, authorization := range *ctx.authorizedCertSubjects {
+		records = append(records, storedAuthorization{
+			Subject:            subject,
+			Created:            authorization.created,
+			Expires:            authorization.expires,
+			RequestedBy:        authorization.options.RequestedBy,
+			ExpectedAttributes: authorization.options.ExpectedAttributes,
+			DnsAltNames:        authorization.options.DnsAltNames,
+			Autosigned:         authorization.autosigned,
+			StaleCert:          authorization.staleCert,
+		})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Subject < records[j].Subject })
+	if err := ctx.store.save(records); err != nil {
+		ctx.log.Printf("Unable to save pending authorizations to %s: %s\n", ctx.store.path, err.Error())
+	}
+}
+
+// restoreAuthorizations reloads the authorizations that were pending when the service last stopped. Nobody is
+// waiting on their results anymore, but they are still signed, and notified about, when their CSRs arrive.
+func (ctx *CertSigner) restoreAuthorizations() {
+	records, err := ctx.store.load()
+	if err != nil {
+		ctx.log.Printf("Unable to load pending authorizations from %s: %s\n", ctx.store.path, err.Error())
+		return
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	ctx.authorizationsLock.Lock()
+	for _, record := range records {
+		(*ctx.authorizedCertSubjects)[record.Subject] = &pendingAuthorization{
+			options:    SignOptions{ExpectedAttributes: record.ExpectedAttributes, RequestedBy: record.RequestedBy, DnsAltNames: record.DnsAltNames},
+			created:    record.Created,
+			expires:    record.Expires,
+			autosigned: record.Autosigned,
+			staleCert:  record.StaleCert,
+		}
+	}
+	ctx.authorizationsLock.Unlock()
+	ctx.log.Printf("Restored %d pending certificate signing authorization(s) from %s\n", len(records), ctx.store.path)
+
+	// Those that went stale while the service was down are expired right away.
+	ctx.reapExpiredAuthorizations()
+}
+
+// reconcileAuthorizations queues up the pending authorizations whose CSRs arrived while the service was not
+// running to watch for them, and resumes watching for the certificates the CA was approved to autosign.
+func (ctx *CertSigner) reconcileAuthorizations() {
+	ctx.authorizationsLock.Lock()
+	for subject, authorization := range *ctx.authorizedCertSubjects {
+		if authorization.autosigned {
+			go ctx.awaitAutosign(subject, authorization, authorization.staleCert)
+		}
+	}
+	ctx.authorizationsLock.Unlock()
+
+	if _, remote := ctx.backend.(csrFetcher); remote {
+		// The CA API poller reports every CSR pending on the CA when it starts.
+		return
+	}
+	for _, authorization := range ctx.PendingAuthorizations() {
+		if _, err := os.Stat(filepath.Join(ctx.puppetConfig.CsrDir, authorization.Subject+".pem")); err == nil {
+			ctx.log.Printf("Found a CSR for %s, which has a pending authorization.\n", authorization.Subject)
+			ctx.queueCsr(authorization.Subject)
+		}
+	}
+}
+
+func (ctx *CertSigner) authorizationWithdrawn(certSubject string, resultChan chan<- SigningResult, info string) {
+	ctx.notify(info)
+	ctx.log.Println(info)
+	if resultChan != nil {
+		resultChan <- SigningResult{Action: "sign", Success: false, Message: info}
+		close(resultChan)
+	}
+}
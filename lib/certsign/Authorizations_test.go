@@ -0,0 +1,117 @@
+package certsign
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// deferredSutFactory gives a CertSigner whose backend reports that no CSR exists yet, and a channel that is
+// signalled once an authorization has been deferred waiting on its CSR.
+func deferredSutFactory(t *testing.T, now time.Time) (*CertSigner, <-chan struct{}, *[]string) {
+	var notifications []string
+	deferred := make(chan struct{}, 5)
+	sut, err, _ := sutFactory(nil, func(message string) {
+		notifications = append(notifications, message)
+		if message == "Certificate for \"foo.bar.com\" will be signed when a matching CSR arrives." {
+			deferred <- struct{}{}
+		}
+	}, []string{"TestHelperPuppetSignNoCsr"})
+	if err != nil {
+		t.FailNow()
+	}
+	sut.openFileFunc = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return nil, errors.New("simulated error")
+	}
+	sut.now = func() time.Time { return now }
+	return sut, deferred, &notifications
+}
+
+func TestCertSigner_PendingAuthorizations(t *testing.T) {
+	created := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	sut, deferred, _ := deferredSutFactory(t, created)
+	defer sut.Shutdown()
+
+	sut.SignWithOptions("foo.bar.com", false, SignOptions{
+		ExpectedAttributes: &CsrAttributes{ChallengePassword: "s3cret", Extensions: map[string]string{"pp_uuid": "1234"}},
+		Ttl:                time.Hour,
+	})
+	<-deferred
+
+	authorizations := sut.PendingAuthorizations()
+	if len(authorizations) != 1 {
+		t.Fatalf("Expected 1 pending authorization, got %d", len(authorizations))
+	}
+	authorization := authorizations[0]
+	if authorization.Subject != "foo.bar.com" || !authorization.Created.Equal(created) {
+		t.Errorf("Unexpected pending authorization %+v", authorization)
+	}
+	if authorization.Expires == nil || !authorization.Expires.Equal(created.Add(time.Hour)) {
+		t.Errorf("Expected authorization to expire at %s, got %v", created.Add(time.Hour), authorization.Expires)
+	}
+	if len(authorization.ExpectedAttributes) != 2 || authorization.ExpectedAttributes[0] != "challenge-password" || authorization.ExpectedAttributes[1] != "pp_uuid" {
+		t.Errorf("Unexpected ExpectedAttributes %v", authorization.ExpectedAttributes)
+	}
+}
+
+func TestCertSigner_ReapExpiredAuthorizations(t *testing.T) {
+	created := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	sut, deferred, notifications := deferredSutFactory(t, created)
+	defer sut.Shutdown()
+
+	resultChan := sut.Sign("foo.bar.com", false)
+	<-deferred
+
+	// Not stale yet; the default TTL is a day.
+	sut.now = func() time.Time { return created.Add(23 * time.Hour) }
+	sut.reapExpiredAuthorizations()
+	if len(sut.PendingAuthorizations()) != 1 {
+		t.Fatal("Authorization was reaped before it expired.")
+	}
+
+	sut.now = func() time.Time { return created.Add(25 * time.Hour) }
+	sut.reapExpiredAuthorizations()
+
+	result, open := <-resultChan
+	expect := "Authorization to sign a certificate for \"foo.bar.com\" expired before a matching CSR arrived."
+	if !open || result.Success || result.Message != expect {
+		t.Errorf("Expected failed signing result \"%s\", got %+v", expect, result)
+	}
+	if _, open := <-resultChan; open {
+		t.Error("Result channel was not closed after the authorization expired.")
+	}
+	if (*notifications)[len(*notifications)-1] != expect {
+		t.Errorf("Expected notification \"%s\", got %v", expect, *notifications)
+	}
+	if len(sut.PendingAuthorizations()) != 0 {
+		t.Error("Expired authorization is still pending.")
+	}
+}
+
+func TestCertSigner_CancelAuthorization(t *testing.T) {
+	sut, deferred, _ := deferredSutFactory(t, time.Now())
+	defer sut.Shutdown()
+
+	if sut.CancelAuthorization("foo.bar.com") {
+		t.Error("Cancelling a nonexistent authorization reported success.")
+	}
+
+	resultChan := sut.Sign("foo.bar.com", false)
+	<-deferred
+
+	if !sut.CancelAuthorization("foo.bar.com") {
+		t.Fatal("Cancelling the pending authorization reported failure.")
+	}
+	result := <-resultChan
+	expect := "Authorization to sign a certificate for \"foo.bar.com\" was cancelled."
+	if result.Success || result.Message != expect {
+		t.Errorf("Expected failed signing result \"%s\", got %+v", expect, result)
+	}
+	if _, open := <-resultChan; open {
+		t.Error("Result channel was not closed after the authorization was cancelled.")
+	}
+	if len(sut.PendingAuthorizations()) != 0 {
+		t.Error("Cancelled authorization is still pending.")
+	}
+}
@@ -0,0 +1,104 @@
+package certsign
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+// How often to look for the certificate the CA signed after an approving autosign check.
+const autosignPollInterval = time.Second
+
+// AutosignCheck decides whether the CA may sign csrPem for certSubject, on behalf of Puppet's policy-based
+// autosigning. It approves only subjects with a pending authorization whose expected attributes the CSR carries.
+// Once approved, the CA does the signing; the CertSigner watches for the signed certificate to complete the
+// authorization. The returned message explains the decision.
+func (ctx *CertSigner) AutosignCheck(certSubject string, csrPem []byte) (bool, string) {
+	csrBlock, _ := pem.Decode(csrPem)
+	if csrBlock == nil {
+		return false, "No CSR was provided."
+	}
+	csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+	if err != nil {
+		return false, fmt.Sprintf("CSR could not be parsed: %s.", err.Error())
+	}
+	if csr.Subject.CommonName != certSubject {
+		return false, fmt.Sprintf("CSR subject \"%s\" does not match \"%s\".", csr.Subject.CommonName, certSubject)
+	}
+
+	// A certificate already signed for the subject, which was not cleaned first, is not the one being approved.
+	staleCert := ctx.signedCertFingerprint(certSubject)
+
+	ctx.authorizationsLock.Lock()
+	authorization, present := (*ctx.authorizedCertSubjects)[certSubject]
+	if !present || authorization.expired(ctx.now()) {
+		ctx.authorizationsLock.Unlock()
+		info := fmt.Sprintf("There is no pending authorization for %s.", certSubject)
+		ctx.log.Printf("Autosign check declined: %s\n", info)
+		return false, info
+	}
+	err = authorization.options.ExpectedAttributes.Verify(csr)
+	if err == nil {
+		_, err = ctx.checkDnsAltNames(certSubject, csr, authorization.options.DnsAltNames)
+	}
+	if err != nil {
+		// The authorization checked is the one withdrawn; the lock is held throughout so it can't be replaced by a
+		// newer one in between.
+		delete(*ctx.authorizedCertSubjects, certSubject)
+		ctx.persistAuthorizations()
+		ctx.authorizationsLock.Unlock()
+		info := fmt.Sprintf("Refusing to sign certificate for \"%s\": %s.", certSubject, err.Error())
+		ctx.authorizationWithdrawn(certSubject, authorization.resultChan, info)
+		return false, info
+	}
+	authorization.autosigned = true
+	authorization.staleCert = staleCert
+	ctx.persistAuthorizations()
+	ctx.authorizationsLock.Unlock()
+
+	ctx.log.Printf("Autosign check approved signing of %s.\n", certSubject)
+	go ctx.awaitAutosign(certSubject, authorization, staleCert)
+	return true, fmt.Sprintf("%s is authorized for signing.", certSubject)
+}
+
+// awaitAutosign completes an autosign-approved authorization when the CA's signed certificate turns up, telling it
+// from the stale certificate, if any, that was there when signing was approved by its fingerprint. It gives up if
+// the authorization goes away first, by expiring, being cancelled or being superseded.
+func (ctx *CertSigner) awaitAutosign(certSubject string, authorization *pendingAuthorization, stale string) {
+	ticker := time.NewTicker(autosignPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.stopping:
+			return
+		}
+
+		if current, present := ctx.authorization(certSubject); !present || current != authorization {
+			return
+		}
+		if fingerprint := ctx.signedCertFingerprint(certSubject); fingerprint == "" || fingerprint == stale {
+			continue
+		}
+
+		ctx.authorizationsLock.Lock()
+		if (*ctx.authorizedCertSubjects)[certSubject] != authorization {
+			ctx.authorizationsLock.Unlock()
+			return
+		}
+		delete(*ctx.authorizedCertSubjects, certSubject)
+		ctx.persistAuthorizations()
+		ctx.authorizationsLock.Unlock()
+
+		ctx.recordSigning(certSubject, SigningRecord{Signed: ctx.now(), RequestedBy: authorization.options.RequestedBy})
+		info := fmt.Sprintf("Certificate for \"%s\" has been signed.", certSubject)
+		ctx.notify(info)
+		ctx.log.Println(info)
+		if authorization.resultChan != nil {
+			authorization.resultChan <- SigningResult{Action: "sign", Success: true, Message: info}
+			close(authorization.resultChan)
+		}
+		return
+	}
+}
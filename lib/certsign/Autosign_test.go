@@ -0,0 +1,121 @@
+package certsign
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCertSigner_AutosignCheck(t *testing.T) {
+	sut, deferred, notifications := deferredSutFactory(t, time.Now())
+
+	if approved, _ := sut.AutosignCheck("foo.bar.com", testCsrPem(t, "foo.bar.com", "", nil)); approved {
+		t.Error("Autosign check approved a subject without a pending authorization.")
+	}
+
+	resultChan := sut.SignWithOptions("foo.bar.com", false, SignOptions{ExpectedAttributes: &CsrAttributes{ChallengePassword: "s3cret"}})
+	<-deferred
+
+	if approved, message := sut.AutosignCheck("foo.bar.com", testCsrPem(t, "baz.bar.com", "s3cret", nil)); approved {
+		t.Errorf("Autosign check approved a CSR for a different subject: %s", message)
+	}
+
+	// The CA's certificate appears once the check approves it.
+	var signed int32
+	sut.openFileFunc = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		if atomic.LoadInt32(&signed) == 0 {
+			return nil, errors.New("simulated error")
+		}
+		return os.Open(os.DevNull)
+	}
+	approved, message := sut.AutosignCheck("foo.bar.com", testCsrPem(t, "foo.bar.com", "s3cret", nil))
+	if !approved {
+		t.Fatalf("Autosign check declined a matching CSR: %s", message)
+	}
+	atomic.StoreInt32(&signed, 1)
+
+	select {
+	case result := <-resultChan:
+		expect := "Certificate for \"foo.bar.com\" has been signed."
+		if !result.Success || result.Message != expect {
+			t.Errorf("Expected signing result \"%s\", got %+v", expect, result)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Signing result was not delivered after the CA signed the certificate.")
+	}
+	sut.Shutdown()
+
+	if len(sut.PendingAuthorizations()) != 0 {
+		t.Error("Autosigned authorization is still pending.")
+	}
+	expect := "Certificate for \"foo.bar.com\" has been signed."
+	if (*notifications)[len(*notifications)-1] != expect {
+		t.Errorf("Expected notification \"%s\", got %v", expect, *notifications)
+	}
+}
+
+func TestCertSigner_AutosignCheck_StaleCert(t *testing.T) {
+	sut, deferred, _ := deferredSutFactory(t, time.Now())
+	defer sut.Shutdown()
+
+	// A certificate for the subject from before is still there, not having been cleaned.
+	certs, err := ioutil.TempDir("", "spp-autosign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certs)
+	certPath := filepath.Join(certs, "foo.bar.com.pem")
+	ioutil.WriteFile(certPath, []byte("stale certificate"), 0644)
+	sut.openFileFunc = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return os.Open(certPath)
+	}
+
+	resultChan := sut.SignWithOptions("foo.bar.com", false, SignOptions{ExpectedAttributes: &CsrAttributes{ChallengePassword: "s3cret"}})
+	<-deferred
+	if approved, message := sut.AutosignCheck("foo.bar.com", testCsrPem(t, "foo.bar.com", "s3cret", nil)); !approved {
+		t.Fatalf("Autosign check declined a matching CSR: %s", message)
+	}
+
+	select {
+	case result := <-resultChan:
+		t.Fatalf("Signing was reported before the CA signed the new certificate: %+v", result)
+	case <-time.After(3 * autosignPollInterval):
+	}
+	if len(sut.PendingAuthorizations()) != 1 {
+		t.Error("Authorization was completed by the stale certificate.")
+	}
+
+	ioutil.WriteFile(certPath, []byte("new certificate"), 0644)
+	select {
+	case result := <-resultChan:
+		if !result.Success {
+			t.Errorf("Expected a successful signing result, got %+v", result)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Signing result was not delivered after the CA signed the new certificate.")
+	}
+}
+
+func TestCertSigner_AutosignCheck_RefusesMismatchedCsr(t *testing.T) {
+	sut, deferred, _ := deferredSutFactory(t, time.Now())
+	defer sut.Shutdown()
+
+	resultChan := sut.SignWithOptions("foo.bar.com", false, SignOptions{ExpectedAttributes: &CsrAttributes{ChallengePassword: "s3cret"}})
+	<-deferred
+
+	approved, message := sut.AutosignCheck("foo.bar.com", testCsrPem(t, "foo.bar.com", "rogue", nil))
+	expect := "Refusing to sign certificate for \"foo.bar.com\": CSR challengePassword does not match."
+	if approved || message != expect {
+		t.Errorf("Expected autosign check to decline with \"%s\", got %v \"%s\"", expect, approved, message)
+	}
+	if result := <-resultChan; result.Success || result.Message != expect {
+		t.Errorf("Expected signing result \"%s\", got %+v", expect, result)
+	}
+	if len(sut.PendingAuthorizations()) != 0 {
+		t.Error("The refused authorization is still pending.")
+	}
+}
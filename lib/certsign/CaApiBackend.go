@@ -0,0 +1,361 @@
+package certsign
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
+)
+
+// CaApiConfig locates a Puppet Server CA's HTTP API and the client credentials used to authenticate to it.
+type CaApiConfig struct {
+	Url          string // e.g. https://puppetca.my.org:8140
+	ClientCert   string
+	ClientKey    string
+	CaCert       string        // Used to verify the CA server's certificate.
+	PollInterval time.Duration // How often to look for newly arrived CSRs. Default 15s.
+}
+
+// CaApiClient makes requests against the Puppet CA certificate_status API.
+type CaApiClient struct {
+	baseUrl    string
+	httpClient *http.Client
+}
+
+type certificateStatus struct {
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// caApiBackend signs and revokes certificates through the Puppet CA HTTP API, for when SPP is not on the CA host.
+type caApiBackend struct {
+	client *CaApiClient
+}
+
+func NewCaApiClient(config *CaApiConfig) (*CaApiClient, error) {
+	if config == nil || config.Url == "" {
+		return nil, errors.New("CaApi Url is not configured")
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.ClientCert != "" || config.ClientKey != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load CA API client credentials: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+	if config.CaCert != "" {
+		caPem, err := ioutil.ReadFile(config.CaCert)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA API CA certificate: %s", err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("No certificates found in %s", config.CaCert)
+		}
+	}
+
+	client := CaApiClient{
+		baseUrl: strings.TrimRight(config.Url, "/"),
+		httpClient: &http.Client{
+			Timeout:   time.Second * 30,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+	return &client, nil
+}
+
+func newCaApiBackend(config *CaApiConfig) (*caApiBackend, error) {
+	client, err := NewCaApiClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &caApiBackend{client: client}, nil
+}
+
+func (ctx *caApiBackend) Sign(certSubject string) error {
+	status, body, err := ctx.client.setDesiredState(certSubject, "signed")
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrCsrNotFound
+	default:
+		return fmt.Errorf("CA responded HTTP %d: %s", status, body)
+	}
+}
+
+func (ctx *caApiBackend) Clean(certSubject string) error {
+	status, body, err := ctx.client.setDesiredState(certSubject, "revoked")
+	if err != nil {
+		return err
+	}
+	// 409 means the certificate was already revoked or was never signed; either way it can still be deleted.
+	if status != http.StatusNoContent && status != http.StatusOK && status != http.StatusNotFound && status != http.StatusConflict {
+		return fmt.Errorf("CA responded HTTP %d to revocation: %s", status, body)
+	}
+
+	status, body, err = ctx.client.do(http.MethodDelete, ctx.client.statusUrl(certSubject), nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusNoContent && status != http.StatusOK && status != http.StatusNotFound {
+		return fmt.Errorf("CA responded HTTP %d to deletion: %s", status, body)
+	}
+	return nil
+}
+
+// RejectCsr deletes the subject's pending CSR from the CA.
+func (ctx *caApiBackend) RejectCsr(certSubject string) error {
+	status, body, err := ctx.client.do(http.MethodDelete, ctx.client.statusUrl(certSubject), nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusNoContent && status != http.StatusOK && status != http.StatusNotFound {
+		return fmt.Errorf("CA responded HTTP %d to deletion: %s", status, body)
+	}
+	return nil
+}
+
+// HasSignedCert asks the CA whether it holds a signed certificate for the subject, since there is no local
+// signed certificate directory to look in.
+func (ctx *caApiBackend) HasSignedCert(certSubject string) (bool, error) {
+	certStatus, err := ctx.signedCertStatus(certSubject)
+	return certStatus != nil, err
+}
+
+// SignedCertFingerprint asks the CA for the fingerprint of the subject's signed certificate, or "" if it has none.
+func (ctx *caApiBackend) SignedCertFingerprint(certSubject string) (string, error) {
+	certStatus, err := ctx.signedCertStatus(certSubject)
+	if certStatus == nil {
+		return "", err
+	}
+	if certStatus.Fingerprint == "" {
+		// The CA didn't say; a certificate that is replaced won't be noticed.
+		return "signed", nil
+	}
+	return certStatus.Fingerprint, nil
+}
+
+// signedCertStatus returns the CA's status for the subject, or nil if it holds no signed certificate for it.
+func (ctx *caApiBackend) signedCertStatus(certSubject string) (*certificateStatus, error) {
+	status, body, err := ctx.client.do(http.MethodGet, ctx.client.statusUrl(certSubject), nil)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusOK:
+		var certStatus certificateStatus
+		if err := json.Unmarshal(body, &certStatus); err != nil {
+			return nil, err
+		}
+		if certStatus.State != "signed" {
+			return nil, nil
+		}
+		return &certStatus, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("CA responded HTTP %d: %s", status, body)
+	}
+}
+
+func (ctx *caApiBackend) FetchCsr(certSubject string) (*x509.CertificateRequest, error) {
+	requestUrl := fmt.Sprintf("%s/puppet-ca/v1/certificate_request/%s", ctx.client.baseUrl, url.PathEscape(certSubject))
+	status, body, err := ctx.client.request(http.MethodGet, requestUrl, nil, "text/plain")
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusOK:
+		csrBlock, _ := pem.Decode(body)
+		if csrBlock == nil {
+			return nil, fmt.Errorf("CA returned no PEM data for the %s CSR", certSubject)
+		}
+		return x509.ParseCertificateRequest(csrBlock.Bytes)
+	case http.StatusNotFound:
+		return nil, ErrCsrNotFound
+	default:
+		return nil, fmt.Errorf("CA responded HTTP %d: %s", status, body)
+	}
+}
+
+// RequestedCertificates lists the subjects that have a CSR pending on the CA.
+func (ctx *CaApiClient) RequestedCertificates() ([]string, error) {
+	status, body, err := ctx.do(http.MethodGet, ctx.baseUrl+"/puppet-ca/v1/certificate_statuses/any_key?state=requested", nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("CA responded HTTP %d: %s", status, body)
+	}
+
+	var statuses []certificateStatus
+	if err := json.Unmarshal(body, &statuses); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(statuses))
+	for _, certStatus := range statuses {
+		if certStatus.State == "requested" {
+			names = append(names, certStatus.Name)
+		}
+	}
+	return names, nil
+}
+
+func (ctx *CaApiClient) statusUrl(certSubject string) string {
+	return fmt.Sprintf("%s/puppet-ca/v1/certificate_status/%s", ctx.baseUrl, url.PathEscape(certSubject))
+}
+
+func (ctx *CaApiClient) setDesiredState(certSubject string, state string) (int, []byte, error) {
+	requestBody, _ := json.Marshal(map[string]string{"desired_state": state})
+	return ctx.do(http.MethodPut, ctx.statusUrl(certSubject), requestBody)
+}
+
+func (ctx *CaApiClient) do(method string, requestUrl string, requestBody []byte) (int, []byte, error) {
+	return ctx.request(method, requestUrl, requestBody, "application/json")
+}
+
+func (ctx *CaApiClient) request(method string, requestUrl string, requestBody []byte, accept string) (int, []byte, error) {
+	var bodyReader io.Reader
+	if requestBody != nil {
+		bodyReader = bytes.NewReader(requestBody)
+	}
+	request, err := http.NewRequest(method, requestUrl, bodyReader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if requestBody != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	request.Header.Set("Accept", accept)
+
+	response, err := ctx.httpClient.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(io.LimitReader(response.Body, 1024*1024))
+	if err != nil {
+		return 0, nil, err
+	}
+	return response.StatusCode, responseBody, nil
+}
+
+// caApiCsrPoller stands in for an fsnotify watch of the CSR directory when the CA is remote, by periodically
+// listing the CA's pending requests and posting a Create event for each one that was not present last time.
+type caApiCsrPoller struct {
+	client   *CaApiClient
+	interval time.Duration
+	log      *log.Logger
+	watcher  *interfaces.FsnotifyWatcher
+	csrDir   string
+	started  bool
+	stop     chan struct{}
+	lock     sync.Mutex
+}
+
+// NewCaApiCsrWatcher returns a FsnotifyWatcher that reports CSRs arriving at a remote Puppet CA.
+func NewCaApiCsrWatcher(config *CaApiConfig, log *log.Logger) (*interfaces.FsnotifyWatcher, error) {
+	client, err := NewCaApiClient(config)
+	if err != nil {
+		return nil, err
+	}
+	poller := &caApiCsrPoller{
+		client:   client,
+		interval: config.PollInterval,
+		log:      log,
+		stop:     make(chan struct{}),
+	}
+	if poller.interval <= 0 {
+		poller.interval = 15 * time.Second
+	}
+	poller.watcher = &interfaces.FsnotifyWatcher{
+		Add:    poller.add,
+		Remove: func(name string) error { return nil },
+		Close:  poller.close,
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	return poller.watcher, nil
+}
+
+func (ctx *caApiCsrPoller) add(name string) error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	// The CSR directory is only used to give events a familiar-looking path.
+	ctx.csrDir = name
+	if !ctx.started {
+		ctx.started = true
+		go ctx.poll()
+	}
+	return nil
+}
+
+func (ctx *caApiCsrPoller) close() error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if ctx.started {
+		close(ctx.stop)
+		ctx.started = false
+	}
+	return nil
+}
+
+func (ctx *caApiCsrPoller) poll() {
+	ticker := time.NewTicker(ctx.interval)
+	defer ticker.Stop()
+
+	previous := map[string]bool{}
+	for {
+		names, err := ctx.client.RequestedCertificates()
+		if err != nil {
+			select {
+			case ctx.watcher.Errors <- err:
+			case <-ctx.stop:
+				return
+			}
+		} else {
+			current := make(map[string]bool, len(names))
+			for _, name := range names {
+				current[name] = true
+				if previous[name] {
+					continue
+				}
+				event := fsnotify.Event{Name: filepath.Join(ctx.csrDir, name+".pem"), Op: fsnotify.Create}
+				select {
+				case ctx.watcher.Events <- event:
+				case <-ctx.stop:
+					return
+				}
+			}
+			previous = current
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package certsign
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetconfig"
+)
+
+// fakePuppetCa is an httptest stand-in for the certificate_status endpoints of a Puppet Server CA.
+type fakePuppetCa struct {
+	states   map[string]string
+	requests []string
+	lock     sync.Mutex
+}
+
+func newFakePuppetCa(states map[string]string) (*fakePuppetCa, *httptest.Server) {
+	ca := &fakePuppetCa{states: states}
+	return ca, httptest.NewServer(ca)
+}
+
+func (ctx *fakePuppetCa) setState(name string, state string) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.states[name] = state
+}
+
+func (ctx *fakePuppetCa) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.requests = append(ctx.requests, request.Method+" "+request.URL.Path)
+
+	if strings.HasPrefix(request.URL.Path, "/puppet-ca/v1/certificate_statuses/") {
+		statuses := []certificateStatus{}
+		for name, state := range ctx.states {
+			if request.URL.Query().Get("state") == "" || request.URL.Query().Get("state") == state {
+				statuses = append(statuses, certificateStatus{Name: name, State: state})
+			}
+		}
+		json.NewEncoder(response).Encode(statuses)
+		return
+	}
+
+	name := strings.TrimPrefix(request.URL.Path, "/puppet-ca/v1/certificate_status/")
+	state, present := ctx.states[name]
+	switch request.Method {
+	case http.MethodGet:
+		if !present {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(response).Encode(certificateStatus{Name: name, State: state})
+	case http.MethodPut:
+		var body map[string]string
+		json.NewDecoder(request.Body).Decode(&body)
+		switch {
+		case !present:
+			response.WriteHeader(http.StatusNotFound)
+		case body["desired_state"] == "signed" && state == "requested",
+			body["desired_state"] == "revoked" && state == "signed":
+			ctx.states[name] = body["desired_state"]
+			response.WriteHeader(http.StatusNoContent)
+		default:
+			response.WriteHeader(http.StatusConflict)
+		}
+	case http.MethodDelete:
+		if !present {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(ctx.states, name)
+		response.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestCaApiBackend_Sign(t *testing.T) {
+	ca, server := newFakePuppetCa(map[string]string{"foo.bar.com": "requested"})
+	defer server.Close()
+
+	sut, err := newCaApiBackend(&CaApiConfig{Url: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sut.Sign("foo.bar.com"); err != nil {
+		t.Errorf("Expected successful signing, got %s", err.Error())
+	}
+	if ca.states["foo.bar.com"] != "signed" {
+		t.Errorf("Expected CA to have signed foo.bar.com, state is %s", ca.states["foo.bar.com"])
+	}
+	if exists, _ := sut.HasSignedCert("foo.bar.com"); !exists {
+		t.Error("Expected the signed certificate to be reported as existing.")
+	}
+	if fingerprint, _ := sut.SignedCertFingerprint("foo.bar.com"); fingerprint == "" {
+		t.Error("Expected the signed certificate to be identified.")
+	}
+}
+
+func TestCaApiBackend_Sign_NoCsr(t *testing.T) {
+	_, server := newFakePuppetCa(map[string]string{})
+	defer server.Close()
+
+	sut, _ := newCaApiBackend(&CaApiConfig{Url: server.URL})
+	if err := sut.Sign("foo.bar.com"); err != ErrCsrNotFound {
+		t.Errorf("Expected ErrCsrNotFound, got %v", err)
+	}
+	if exists, _ := sut.HasSignedCert("foo.bar.com"); exists {
+		t.Error("Expected no certificate to be reported as existing.")
+	}
+}
+
+func TestCaApiBackend_Clean(t *testing.T) {
+	ca, server := newFakePuppetCa(map[string]string{"foo.bar.com": "signed"})
+	defer server.Close()
+
+	sut, _ := newCaApiBackend(&CaApiConfig{Url: server.URL})
+	if err := sut.Clean("foo.bar.com"); err != nil {
+		t.Errorf("Expected successful revocation, got %s", err.Error())
+	}
+
+	expect := []string{
+		"PUT /puppet-ca/v1/certificate_status/foo.bar.com",
+		"DELETE /puppet-ca/v1/certificate_status/foo.bar.com",
+	}
+	if strings.Join(ca.requests, ",") != strings.Join(expect, ",") {
+		t.Errorf("Expected requests %v, got %v", expect, ca.requests)
+	}
+	if _, present := ca.states["foo.bar.com"]; present {
+		t.Error("Expected CA to have deleted foo.bar.com.")
+	}
+}
+
+func TestNewCaApiClient_BadCredentials(t *testing.T) {
+	_, err := NewCaApiClient(&CaApiConfig{Url: "https://ca", ClientCert: "/dev/notafile", ClientKey: "/dev/notafile"})
+	if err == nil || !strings.Contains(err.Error(), "Unable to load CA API client credentials") {
+		t.Errorf("Expected client credential loading error, got %v", err)
+	}
+}
+
+func TestCaApiCsrWatcher_ReportsNewCsrsOnce(t *testing.T) {
+	ca, server := newFakePuppetCa(map[string]string{"foo.bar.com": "requested", "old.bar.com": "signed"})
+	defer server.Close()
+
+	sut, err := NewCaApiCsrWatcher(&CaApiConfig{Url: server.URL, PollInterval: 10 * time.Millisecond}, log.New(&bytes.Buffer{}, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sut.Close()
+	sut.Add("/testssl/csr")
+
+	event := <-sut.Events
+	if event.Name != "/testssl/csr/foo.bar.com.pem" {
+		t.Errorf("Expected event for /testssl/csr/foo.bar.com.pem, got %s", event.Name)
+	}
+
+	// foo.bar.com is still pending, so only the newcomer should be reported.
+	ca.setState("new.bar.com", "requested")
+	event = <-sut.Events
+	if event.Name != "/testssl/csr/new.bar.com.pem" {
+		t.Errorf("Expected event for /testssl/csr/new.bar.com.pem, got %s", event.Name)
+	}
+}
+
+func TestCertSigner_CaApi_HandlesDeferredCsr(t *testing.T) {
+	ca, server := newFakePuppetCa(map[string]string{})
+	defer server.Close()
+
+	caApiConfig := &CaApiConfig{Url: server.URL, PollInterval: 10 * time.Millisecond}
+	testlog := log.New(&bytes.Buffer{}, "", 0)
+	watcher, _ := NewCaApiCsrWatcher(caApiConfig, testlog)
+	puppetConfig := puppetconfig.PuppetConfig{CsrDir: "/testssl/csr", SignedCertDir: "/testssl/cert"}
+	notifications := make(chan string, 5)
+	sut, err := NewCertSigner(puppetConfig, CertSignerConfig{Backend: "ca-api", CaApi: caApiConfig}, testlog, watcher, func(message string) {
+		notifications <- message
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sut.Shutdown()
+
+	resultChan := sut.Sign("foo.bar.com", false)
+	if notification := <-notifications; notification != "Certificate for \"foo.bar.com\" will be signed when a matching CSR arrives." {
+		t.Errorf("Unexpected notification \"%s\"", notification)
+	}
+
+	// The agent submits its CSR.
+	ca.setState("foo.bar.com", "requested")
+
+	result := <-resultChan
+	if !result.Success {
+		t.Errorf("Signing result was not Success: %s", result.Message)
+	}
+	if ca.states["foo.bar.com"] != "signed" {
+		t.Errorf("Expected CA to have signed foo.bar.com, state is %s", ca.states["foo.bar.com"])
+	}
+}
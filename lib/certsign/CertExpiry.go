@@ -0,0 +1,246 @@
+package certsign
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/atomicfile"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// expiryWarningFile is the name of the file, beside the AuthorizationStore, recording the warnings already sent.
+const expiryWarningFile = "expiry-warnings.json"
+
+// ExpiryWarningConfig controls the notifications sent as signed certificates and the CA certificate near expiry.
+// When there is an AuthorizationStore, the warnings already sent are saved beside it, so that a restart doesn't
+// send them again.
+type ExpiryWarningConfig struct {
+	// Days before expiry to notify at. Default 60, 30 and 7. A notification is also sent once a certificate expires.
+	Days []int
+	// How often the certificates are checked. Default 1h.
+	Interval time.Duration
+	// Turns expiry checks off.
+	Disabled bool
+}
+
+// ExpiryCounts tallies the certificates near or past expiry, as of the last check.
+type ExpiryCounts struct {
+	// Unexpired certificates expiring within each configured number of days. Nearer thresholds are included in
+	// the counts for further ones.
+	ExpiringWithin map[int]int
+	Expired        int
+	// Expiry of the CA certificate, if it could be read.
+	CaNotAfter *time.Time
+	Checked    time.Time
+}
+
+type expiryMonitor struct {
+	config    ExpiryWarningConfig
+	lastCheck time.Time
+	// The level each certificate, by fingerprint, has been warned at: an index into config.Days, or len(config.Days)
+	// once it has expired. Keying on the fingerprint starts a renewed certificate over.
+	warned map[string]int
+	path   string // The warned levels aren't saved if empty.
+	counts ExpiryCounts
+	lock   sync.Mutex // Guards counts, which /stats reads.
+}
+
+// savedExpiryWarning is the durable form of a warned level. It holds the threshold in days rather than the level,
+// which would be misread if the configured Days changed meanwhile.
+type savedExpiryWarning struct {
+	Days    int  `json:",omitempty"`
+	Expired bool `json:",omitempty"`
+}
+
+func newExpiryMonitor(config *ExpiryWarningConfig) *expiryMonitor {
+	monitor := &expiryMonitor{warned: make(map[string]int)}
+	if config != nil {
+		monitor.config = *config
+	}
+	if len(monitor.config.Days) == 0 {
+		monitor.config.Days = []int{60, 30, 7}
+	}
+	// Furthest threshold first, so the level rises as expiry approaches.
+	monitor.config.Days = append([]int(nil), monitor.config.Days...)
+	sort.Sort(sort.Reverse(sort.IntSlice(monitor.config.Days)))
+	if monitor.config.Interval == 0 {
+		monitor.config.Interval = time.Hour
+	}
+	monitor.counts.ExpiringWithin = make(map[int]int)
+	return monitor
+}
+
+// load restores the warned levels saved by an earlier run. Warnings at thresholds no longer configured are
+// forgotten, unless a nearer threshold was also passed.
+func (ctx *expiryMonitor) load() error {
+	data, err := ioutil.ReadFile(ctx.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved map[string]savedExpiryWarning
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for certFingerprint, warning := range saved {
+		level := -1
+		if warning.Expired {
+			level = len(ctx.config.Days)
+		} else {
+			for i, within := range ctx.config.Days {
+				if within >= warning.Days {
+					level = i
+				}
+			}
+		}
+		if level >= 0 {
+			ctx.warned[certFingerprint] = level
+		}
+	}
+	return nil
+}
+
+// save records the warned levels, if they are saved.
+func (ctx *expiryMonitor) save() error {
+	if ctx.path == "" {
+		return nil
+	}
+	saved := make(map[string]savedExpiryWarning, len(ctx.warned))
+	for certFingerprint, level := range ctx.warned {
+		if level == len(ctx.config.Days) {
+			saved[certFingerprint] = savedExpiryWarning{Expired: true}
+		} else {
+			saved[certFingerprint] = savedExpiryWarning{Days: ctx.config.Days[level]}
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(ctx.path, data, 0600)
+}
+
+// ExpiryCounts reports the results of the last certificate expiry check.
+func (ctx *CertSigner) ExpiryCounts() ExpiryCounts {
+	ctx.expiry.lock.Lock()
+	defer ctx.expiry.lock.Unlock()
+	counts := ctx.expiry.counts
+	counts.ExpiringWithin = make(map[int]int, len(ctx.expiry.counts.ExpiringWithin))
+	for days, count := range ctx.expiry.counts.ExpiringWithin {
+		counts.ExpiringWithin[days] = count
+	}
+	return counts
+}
+
+// checkExpiryIfDue runs checkExpiry when the configured interval has passed since the last check.
+func (ctx *CertSigner) checkExpiryIfDue() {
+	if ctx.expiry.config.Disabled || ctx.now().Sub(ctx.expiry.lastCheck) < ctx.expiry.config.Interval {
+		return
+	}
+	ctx.checkExpiry()
+}
+
+// checkExpiry reads the signed certificates and the CA certificate, notifying about each one that has crossed a
+// warning threshold it hasn't been notified about yet.
+func (ctx *CertSigner) checkExpiry() {
+	now := ctx.now()
+	ctx.expiry.lastCheck = now
+	days := ctx.expiry.config.Days
+
+	counts := ExpiryCounts{ExpiringWithin: make(map[int]int, len(days)), Checked: now}
+	for _, within := range days {
+		counts.ExpiringWithin[within] = 0
+	}
+	seen := make(map[string]bool)
+	changed := false
+
+	var certs []*x509.Certificate
+	var caCert *x509.Certificate
+	if ctx.puppetConfig.CaCert != "" {
+		var err error
+		if caCert, err = readCertFile(ctx.puppetConfig.CaCert); err == nil {
+			certs = append(certs, caCert)
+			caNotAfter := caCert.NotAfter
+			counts.CaNotAfter = &caNotAfter
+		} else {
+			ctx.log.Printf("Expiry check could not read the CA certificate: %s\n", err.Error())
+		}
+	}
+	certFiles, err := listPemFiles(ctx.puppetConfig.SignedCertDir)
+	if err != nil {
+		ctx.log.Printf("Expiry check could not list signed certificates: %s\n", err.Error())
+	}
+	for _, certFile := range certFiles {
+		cert, err := readCertFile(certFile)
+		if err != nil {
+			ctx.log.Printf("Expiry check skipped %s: %s\n", certFile, err.Error())
+			continue
+		}
+		certs = append(certs, cert)
+	}
+
+	for _, cert := range certs {
+		certFingerprint := fingerprint(cert.Raw)
+		if seen[certFingerprint] {
+			continue
+		}
+		seen[certFingerprint] = true
+
+		remaining := cert.NotAfter.Sub(now)
+		level := -1
+		if remaining <= 0 {
+			counts.Expired++
+			level = len(days)
+		} else {
+			for i, within := range days {
+				if remaining <= time.Duration(within)*24*time.Hour {
+					counts.ExpiringWithin[within]++
+					level = i
+				}
+			}
+		}
+
+		warned, present := ctx.expiry.warned[certFingerprint]
+		if level < 0 || (present && warned >= level) {
+			continue
+		}
+		ctx.expiry.warned[certFingerprint] = level
+		changed = true
+
+		name := fmt.Sprintf("The certificate for \"%s\"", cert.Subject.CommonName)
+		if cert == caCert {
+			name = "The CA certificate"
+		}
+		var info string
+		if level == len(days) {
+			info = fmt.Sprintf("%s expired on %s.", name, cert.NotAfter.Format(time.RFC1123))
+		} else {
+			info = fmt.Sprintf("%s expires in %d days, on %s.", name, int(remaining.Hours()/24), cert.NotAfter.Format(time.RFC1123))
+		}
+		ctx.notify(info)
+		ctx.log.Println(info)
+	}
+
+	// Forget certificates that are gone, such as ones that were revoked or renewed.
+	for certFingerprint := range ctx.expiry.warned {
+		if !seen[certFingerprint] {
+			delete(ctx.expiry.warned, certFingerprint)
+			changed = true
+		}
+	}
+	if changed {
+		if err := ctx.expiry.save(); err != nil {
+			ctx.log.Printf("Unable to save the certificate expiry warnings sent to %s: %s\n", ctx.expiry.path, err.Error())
+		}
+	}
+
+	ctx.expiry.lock.Lock()
+	ctx.expiry.counts = counts
+	ctx.expiry.lock.Unlock()
+}
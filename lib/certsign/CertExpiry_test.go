@@ -0,0 +1,169 @@
+package certsign
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
+)
+
+func writeTestCert(t *testing.T, dir string, subject string, notAfter time.Time) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: subject},
+		NotBefore:    notAfter.Add(-5 * 365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, subject+".pem"), certPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertSigner_CheckExpiry(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	start := time.Now()
+	writeTestCert(t, cfg.SignedCertDir, "a.bar.com", start.Add(45*24*time.Hour+time.Hour))
+	writeTestCert(t, cfg.SignedCertDir, "b.bar.com", start.Add(20*24*time.Hour-time.Hour))
+	writeTestCert(t, cfg.SignedCertDir, "c.bar.com", start.Add(-time.Hour))
+	writeTestCert(t, cfg.SignedCertDir, "d.bar.com", start.Add(200*24*time.Hour))
+
+	var notifications []string
+	watcher := &interfaces.FsnotifyWatcher{
+		Add:    func(name string) error { return nil },
+		Close:  func() error { return nil },
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	sut, err := NewCertSigner(*cfg, CertSignerConfig{Backend: "native"}, log.New(&bytes.Buffer{}, "", 0), watcher, func(message string) { notifications = append(notifications, message) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	sut.Shutdown()
+	clock := &testClock{time: start}
+	sut.now = clock.now
+
+	sut.checkExpiry()
+	// The test CA certificate expires in an hour.
+	if len(notifications) != 4 {
+		t.Fatalf("Expected 4 notifications, got %v", notifications)
+	}
+	for _, expect := range []string{"The CA certificate expires in 0 days", "\"a.bar.com\" expires in 45 days", "\"b.bar.com\" expires in 19 days", "\"c.bar.com\" expired on"} {
+		found := false
+		for _, notification := range notifications {
+			found = found || strings.Contains(notification, expect)
+		}
+		if !found {
+			t.Errorf("Expected a notification containing \"%s\", got %v", expect, notifications)
+		}
+	}
+	counts := sut.ExpiryCounts()
+	if counts.ExpiringWithin[60] != 3 || counts.ExpiringWithin[30] != 2 || counts.ExpiringWithin[7] != 1 || counts.Expired != 1 {
+		t.Errorf("Unexpected expiry counts %+v", counts)
+	}
+	if counts.CaNotAfter == nil {
+		t.Error("CA certificate expiry was not reported.")
+	}
+
+	// Nothing new to say.
+	notifications = nil
+	sut.checkExpiry()
+	if len(notifications) != 0 {
+		t.Errorf("Expected no repeated notifications, got %v", notifications)
+	}
+
+	// a.bar.com crosses the 30 day threshold; b.bar.com and the CA expire.
+	clock.advance(20 * 24 * time.Hour)
+	sut.checkExpiry()
+	if len(notifications) != 3 {
+		t.Errorf("Expected 3 notifications, got %v", notifications)
+	}
+
+	// A renewed certificate is a new certificate.
+	notifications = nil
+	writeTestCert(t, cfg.SignedCertDir, "c.bar.com", start.Add(25*24*time.Hour+time.Hour))
+	sut.checkExpiry()
+	if len(notifications) != 1 || !strings.Contains(notifications[0], "\"c.bar.com\" expires in 5 days") {
+		t.Errorf("Expected a notification about the renewed certificate, got %v", notifications)
+	}
+}
+
+func TestCertSigner_CheckExpiry_RemembersWarningsAcrossRestarts(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	start := time.Now()
+	writeTestCert(t, cfg.SignedCertDir, "a.bar.com", start.Add(45*24*time.Hour+time.Hour))
+	config := CertSignerConfig{Backend: "native", AuthorizationStore: filepath.Join(cfg.SslDir, "spp", "authorizations.json")}
+
+	var notifications []string
+	newSut := func() *CertSigner {
+		watcher := &interfaces.FsnotifyWatcher{
+			Add:    func(name string) error { return nil },
+			Close:  func() error { return nil },
+			Events: make(chan fsnotify.Event),
+			Errors: make(chan error),
+		}
+		sut, err := NewCertSigner(*cfg, config, log.New(&bytes.Buffer{}, "", 0), watcher, func(message string) { notifications = append(notifications, message) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		sut.Shutdown()
+		clock := &testClock{time: start}
+		sut.now = clock.now
+		return sut
+	}
+
+	newSut().checkExpiry()
+	if len(notifications) != 2 {
+		t.Fatalf("Expected notifications about a.bar.com and the CA certificate, got %v", notifications)
+	}
+
+	notifications = nil
+	newSut().checkExpiry()
+	if len(notifications) != 0 {
+		t.Errorf("Expected no warnings to be repeated after a restart, got %v", notifications)
+	}
+}
+
+func TestCertSigner_CheckExpiryIfDue(t *testing.T) {
+	sut, err, _ := sutFactory(nil, nil, nil)
+	if err != nil {
+		t.FailNow()
+	}
+	sut.Shutdown()
+	clock := &testClock{time: time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)}
+	sut.now = clock.now
+
+	sut.checkExpiryIfDue()
+	if !sut.ExpiryCounts().Checked.Equal(clock.now()) {
+		t.Error("The first expiry check was not run.")
+	}
+	clock.advance(30 * time.Minute)
+	sut.checkExpiryIfDue()
+	if sut.ExpiryCounts().Checked.Equal(clock.now()) {
+		t.Error("Expiry was checked again before the interval passed.")
+	}
+	clock.advance(30 * time.Minute)
+	sut.checkExpiryIfDue()
+	if !sut.ExpiryCounts().Checked.Equal(clock.now()) {
+		t.Error("Expiry was not checked again after the interval passed.")
+	}
+}
@@ -1,39 +1,82 @@
 package certsign
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
 	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetconfig"
+	"io"
 	"log"
+	"net"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
+// How often stale authorizations and unsolicited CSRs are looked for.
+const housekeepingInterval = time.Minute
+
 type signChanMessage struct {
 	certSubject       string
 	signCSR           bool
 	cleanExistingCert bool
+	quarantine        bool // Reject the subject's unsolicited CSR instead of signing.
+	options           SignOptions
 	resultChan        chan<- SigningResult
 }
 
+// SignOptions carries the optional constraints a caller places on a signing authorization.
+type SignOptions struct {
+	// The CSR must carry these attributes or it will not be signed.
+	ExpectedAttributes *CsrAttributes
+	// How long to wait for the CSR before giving up on it. Zero uses the configured AuthorizationTtl.
+	Ttl time.Duration
+	// Who asked for the certificate, for the record.
+	RequestedBy string
+	// DNS alt names the request allows the CSR to have, if the DnsAltNames configuration allows requested names.
+	DnsAltNames []string
+}
+
 type CertSigner struct {
-	puppetConfig           *puppetconfig.PuppetConfig
-	log                    *log.Logger
-	stopped                bool
-	stoppedChan            chan struct{}
-	signQueue              chan signChanMessage
-	cmdFactory             func(name string, arg ...string) *exec.Cmd
-	lastCmdStdout          *bytes.Buffer
-	lastCmdStderr          *bytes.Buffer
-	authorizedCertSubjects *map[string]chan<- SigningResult // Not synchronized as it is currently only touched in
-	csrWatcher             *interfaces.FsnotifyWatcher
-	stoppedCsrWatcher      chan struct{}
-	openFileFunc           func(name string, flag int, perm os.FileMode) (*os.File, error)
-	notifyCallback         func(message string)
+	puppetConfig            *puppetconfig.PuppetConfig
+	log                     *log.Logger
+	stopped                 bool         // Set by Shutdown once no more operations are admitted to signQueue.
+	stoppedLock             sync.RWMutex // Guards stopped; held for reading while an operation is being admitted.
+	stoppedChan             chan struct{}
+	signQueue               chan signChanMessage
+	queueTimeout            time.Duration // How long Sign and Clean wait for room in a full signQueue.
+	workQueue               chan signChanMessage
+	busySubjects            map[string][]signChanMessage // Subjects a worker is busy with, and messages held for them.
+	busySubjectsLock        sync.Mutex
+	backend                 SigningBackend
+	authorizedCertSubjects  *map[string]*pendingAuthorization
+	authorizationsLock      sync.Mutex // Guards authorizedCertSubjects, which the API and reaper also touch.
+	defaultAuthorizationTtl time.Duration
+	store                   *authorizationStore // Nil if authorizations aren't persisted.
+	stopping                chan struct{}       // Closed to stop the background goroutines other than the workers.
+	stoppedHousekeeping     chan struct{}
+	unsolicitedCsrs         map[string]*unsolicitedCsr
+	unsolicitedCsrsLock     sync.Mutex
+	unsolicitedCsrConfig    UnsolicitedCsrConfig
+	queuedCsrs              map[string]bool // Subjects with a CSR event waiting in signQueue.
+	overflowedCsrs          map[string]bool // Subjects whose CSR event didn't fit in signQueue, to be retried.
+	queuedCsrsLock          sync.Mutex
+	csrWatcher              *interfaces.FsnotifyWatcher
+	stoppedCsrWatcher       chan struct{}
+	openFileFunc            func(name string, flag int, perm os.FileMode) (*os.File, error)
+	notifyCallback          func(message string)
+	now                     func() time.Time
+	policies                []compiledSigningPolicy
+	dnsAltNames             dnsAltNamePolicy
+	lookupHost              func(host string) ([]string, error)
+	signingRecords          map[string]SigningRecord
+	signingRecordsLock      sync.Mutex
+	expiry                  *expiryMonitor
 }
 
 type SigningResult struct {
@@ -42,27 +85,100 @@ type SigningResult struct {
 	Message string
 }
 
-func NewCertSigner(puppetConfig puppetconfig.PuppetConfig, log *log.Logger, watcher *interfaces.FsnotifyWatcher, notifyCallback func(message string)) (*CertSigner, error) {
-	certSigner := CertSigner{puppetConfig: &puppetConfig, stopped: false, log: log}
+func NewCertSigner(puppetConfig puppetconfig.PuppetConfig, config CertSignerConfig, log *log.Logger, watcher *interfaces.FsnotifyWatcher, notifyCallback func(message string)) (*CertSigner, error) {
+	certSigner := CertSigner{puppetConfig: &puppetConfig, log: log}
+
+	backend, err := newSigningBackend(config, certSigner.puppetConfig)
+	if err != nil {
+		certSigner.log.Printf("Failed to set up certificate signing backend: %s\n", err.Error())
+		return nil, err
+	}
+	certSigner.backend = backend
 
-	certSigner.signQueue = make(chan signChanMessage, 50)
+	certSigner.policies, err = compileSigningPolicies(config.Policies)
+	if err != nil {
+		certSigner.log.Printf("Failed to set up certificate signing policies: %s\n", err.Error())
+		return nil, err
+	}
+	certSigner.dnsAltNames, err = compileDnsAltNamePolicy(config.DnsAltNames)
+	if err != nil {
+		certSigner.log.Printf("Failed to set up the DNS alt name policy: %s\n", err.Error())
+		return nil, err
+	}
+	certSigner.lookupHost = net.LookupHost
+	certSigner.signingRecords = make(map[string]SigningRecord)
+
+	if config.QueueSize <= 0 {
+		config.QueueSize = 50
+	}
+	certSigner.signQueue = make(chan signChanMessage, config.QueueSize)
+	certSigner.queueTimeout = config.QueueTimeout
+	certSigner.workQueue = make(chan signChanMessage)
+	certSigner.busySubjects = make(map[string][]signChanMessage)
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
 	certSigner.stoppedChan = make(chan struct{}, 1)
 	certSigner.stoppedCsrWatcher = make(chan struct{}, 1)
-	certSigner.cmdFactory = certSigner.puppetCmdFactory
-	temp := make(map[string]chan<- SigningResult, 15)
+	temp := make(map[string]*pendingAuthorization, 15)
 	certSigner.authorizedCertSubjects = &temp
 	certSigner.notifyCallback = notifyCallback
 	certSigner.openFileFunc = os.OpenFile
+	certSigner.now = time.Now
+
+	certSigner.defaultAuthorizationTtl = config.AuthorizationTtl
+	if certSigner.defaultAuthorizationTtl == 0 {
+		certSigner.defaultAuthorizationTtl = 24 * time.Hour
+	}
+	if config.AuthorizationStore != "" {
+		certSigner.store = &authorizationStore{path: config.AuthorizationStore}
+		certSigner.restoreAuthorizations()
+	}
+	certSigner.unsolicitedCsrs = make(map[string]*unsolicitedCsr)
+	certSigner.queuedCsrs = make(map[string]bool)
+	certSigner.overflowedCsrs = make(map[string]bool)
+	if config.UnsolicitedCsrs != nil {
+		certSigner.unsolicitedCsrConfig = *config.UnsolicitedCsrs
+	}
+	if certSigner.unsolicitedCsrConfig.NotifyInterval == 0 {
+		certSigner.unsolicitedCsrConfig.NotifyInterval = time.Hour
+	}
+	if certSigner.unsolicitedCsrConfig.GracePeriod == 0 {
+		certSigner.unsolicitedCsrConfig.GracePeriod = time.Hour
+	}
+	if certSigner.unsolicitedCsrConfig.Retention == 0 {
+		certSigner.unsolicitedCsrConfig.Retention = 7 * 24 * time.Hour
+	}
+	if certSigner.unsolicitedCsrConfig.Action == "" {
+		certSigner.unsolicitedCsrConfig.Action = "reject"
+	}
+	if certSigner.unsolicitedCsrConfig.Action != "reject" && certSigner.unsolicitedCsrConfig.Action != "clean" {
+		err = fmt.Errorf("UnsolicitedCsrs Action \"%s\" is unsupported", certSigner.unsolicitedCsrConfig.Action)
+		certSigner.log.Printf("Failed to set up handling of unsolicited CSRs: %s\n", err.Error())
+		return nil, err
+	}
+
+	certSigner.expiry = newExpiryMonitor(config.ExpiryWarnings)
+	if config.AuthorizationStore != "" {
+		certSigner.expiry.path = filepath.Join(filepath.Dir(config.AuthorizationStore), expiryWarningFile)
+		if err := certSigner.expiry.load(); err != nil {
+			certSigner.log.Printf("Unable to load the certificate expiry warnings sent from %s: %s\n", certSigner.expiry.path, err.Error())
+		}
+	}
+
+	certSigner.stopping = make(chan struct{})
+	certSigner.stoppedHousekeeping = make(chan struct{})
+	go certSigner.housekeeping()
 
 	// Set up csr watcher.
 	certSigner.csrWatcher = watcher
 	go certSigner.csrWatchWorker()
-	err := certSigner.csrWatcher.Add(puppetConfig.CsrDir)
+	err = certSigner.csrWatcher.Add(puppetConfig.CsrDir)
 	if err == nil {
 		certSigner.log.Printf("Watching for CSRs in %s\n", puppetConfig.CsrDir)
 
-		// Start one signing worker; these need to be one at a time for now.
-		go certSigner.signQueueWorker()
+		certSigner.startSigningWorkers(config.Workers)
+		certSigner.reconcileAuthorizations()
 	} else {
 		certSigner.log.Printf("Failed to set up watch for CSRs in %s: %s\n", puppetConfig.CsrDir, err.Error())
 	}
@@ -71,146 +187,319 @@ func NewCertSigner(puppetConfig puppetconfig.PuppetConfig, log *log.Logger, watc
 }
 
 func (ctx *CertSigner) Clean(hostname string) <-chan SigningResult {
-	resultChan := make(chan SigningResult, 1)
-	if ctx.stopped {
-		resultChan <- SigningResult{Action: "revoke", Success: false, Message: "The certificate signing manager has been stopped. Shutting down?"}
-		close(resultChan)
-		return resultChan
+	resultChan, err := ctx.QueueClean(hostname)
+	if err != nil {
+		return failedResultChan(err, "revoke")
 	}
+	return resultChan
+}
 
-	ctx.signQueue <- signChanMessage{
+// QueueClean is Clean, except that it returns ErrQueueFull or ErrStopped instead of a channel when the operation
+// could not be queued.
+func (ctx *CertSigner) QueueClean(hostname string) (<-chan SigningResult, error) {
+	resultChan := make(chan SigningResult, 1)
+	err := ctx.enqueue(signChanMessage{
 		certSubject:       hostname,
 		signCSR:           false,
 		cleanExistingCert: true,
 		resultChan:        resultChan,
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return resultChan
+	return resultChan, nil
 }
 
 // SigningResult channel will receive two messages if cleanExistingCert is true -
 // one when cert is cleaned and one when cert is signed
 func (ctx *CertSigner) Sign(hostname string, cleanExistingCert bool) <-chan SigningResult {
-	resultChan := make(chan SigningResult, 3)
-	if ctx.stopped {
+	return ctx.SignWithOptions(hostname, cleanExistingCert, SignOptions{})
+}
+
+// SignWithOptions is Sign, with constraints on the CSR that will be accepted for the hostname.
+func (ctx *CertSigner) SignWithOptions(hostname string, cleanExistingCert bool, options SignOptions) <-chan SigningResult {
+	resultChan, err := ctx.QueueSign(hostname, cleanExistingCert, options)
+	if err != nil {
 		if cleanExistingCert {
-			resultChan <- SigningResult{Action: "revoke", Success: false, Message: "The certificate signing manager has been stopped. Shutting down?"}
+			return failedResultChan(err, "revoke", "sign")
 		}
-		resultChan <- SigningResult{Action: "sign", Success: false, Message: "The certificate signing manager has been stopped. Shutting down?"}
-		close(resultChan)
-		return resultChan
+		return failedResultChan(err, "sign")
 	}
+	return resultChan
+}
 
-	ctx.signQueue <- signChanMessage{
+// QueueSign is SignWithOptions, except that it returns ErrQueueFull or ErrStopped instead of a channel when the
+// operation could not be queued.
+func (ctx *CertSigner) QueueSign(hostname string, cleanExistingCert bool, options SignOptions) (<-chan SigningResult, error) {
+	resultChan := make(chan SigningResult, 3)
+	err := ctx.enqueue(signChanMessage{
 		certSubject:       hostname,
 		signCSR:           true,
 		cleanExistingCert: cleanExistingCert,
+		options:           options,
 		resultChan:        resultChan,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resultChan, nil
+}
+
+// enqueue adds message to signQueue, waiting up to queueTimeout for room if it is full. Shutdown waits for it to
+// finish before signQueue is closed, and stops any wait.
+func (ctx *CertSigner) enqueue(message signChanMessage) error {
+	ctx.stoppedLock.RLock()
+	defer ctx.stoppedLock.RUnlock()
+	if ctx.stopped {
+		return ErrStopped
+	}
+	select {
+	case ctx.signQueue <- message:
+		return nil
+	default:
+	}
+	if ctx.queueTimeout <= 0 {
+		return ErrQueueFull
 	}
 
+	timer := time.NewTimer(ctx.queueTimeout)
+	defer timer.Stop()
+	select {
+	case ctx.signQueue <- message:
+		return nil
+	case <-timer.C:
+		return ErrQueueFull
+	case <-ctx.stopping:
+		return ErrStopped
+	}
+}
+
+// failedResultChan returns a closed channel holding a failed SigningResult for each of actions.
+func failedResultChan(err error, actions ...string) <-chan SigningResult {
+	resultChan := make(chan SigningResult, len(actions))
+	for _, action := range actions {
+		resultChan <- SigningResult{Action: action, Success: false, Message: err.Error()}
+	}
+	close(resultChan)
 	return resultChan
 }
 
 func (ctx *CertSigner) ProcessingBacklogLength() int {
-	return len(ctx.signQueue)
+	backlog := len(ctx.signQueue)
+	ctx.busySubjectsLock.Lock()
+	for _, waiting := range ctx.busySubjects {
+		backlog += len(waiting)
+	}
+	ctx.busySubjectsLock.Unlock()
+	return backlog
 }
 
 func (ctx *CertSigner) Shutdown() {
+	close(ctx.stopping)
+	// Operations still being admitted give up waiting once stopping is closed, and none are admitted after this,
+	// so signQueue can be closed safely.
+	ctx.stoppedLock.Lock()
 	ctx.stopped = true
+	ctx.stoppedLock.Unlock()
+	// Housekeeping may be queueing work, so it must stop before the queue is closed.
+	<-ctx.stoppedHousekeeping
 	ctx.csrWatcher.Close()
 	ctx.stoppedCsrWatcher <- struct{}{}
 	<-ctx.stoppedChan
 }
 
-func (ctx *CertSigner) signQueueWorker() {
-	for message, opened := <-ctx.signQueue; opened; message, opened = <-ctx.signQueue {
-		certExists := false
-		existingCertPath := fmt.Sprintf("%s/%s.pem", ctx.puppetConfig.SignedCertDir, message.certSubject)
-		fh, _ := ctx.openFileFunc(existingCertPath, os.O_RDONLY, 0660)
-		if fh != nil {
-			fh.Close()
-			certExists = true
+// startSigningWorkers starts count workers to carry out the messages in signQueue, and signals stoppedChan once
+// signQueue is closed and they have all finished.
+func (ctx *CertSigner) startSigningWorkers(count int) {
+	var workers sync.WaitGroup
+	workers.Add(count)
+	for i := 0; i < count; i++ {
+		go ctx.signQueueWorker(&workers)
+	}
+	go func() {
+		ctx.dispatchSignQueue()
+		workers.Wait()
+		// Signal stopped.
+		ctx.stoppedChan <- struct{}{}
+	}()
+}
+
+// dispatchSignQueue hands the messages in signQueue to the workers, except those for a subject a worker is already
+// busy with. That worker takes them next, so operations on one subject happen in order and never at the same time.
+func (ctx *CertSigner) dispatchSignQueue() {
+	for message := range ctx.signQueue {
+		ctx.busySubjectsLock.Lock()
+		waiting, busy := ctx.busySubjects[message.certSubject]
+		if busy {
+			ctx.busySubjects[message.certSubject] = append(waiting, message)
+		} else {
+			ctx.busySubjects[message.certSubject] = nil
 		}
+		ctx.busySubjectsLock.Unlock()
 
-		// Revoke existing certificate if present and requested.
-		if message.cleanExistingCert {
-			if certExists { // Looks like there's a cert to revoke.
-				ctx.log.Printf("Revoking existing certificate for %s...\n", message.certSubject)
-				// puppet cert clean appears to exit 0 on successfully signed, nonzero otherwise.
-				cleanCmd := ctx.cmdFactory("puppet", "cert", "clean", message.certSubject)
-				err := cleanCmd.Run()
-				if err != nil {
-					// So this is likely to cause the subsequent attempt to sign another certificate to fail,
-					// but instead of giving up now let's let the actual puppet CA be the authority on what
-					// it can sign.
-					ctx.log.Printf("Revocation of %s failed. *** Stdout:\n%s\n*** Stderr:\n%s\n", message.certSubject, ctx.lastCmdStdout.String(), ctx.lastCmdStderr.String())
-					ctx.actionDone("revoke", message, false, fmt.Sprintf("Revocation of %s failed.", message.certSubject))
-				} else {
-					var info string
-					if message.signCSR {
-						info = fmt.Sprintf("An existing certificate for %s was revoked to make way for the new certificate.", message.certSubject)
-					} else {
-						info = fmt.Sprintf("Existing certificate for %s was revoked.", message.certSubject)
-					}
-					ctx.notify(info)
-					ctx.log.Printf("Revoked %s.\n", message.certSubject)
-					ctx.actionDone("revoke", message, true, info)
-					certExists = false
-				}
-			} else {
-				ctx.log.Printf("No existing certificate found for %s\n", message.certSubject)
-				ctx.actionDone("revoke", message, true, fmt.Sprintf("No existing certificate for %s to revoke.", message.certSubject))
+		if !busy {
+			ctx.workQueue <- message
+		}
+	}
+	close(ctx.workQueue)
+}
+
+func (ctx *CertSigner) signQueueWorker(workers *sync.WaitGroup) {
+	defer workers.Done()
+	for message := range ctx.workQueue {
+		for {
+			ctx.processSignMessage(message)
+
+			var more bool
+			if message, more = ctx.nextForSubject(message.certSubject); !more {
+				break
 			}
 		}
+	}
+}
+
+// nextForSubject takes the next message held back for certSubject, or releases the subject if there are none.
+func (ctx *CertSigner) nextForSubject(certSubject string) (signChanMessage, bool) {
+	ctx.busySubjectsLock.Lock()
+	defer ctx.busySubjectsLock.Unlock()
+	waiting := ctx.busySubjects[certSubject]
+	if len(waiting) == 0 {
+		delete(ctx.busySubjects, certSubject)
+		return signChanMessage{}, false
+	}
+	ctx.busySubjects[certSubject] = waiting[1:]
+	return waiting[0], true
+}
+
+func (ctx *CertSigner) processSignMessage(message signChanMessage) {
+	if message.quarantine {
+		ctx.quarantineCsr(message.certSubject)
+		return
+	}
+	if message.resultChan == nil {
+		ctx.queuedCsrsLock.Lock()
+		delete(ctx.queuedCsrs, message.certSubject)
+		ctx.queuedCsrsLock.Unlock()
+	}
+
+	certExists := ctx.certExists(message.certSubject)
 
-		if message.signCSR {
-			temp := *ctx.authorizedCertSubjects
-			if message.resultChan != nil {
-				// This request came from an external caller.
-				// Authorize this certificate subject for signing if it pops up as a CSR later.
-				temp[message.certSubject] = message.resultChan
+	// Revoke existing certificate if present and requested.
+	if message.cleanExistingCert {
+		if certExists { // Looks like there's a cert to revoke.
+			ctx.log.Printf("Revoking existing certificate for %s...\n", message.certSubject)
+			err := ctx.backend.Clean(message.certSubject)
+			if err != nil {
+				// So this is likely to cause the subsequent attempt to sign another certificate to fail,
+				// but instead of giving up now let's let the actual puppet CA be the authority on what
+				// it can sign.
+				ctx.log.Printf("Revocation of %s failed. %s\n", message.certSubject, err.Error())
+				ctx.actionDone("revoke", message, false, fmt.Sprintf("Revocation of %s failed.", message.certSubject))
 			} else {
-				// This request came from the CSR watcher.
-				// We'll only process this Message if it is for a preauthorized subject with an available result channel.
-				_, present := temp[message.certSubject]
-				if !present {
-					continue
+				var info string
+				if message.signCSR {
+					info = fmt.Sprintf("An existing certificate for %s was revoked to make way for the new certificate.", message.certSubject)
+				} else {
+					info = fmt.Sprintf("Existing certificate for %s was revoked.", message.certSubject)
 				}
+				ctx.notify(info)
+				ctx.log.Printf("Revoked %s.\n", message.certSubject)
+				ctx.actionDone("revoke", message, true, info)
+				certExists = false
 			}
+		} else {
+			ctx.log.Printf("No existing certificate found for %s\n", message.certSubject)
+			ctx.actionDone("revoke", message, true, fmt.Sprintf("No existing certificate for %s to revoke.", message.certSubject))
+		}
+	}
 
-			// Try to sign the certificate.
-			// puppet cert sign appears to exit 0 on successfully signed, nonzero otherwise.
-			signCmd := ctx.cmdFactory("puppet", "cert", "sign", message.certSubject)
-			err := signCmd.Run()
-			if err != nil {
-				// If it was because the cert is not present, the CSR watcher will get it later.
-				stderr := ctx.lastCmdStderr.String()
-				if strings.Contains(stderr, fmt.Sprintf("Could not find CSR for: \"%s\"", message.certSubject)) {
-					info := fmt.Sprintf("Certificate for \"%s\" will be signed when a matching CSR arrives.", message.certSubject)
-					ctx.notify(info)
-					ctx.log.Printf("%s\n", info)
+	if message.signCSR {
+		if message.resultChan != nil {
+			// This request came from an external caller.
+			// Authorize this certificate subject for signing if it pops up as a CSR later.
+			ctx.authorize(message)
+		} else {
+			// Don't honor an authorization that has lapsed but not been reaped yet.
+			ctx.reapExpiredAuthorizations()
+		}
+		// CSR watcher messages are only processed if they are for a preauthorized subject with an available
+		// result channel.
+		authorization, present := ctx.authorization(message.certSubject)
+		if !present {
+			// A CSR nobody asked for may still be allowed by a standing signing policy. Events for CSRs that
+			// have since been dealt with are disregarded.
+			if message.resultChan == nil && ctx.csrExists(message.certSubject) {
+				if policy := ctx.matchingPolicy(message.certSubject); policy != nil {
+					ctx.signByPolicy(message.certSubject, policy)
 				} else {
-					ctx.log.Printf("Certificate signing for %s failed. *** Stdout:\n%s\n*** Stderr:\n%s\n", message.certSubject, ctx.lastCmdStdout.String(), stderr)
-					var info string
-					if certExists {
-						info = "Certificate signing for \"%s\" failed -- looks like there's already a signed cert for that host."
-					} else {
-						info = "Certificate signing for \"%s\" failed! More info in log."
-					}
-					ctx.notify(fmt.Sprintf(info, message.certSubject))
-					ctx.actionDone("sign", message, false, fmt.Sprintf(info, message.certSubject))
+					ctx.unsolicitedCsrArrived(message.certSubject)
 				}
-			} else {
-				info := fmt.Sprintf("Certificate for \"%s\" has been signed.", message.certSubject)
-				ctx.actionDone("sign", message, true, info)
+			}
+			return
+		}
+		if message.resultChan == nil && authorization.autosigned {
+			// The CA is signing this one itself, per its autosign check.
+			return
+		}
+
+		// Make sure the CSR is the one the authorization was meant for, then try to sign the certificate.
+		dnsAltNames, err := ctx.verifyCsr(message.certSubject, authorization.options)
+		if mismatch, ok := err.(csrMismatch); ok {
+			ctx.rejectMismatchedCsr(message.certSubject, mismatch)
+			return
+		}
+		if err == nil {
+			err = ctx.signCsr(message.certSubject, dnsAltNames)
+		} else if err != ErrCsrNotFound {
+			info := fmt.Sprintf("Refusing to sign certificate for \"%s\": %s.", message.certSubject, err.Error())
+			ctx.notify(info)
+			ctx.log.Println(info)
+			ctx.actionDone("sign", message, false, info)
+			return
+		}
+		if err != nil {
+			// If it was because the cert is not present, the CSR watcher will get it later.
+			if err == ErrCsrNotFound {
+				info := fmt.Sprintf("Certificate for \"%s\" will be signed when a matching CSR arrives.", message.certSubject)
 				ctx.notify(info)
-				ctx.log.Println(info)
+				ctx.log.Printf("%s\n", info)
+			} else {
+				ctx.log.Printf("Certificate signing for %s failed. %s\n", message.certSubject, err.Error())
+				var info string
+				if certExists {
+					info = "Certificate signing for \"%s\" failed -- looks like there's already a signed cert for that host."
+				} else {
+					info = "Certificate signing for \"%s\" failed! More info in log."
+				}
+				ctx.notify(fmt.Sprintf(info, message.certSubject))
+				ctx.actionDone("sign", message, false, fmt.Sprintf(info, message.certSubject))
 			}
+		} else {
+			info := fmt.Sprintf("Certificate for \"%s\" has been signed.", message.certSubject)
+			ctx.recordSigning(message.certSubject, SigningRecord{Signed: ctx.now(), RequestedBy: authorization.options.RequestedBy})
+			ctx.actionDone("sign", message, true, info)
+			ctx.notify(info)
+			ctx.log.Println(info)
 		}
 	}
+}
 
-	// Signal stopped.
-	ctx.stoppedChan <- struct{}{}
+func (ctx *CertSigner) housekeeping() {
+	ticker := time.NewTicker(housekeepingInterval)
+	defer ticker.Stop()
+	defer close(ctx.stoppedHousekeeping)
+	for {
+		select {
+		case <-ticker.C:
+			ctx.reapExpiredAuthorizations()
+			ctx.requeueOverflowedCsrs()
+			ctx.pruneUnsolicitedCsrs()
+			ctx.queueQuarantines()
+			ctx.checkExpiryIfDue()
+		case <-ctx.stopping:
+			return
+		}
+	}
 }
 
 func (ctx *CertSigner) csrWatchWorker() {
@@ -221,13 +510,7 @@ func (ctx *CertSigner) csrWatchWorker() {
 				csrName := path.Base(event.Name)
 				extensionIx := strings.LastIndex(csrName, ".")
 				if extensionIx > 0 {
-					subject := csrName[:extensionIx]
-					ctx.signQueue <- signChanMessage{
-						certSubject:       subject,
-						signCSR:           true,
-						cleanExistingCert: false, // Would have been done already.
-						resultChan:        nil,   // Will cause signQueueWorker to only proceed if subject has been authorized.
-					}
+					ctx.queueCsr(csrName[:extensionIx])
 				}
 			}
 		case err := <-ctx.csrWatcher.Errors:
@@ -239,20 +522,147 @@ func (ctx *CertSigner) csrWatchWorker() {
 	}
 }
 
-func (ctx *CertSigner) puppetCmdFactory(name string, arg ...string) *exec.Cmd {
-	if name == "puppet" {
-		name = ctx.puppetConfig.PuppetExecutable
-		// Need to pass these for non-root puppet cli to act on puppet master file locations :|
-		origArg := arg
-		arg = []string{origArg[0], "--config", "/etc/puppetlabs/puppet/puppet.conf", "--confdir", "/etc/puppetlabs/puppet"}
-		arg = append(arg, origArg[1:]...)
+// queueCsr has the signing worker consider a CSR that has arrived for certSubject, unless it is already queued.
+// Watchers often report one CSR more than once, e.g. as both created and written. When the queue is full, the CSR
+// is set aside for housekeeping to queue later rather than holding up the watcher.
+func (ctx *CertSigner) queueCsr(certSubject string) {
+	ctx.queuedCsrsLock.Lock()
+	defer ctx.queuedCsrsLock.Unlock()
+	if ctx.queuedCsrs[certSubject] {
+		return
+	}
+
+	select {
+	case ctx.signQueue <- signChanMessage{
+		certSubject:       certSubject,
+		signCSR:           true,
+		cleanExistingCert: false, // Would have been done already.
+		resultChan:        nil,   // Will cause signQueueWorker to only proceed if subject has been authorized.
+	}:
+		ctx.queuedCsrs[certSubject] = true
+		delete(ctx.overflowedCsrs, certSubject)
+	default:
+		if !ctx.overflowedCsrs[certSubject] {
+			ctx.log.Printf("The certificate signing queue is full; the CSR for %s will be considered later.\n", certSubject)
+		}
+		ctx.overflowedCsrs[certSubject] = true
+	}
+}
+
+// requeueOverflowedCsrs tries again to queue the CSRs that queueCsr found no room for.
+func (ctx *CertSigner) requeueOverflowedCsrs() {
+	ctx.queuedCsrsLock.Lock()
+	subjects := make([]string, 0, len(ctx.overflowedCsrs))
+	for subject := range ctx.overflowedCsrs {
+		subjects = append(subjects, subject)
 	}
-	cmd := exec.Command(name, arg...)
-	ctx.lastCmdStdout = &bytes.Buffer{}
-	ctx.lastCmdStderr = &bytes.Buffer{}
-	cmd.Stdout = ctx.lastCmdStdout
-	cmd.Stderr = ctx.lastCmdStderr
-	return cmd
+	ctx.queuedCsrsLock.Unlock()
+
+	for _, subject := range subjects {
+		ctx.queueCsr(subject)
+	}
+}
+
+func (ctx *CertSigner) certExists(certSubject string) bool {
+	if checker, ok := ctx.backend.(signedCertChecker); ok {
+		exists, err := checker.HasSignedCert(certSubject)
+		if err != nil {
+			ctx.log.Printf("Unable to determine whether a certificate exists for %s: %s\n", certSubject, err.Error())
+		}
+		return exists
+	}
+
+	existingCertPath := fmt.Sprintf("%s/%s.pem", ctx.puppetConfig.SignedCertDir, certSubject)
+	fh, _ := ctx.openFileFunc(existingCertPath, os.O_RDONLY, 0660)
+	if fh != nil {
+		fh.Close()
+		return true
+	}
+	return false
+}
+
+// signedCertFingerprint identifies the certificate currently signed for certSubject, so that a newly signed one
+// can be told from one that was already there. It returns "" if there is none.
+func (ctx *CertSigner) signedCertFingerprint(certSubject string) string {
+	if checker, ok := ctx.backend.(signedCertChecker); ok {
+		fingerprint, err := checker.SignedCertFingerprint(certSubject)
+		if err != nil {
+			ctx.log.Printf("Unable to determine whether a certificate exists for %s: %s\n", certSubject, err.Error())
+		}
+		return fingerprint
+	}
+
+	existingCertPath := fmt.Sprintf("%s/%s.pem", ctx.puppetConfig.SignedCertDir, certSubject)
+	fh, _ := ctx.openFileFunc(existingCertPath, os.O_RDONLY, 0660)
+	if fh == nil {
+		return ""
+	}
+	defer fh.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fh); err != nil {
+		ctx.log.Printf("Unable to read the certificate for %s: %s\n", certSubject, err.Error())
+	}
+	return fmt.Sprintf("%X", hash.Sum(nil))
+}
+
+// csrMismatch is why a CSR is not one the authorization for its subject can be used for. Anything able to reach the
+// CA can submit a CSR for any subject, so such a CSR is rejected without withdrawing the authorization, which is
+// left for the host's own CSR.
+type csrMismatch struct {
+	error
+}
+
+// verifyCsr checks the pending CSR for certSubject against the attributes it was expected to carry and the DNS alt
+// name policy, returning the alt names it requests, which are all allowed and which the backend can sign. The CSR
+// failing any of those checks is reported as a csrMismatch.
+func (ctx *CertSigner) verifyCsr(certSubject string, options SignOptions) ([]string, error) {
+	csr, err := ctx.fetchCsr(certSubject)
+	if err == ErrCsrNotFound && options.ExpectedAttributes.IsEmpty() {
+		// Let the backend be the judge of whether there is a CSR to sign. Without approved alt names, it will
+		// refuse any the CSR has.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := options.ExpectedAttributes.Verify(csr); err != nil {
+		return nil, csrMismatch{err}
+	}
+	dnsAltNames, err := ctx.checkDnsAltNames(certSubject, csr, options.DnsAltNames)
+	if err != nil {
+		return nil, csrMismatch{err}
+	}
+	if _, ok := ctx.backend.(dnsAltNameSigner); len(dnsAltNames) > 0 && !ok {
+		return nil, csrMismatch{errDnsAltNamesUnsupported}
+	}
+	return dnsAltNames, nil
+}
+
+// rejectMismatchedCsr gets rid of the CSR for certSubject, which the subject's pending authorization can't be used
+// for, so that the host can submit another, and reports the refusal.
+func (ctx *CertSigner) rejectMismatchedCsr(certSubject string, mismatch csrMismatch) {
+	info := fmt.Sprintf("Refusing to sign certificate for \"%s\": %s.", certSubject, mismatch.Error())
+	if err := ctx.rejectCsr(certSubject); err != nil {
+		ctx.log.Printf("Rejecting the refused CSR for %s failed. %s\n", certSubject, err.Error())
+		info += " The CSR could not be rejected; more info in log."
+	} else {
+		info += " The CSR was rejected, and the authorization remains pending for a CSR that matches."
+	}
+	ctx.notify(info)
+	ctx.log.Println(info)
+}
+
+func (ctx *CertSigner) csrExists(certSubject string) bool {
+	_, err := ctx.fetchCsr(certSubject)
+	return err != ErrCsrNotFound
+}
+
+// fetchCsr gets the pending CSR for certSubject, or ErrCsrNotFound.
+func (ctx *CertSigner) fetchCsr(certSubject string) (*x509.CertificateRequest, error) {
+	if fetcher, ok := ctx.backend.(csrFetcher); ok {
+		return fetcher.FetchCsr(certSubject)
+	}
+	return readCsrFile(filepath.Join(ctx.puppetConfig.CsrDir, certSubject+".pem"))
 }
 
 func (ctx *CertSigner) notify(message string) {
@@ -263,12 +673,8 @@ func (ctx *CertSigner) notify(message string) {
 func (ctx *CertSigner) actionDone(action string, entry signChanMessage, success bool, message string) {
 	resultChan := entry.resultChan
 	if action == "sign" {
-		temp := *ctx.authorizedCertSubjects
-		tempChan, present := temp[entry.certSubject]
-		if present {
-			resultChan = tempChan
-			delete(temp, entry.certSubject)
-		}
+		// The authorization may have been cancelled or expired meanwhile, in which case its channel is already closed.
+		resultChan = ctx.takeAuthorization(entry.certSubject)
 	}
 	if resultChan != nil {
 		resultChan <- SigningResult{
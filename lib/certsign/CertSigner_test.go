@@ -56,11 +56,12 @@ func sutFactory(watcher *interfaces.FsnotifyWatcher, notifyCallback func(message
 		notifyCallback = func(message string) {}
 	}
 
-	sut, err := NewCertSigner(puppetConfig, testlog, watcher, notifyCallback)
+	sut, err := NewCertSigner(puppetConfig, CertSignerConfig{}, testlog, watcher, notifyCallback)
 
 	// Install test cmdFactory
 	if execMocks != nil {
-		sut.cmdFactory = func(name string, arg ...string) *exec.Cmd {
+		backend := sut.backend.(*puppetCertBackend)
+		backend.cmdFactory = func(name string, arg ...string) *exec.Cmd {
 			run := execMocks[0]
 			if len(execMocks) > 1 {
 				execMocks = execMocks[1:]
@@ -71,10 +72,8 @@ func sutFactory(watcher *interfaces.FsnotifyWatcher, notifyCallback func(message
 				cs = append(cs, arg...)
 				cmd := exec.Command(os.Args[0], cs...)
 				cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
-				sut.lastCmdStdout = &bytes.Buffer{}
-				sut.lastCmdStderr = &bytes.Buffer{}
-				cmd.Stdout = sut.lastCmdStdout
-				cmd.Stderr = sut.lastCmdStderr
+				cmd.Stdout = &bytes.Buffer{}
+				cmd.Stderr = &bytes.Buffer{}
 				return cmd
 			}
 
@@ -574,6 +573,214 @@ func TestCertSigner_ProcessingBacklogLength(t *testing.T) {
 	stallChan <- struct{}{}
 }
 
+// blockingBackend reports each operation on started, then waits for release.
+type blockingBackend struct {
+	started chan string
+	release chan struct{}
+}
+
+func (ctx *blockingBackend) Sign(certSubject string) error {
+	ctx.started <- "sign " + certSubject
+	<-ctx.release
+	return nil
+}
+
+func (ctx *blockingBackend) Clean(certSubject string) error {
+	ctx.started <- "clean " + certSubject
+	<-ctx.release
+	return nil
+}
+
+func TestCertSigner_Workers_SerializePerSubject(t *testing.T) {
+	puppetConfig := puppetconfig.PuppetConfig{CsrDir: "/testssl/csr", SignedCertDir: "/testssl/cert"}
+	watcher := &interfaces.FsnotifyWatcher{
+		Add:    func(name string) error { return nil },
+		Close:  func() error { return nil },
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	sut, err := NewCertSigner(puppetConfig, CertSignerConfig{Workers: 2}, log.New(&bytes.Buffer{}, "", 0), watcher, func(message string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &blockingBackend{started: make(chan string, 3), release: make(chan struct{})}
+	sut.backend = backend
+	sut.openFileFunc = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return os.Open(os.DevNull)
+	}
+
+	results := []<-chan SigningResult{sut.Clean("a.bar.com"), sut.Clean("a.bar.com"), sut.Clean("b.bar.com")}
+
+	// Different subjects run at the same time.
+	started := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case operation := <-backend.started:
+			started[operation] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected two operations to run at once, got %v", started)
+		}
+	}
+	if !started["clean a.bar.com"] || !started["clean b.bar.com"] {
+		t.Errorf("Expected a.bar.com and b.bar.com to be cleaned at once, got %v", started)
+	}
+
+	// The second operation on a.bar.com waits for the first.
+	select {
+	case operation := <-backend.started:
+		t.Errorf("Unexpected operation %s while another for the same subject was running", operation)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if backlog := sut.ProcessingBacklogLength(); backlog != 1 {
+		t.Errorf("Expected a backlog of 1, got %d", backlog)
+	}
+
+	close(backend.release)
+	for _, resultChan := range results {
+		if result := <-resultChan; !result.Success {
+			t.Errorf("Unexpected failure %+v", result)
+		}
+	}
+	if operation := <-backend.started; operation != "clean a.bar.com" {
+		t.Errorf("Expected the held back clean of a.bar.com to run, got %s", operation)
+	}
+	sut.Shutdown()
+}
+
+func TestCertSigner_QueueFull(t *testing.T) {
+	puppetConfig := puppetconfig.PuppetConfig{CsrDir: "/testssl/csr", SignedCertDir: "/testssl/cert"}
+	watcher := &interfaces.FsnotifyWatcher{
+		Add:    func(name string) error { return nil },
+		Close:  func() error { return nil },
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	sut, err := NewCertSigner(puppetConfig, CertSignerConfig{QueueSize: 1}, log.New(&bytes.Buffer{}, "", 0), watcher, func(message string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &blockingBackend{started: make(chan string, 3), release: make(chan struct{})}
+	sut.backend = backend
+	sut.openFileFunc = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return os.Open(os.DevNull)
+	}
+
+	// a.bar.com occupies the worker, b.bar.com waits to be dispatched to it, and c.bar.com fills the queue.
+	results := []<-chan SigningResult{sut.Clean("a.bar.com")}
+	<-backend.started
+	results = append(results, sut.Clean("b.bar.com"))
+	for deadline := time.Now().Add(5 * time.Second); len(sut.signQueue) > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	results = append(results, sut.Clean("c.bar.com"))
+
+	if _, err := sut.QueueClean("d.bar.com"); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	result := <-sut.Sign("d.bar.com", true)
+	if result.Success || result.Action != "revoke" || result.Message != ErrQueueFull.Error() {
+		t.Errorf("Expected a failed revoke result, got %+v", result)
+	}
+
+	sut.queueTimeout = 50 * time.Millisecond
+	started := time.Now()
+	result = <-sut.Clean("d.bar.com")
+	if result.Success || time.Since(started) < 50*time.Millisecond {
+		t.Errorf("Expected a failure after waiting 50ms for room, got %+v after %s", result, time.Since(started))
+	}
+
+	close(backend.release)
+	for _, resultChan := range results {
+		if result := <-resultChan; !result.Success {
+			t.Errorf("Unexpected failure %+v", result)
+		}
+	}
+	sut.Shutdown()
+}
+
+func TestCertSigner_Shutdown_WhileWaitingForRoom(t *testing.T) {
+	puppetConfig := puppetconfig.PuppetConfig{CsrDir: "/testssl/csr", SignedCertDir: "/testssl/cert"}
+	watcher := &interfaces.FsnotifyWatcher{
+		Add:    func(name string) error { return nil },
+		Close:  func() error { return nil },
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	sut, err := NewCertSigner(puppetConfig, CertSignerConfig{QueueSize: 1, QueueTimeout: time.Minute}, log.New(&bytes.Buffer{}, "", 0), watcher, func(message string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &blockingBackend{started: make(chan string, 3), release: make(chan struct{})}
+	sut.backend = backend
+	sut.openFileFunc = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return os.Open(os.DevNull)
+	}
+
+	// Fill the queue as in TestCertSigner_QueueFull, so that d.bar.com has to wait for room.
+	results := []<-chan SigningResult{sut.Clean("a.bar.com")}
+	<-backend.started
+	results = append(results, sut.Clean("b.bar.com"))
+	for deadline := time.Now().Add(5 * time.Second); len(sut.signQueue) > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	results = append(results, sut.Clean("c.bar.com"))
+
+	waiting := make(chan error)
+	go func() {
+		_, err := sut.QueueClean("d.bar.com")
+		waiting <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		sut.Shutdown()
+		close(stopped)
+	}()
+	select {
+	case err := <-waiting:
+		if err != ErrStopped {
+			t.Errorf("Expected ErrStopped, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("An operation waiting for room was not stopped by Shutdown.")
+	}
+
+	close(backend.release)
+	for _, resultChan := range results {
+		<-resultChan
+	}
+	<-stopped
+	if _, err := sut.QueueClean("e.bar.com"); err != ErrStopped {
+		t.Errorf("Expected ErrStopped after Shutdown, got %v", err)
+	}
+}
+
+func TestCertSigner_QueueCsr_RetriesWhenFull(t *testing.T) {
+	var logBuf bytes.Buffer
+	sut := &CertSigner{
+		signQueue:      make(chan signChanMessage, 1),
+		queuedCsrs:     make(map[string]bool),
+		overflowedCsrs: make(map[string]bool),
+		log:            log.New(&logBuf, "", 0),
+	}
+
+	sut.queueCsr("foo.bar.com")
+	sut.queueCsr("baz.bar.com")
+	if !sut.overflowedCsrs["baz.bar.com"] || !strings.Contains(logBuf.String(), "the CSR for baz.bar.com will be considered later") {
+		t.Error("CSR that didn't fit in the queue was not set aside.")
+	}
+
+	<-sut.signQueue
+	sut.requeueOverflowedCsrs()
+	if message := <-sut.signQueue; message.certSubject != "baz.bar.com" {
+		t.Errorf("Expected the set aside CSR to be queued, got %s", message.certSubject)
+	}
+	if len(sut.overflowedCsrs) != 0 {
+		t.Error("Queued CSR is still set aside.")
+	}
+}
+
 // Mock process exec bodies
 func TestHelperPuppetSignOk(t *testing.T) {
 	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
@@ -0,0 +1,184 @@
+package certsign
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+
+// Puppet's short names for its registered certificate extension OIDs, as used in csr_attributes.yaml.
+var puppetExtensionOids = map[string]asn1.ObjectIdentifier{
+	"pp_uuid":             {1, 3, 6, 1, 4, 1, 34380, 1, 1, 1},
+	"pp_instance_id":      {1, 3, 6, 1, 4, 1, 34380, 1, 1, 2},
+	"pp_image_name":       {1, 3, 6, 1, 4, 1, 34380, 1, 1, 3},
+	"pp_preshared_key":    {1, 3, 6, 1, 4, 1, 34380, 1, 1, 4},
+	"pp_cost_center":      {1, 3, 6, 1, 4, 1, 34380, 1, 1, 5},
+	"pp_product":          {1, 3, 6, 1, 4, 1, 34380, 1, 1, 6},
+	"pp_project":          {1, 3, 6, 1, 4, 1, 34380, 1, 1, 7},
+	"pp_application":      {1, 3, 6, 1, 4, 1, 34380, 1, 1, 8},
+	"pp_service":          {1, 3, 6, 1, 4, 1, 34380, 1, 1, 9},
+	"pp_employee":         {1, 3, 6, 1, 4, 1, 34380, 1, 1, 10},
+	"pp_created_by":       {1, 3, 6, 1, 4, 1, 34380, 1, 1, 11},
+	"pp_environment":      {1, 3, 6, 1, 4, 1, 34380, 1, 1, 12},
+	"pp_role":             {1, 3, 6, 1, 4, 1, 34380, 1, 1, 13},
+	"pp_software_version": {1, 3, 6, 1, 4, 1, 34380, 1, 1, 14},
+	"pp_department":       {1, 3, 6, 1, 4, 1, 34380, 1, 1, 15},
+	"pp_cluster":          {1, 3, 6, 1, 4, 1, 34380, 1, 1, 16},
+	"pp_provisioner":      {1, 3, 6, 1, 4, 1, 34380, 1, 1, 17},
+	"pp_region":           {1, 3, 6, 1, 4, 1, 34380, 1, 1, 18},
+	"pp_datacenter":       {1, 3, 6, 1, 4, 1, 34380, 1, 1, 19},
+	"pp_zone":             {1, 3, 6, 1, 4, 1, 34380, 1, 1, 20},
+	"pp_network":          {1, 3, 6, 1, 4, 1, 34380, 1, 1, 21},
+	"pp_securitypolicy":   {1, 3, 6, 1, 4, 1, 34380, 1, 1, 22},
+	"pp_cloudplatform":    {1, 3, 6, 1, 4, 1, 34380, 1, 1, 23},
+	"pp_apptier":          {1, 3, 6, 1, 4, 1, 34380, 1, 1, 24},
+	"pp_hostname":         {1, 3, 6, 1, 4, 1, 34380, 1, 1, 25},
+	"pp_owner":            {1, 3, 6, 1, 4, 1, 34380, 1, 1, 26},
+	"pp_authorization":    {1, 3, 6, 1, 4, 1, 34380, 1, 3, 1},
+	"pp_auth_role":        {1, 3, 6, 1, 4, 1, 34380, 1, 3, 13},
+}
+
+// CsrAttributes are values a CSR is expected to carry before it may be signed. Empty values are not checked.
+type CsrAttributes struct {
+	ChallengePassword string
+	// Expected values of puppet extension requests, keyed by short name such as pp_uuid.
+	Extensions map[string]string
+	// Hex SHA-256 digest of the DER-encoded SubjectPublicKeyInfo. Colons and case are ignored.
+	PublicKeyFingerprint string
+}
+
+// IsKnownExtensionName reports whether name is one of puppet's pp_* extension short names.
+func IsKnownExtensionName(name string) bool {
+	_, known := puppetExtensionOids[name]
+	return known
+}
+
+// PublicKeyFingerprint computes the fingerprint CsrAttributes.PublicKeyFingerprint is compared against.
+func PublicKeyFingerprint(csr *x509.CertificateRequest) string {
+	sum := sha256.Sum256(csr.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+func (ctx *CsrAttributes) IsEmpty() bool {
+	return ctx == nil || (ctx.ChallengePassword == "" && len(ctx.Extensions) == 0 && ctx.PublicKeyFingerprint == "")
+}
+
+// Names lists which attributes are expected, without their values.
+func (ctx *CsrAttributes) Names() []string {
+	if ctx.IsEmpty() {
+		return nil
+	}
+	var names []string
+	if ctx.ChallengePassword != "" {
+		names = append(names, "challenge-password")
+	}
+	var extensionNames []string
+	for name := range ctx.Extensions {
+		extensionNames = append(extensionNames, name)
+	}
+	sort.Strings(extensionNames)
+	names = append(names, extensionNames...)
+	if ctx.PublicKeyFingerprint != "" {
+		names = append(names, "public-key-fingerprint")
+	}
+	return names
+}
+
+// Verify returns an error describing the first way in which csr does not carry the expected attributes.
+func (ctx *CsrAttributes) Verify(csr *x509.CertificateRequest) error {
+	if ctx.IsEmpty() {
+		return nil
+	}
+
+	if ctx.ChallengePassword != "" {
+		actual, err := challengePassword(csr)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(actual), []byte(ctx.ChallengePassword)) != 1 {
+			return fmt.Errorf("CSR challengePassword does not match")
+		}
+	}
+
+	// Checked in a stable order so the reported mismatch is deterministic.
+	names := make([]string, 0, len(ctx.Extensions))
+	for name := range ctx.Extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oid, known := puppetExtensionOids[name]
+		if !known {
+			return fmt.Errorf("%s is not a known puppet extension", name)
+		}
+		actual, present := extensionRequestValue(csr, oid)
+		if !present {
+			return fmt.Errorf("CSR lacks the %s extension", name)
+		}
+		if subtle.ConstantTimeCompare([]byte(actual), []byte(ctx.Extensions[name])) != 1 {
+			return fmt.Errorf("CSR %s \"%s\" does not match", name, actual)
+		}
+	}
+
+	if ctx.PublicKeyFingerprint != "" {
+		expect := strings.ToLower(strings.Replace(ctx.PublicKeyFingerprint, ":", "", -1))
+		if PublicKeyFingerprint(csr) != expect {
+			return fmt.Errorf("CSR public key fingerprint %s does not match", PublicKeyFingerprint(csr))
+		}
+	}
+
+	return nil
+}
+
+func extensionRequestValue(csr *x509.CertificateRequest, oid asn1.ObjectIdentifier) (string, bool) {
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal(oid) {
+			// Puppet encodes extension request values as DER strings; fall back to the raw bytes otherwise.
+			var value string
+			if _, err := asn1.Unmarshal(ext.Value, &value); err == nil {
+				return value, true
+			}
+			return string(ext.Value), true
+		}
+	}
+	return "", false
+}
+
+// challengePassword digs the challengePassword attribute out of the raw CSR, since x509.CertificateRequest only
+// parses extension request attributes.
+func challengePassword(csr *x509.CertificateRequest) (string, error) {
+	var tbsCsr struct {
+		Version       int
+		Subject       asn1.RawValue
+		PublicKey     asn1.RawValue
+		RawAttributes []asn1.RawValue `asn1:"tag:0"`
+	}
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbsCsr); err != nil {
+		return "", fmt.Errorf("CSR could not be parsed: %s", err.Error())
+	}
+
+	for _, rawAttribute := range tbsCsr.RawAttributes {
+		var attribute struct {
+			Type   asn1.ObjectIdentifier
+			Values []asn1.RawValue `asn1:"set"`
+		}
+		if _, err := asn1.Unmarshal(rawAttribute.FullBytes, &attribute); err != nil {
+			continue
+		}
+		if attribute.Type.Equal(oidChallengePassword) && len(attribute.Values) > 0 {
+			var password string
+			if _, err := asn1.Unmarshal(attribute.Values[0].FullBytes, &password); err != nil {
+				return "", fmt.Errorf("CSR challengePassword could not be parsed: %s", err.Error())
+			}
+			return password, nil
+		}
+	}
+	return "", fmt.Errorf("CSR lacks a challengePassword")
+}
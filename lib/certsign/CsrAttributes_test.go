@@ -0,0 +1,186 @@
+package certsign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
+)
+
+// testCsrPem assembles a CSR by hand, because x509.CreateCertificateRequest can't produce a challengePassword.
+func testCsrPem(t *testing.T, subject string, challengePassword string, extensions map[string]string) []byte {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	type attribute struct {
+		Type   asn1.ObjectIdentifier
+		Values []asn1.RawValue `asn1:"set"`
+	}
+	var rawAttributes []asn1.RawValue
+	if challengePassword != "" {
+		passwordDer, _ := asn1.MarshalWithParams(challengePassword, "utf8")
+		attributeDer, _ := asn1.Marshal(attribute{Type: oidChallengePassword, Values: []asn1.RawValue{{FullBytes: passwordDer}}})
+		rawAttributes = append(rawAttributes, asn1.RawValue{FullBytes: attributeDer})
+	}
+	if len(extensions) > 0 {
+		var pkixExtensions []pkix.Extension
+		for name, value := range extensions {
+			valueDer, _ := asn1.MarshalWithParams(value, "utf8")
+			pkixExtensions = append(pkixExtensions, pkix.Extension{Id: puppetExtensionOids[name], Value: valueDer})
+		}
+		extensionsDer, _ := asn1.Marshal(pkixExtensions)
+		attributeDer, _ := asn1.Marshal(attribute{Type: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 14}, Values: []asn1.RawValue{{FullBytes: extensionsDer}}})
+		rawAttributes = append(rawAttributes, asn1.RawValue{FullBytes: attributeDer})
+	}
+
+	subjectDer, _ := asn1.Marshal(pkix.Name{CommonName: subject}.ToRDNSequence())
+	publicKeyDer, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	tbsDer, err := asn1.Marshal(struct {
+		Version       int
+		Subject       asn1.RawValue
+		PublicKey     asn1.RawValue
+		RawAttributes []asn1.RawValue `asn1:"tag:0"`
+	}{0, asn1.RawValue{FullBytes: subjectDer}, asn1.RawValue{FullBytes: publicKeyDer}, rawAttributes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(tbsDer)
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	csrDer, err := asn1.Marshal(struct {
+		Raw                asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          asn1.BitString
+	}{
+		asn1.RawValue{FullBytes: tbsDer},
+		pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, Parameters: asn1.NullRawValue},
+		asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDer})
+}
+
+func parseTestCsr(t *testing.T, csrPem []byte) *x509.CertificateRequest {
+	block, _ := pem.Decode(csrPem)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestCsrAttributes_Verify(t *testing.T) {
+	csr := parseTestCsr(t, testCsrPem(t, "foo.bar.com", "s3cret", map[string]string{"pp_uuid": "1234", "pp_role": "web"}))
+
+	sut := CsrAttributes{
+		ChallengePassword:    "s3cret",
+		Extensions:           map[string]string{"pp_uuid": "1234", "pp_role": "web"},
+		PublicKeyFingerprint: strings.ToUpper(PublicKeyFingerprint(csr)),
+	}
+	if err := sut.Verify(csr); err != nil {
+		t.Errorf("Expected matching CSR to verify, got %s", err.Error())
+	}
+
+	mismatches := []struct {
+		attributes CsrAttributes
+		expect     string
+	}{
+		{CsrAttributes{ChallengePassword: "wrong"}, "CSR challengePassword does not match"},
+		{CsrAttributes{Extensions: map[string]string{"pp_uuid": "5678"}}, "CSR pp_uuid \"1234\" does not match"},
+		{CsrAttributes{Extensions: map[string]string{"pp_instance_id": "i-1"}}, "CSR lacks the pp_instance_id extension"},
+		{CsrAttributes{PublicKeyFingerprint: "00:11"}, "CSR public key fingerprint"},
+	}
+	for _, mismatch := range mismatches {
+		err := mismatch.attributes.Verify(csr)
+		if err == nil || !strings.Contains(err.Error(), mismatch.expect) {
+			t.Errorf("Expected verification error \"%s\", got %v", mismatch.expect, err)
+		}
+	}
+}
+
+func TestCsrAttributes_Verify_MissingChallengePassword(t *testing.T) {
+	csr := parseTestCsr(t, testCsrPem(t, "foo.bar.com", "", nil))
+	sut := CsrAttributes{ChallengePassword: "s3cret"}
+	if err := sut.Verify(csr); err == nil || err.Error() != "CSR lacks a challengePassword" {
+		t.Errorf("Expected missing challengePassword error, got %v", err)
+	}
+}
+
+func TestCertSigner_Sign_RefusesMismatchedCsr(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	csrPath := filepath.Join(cfg.CsrDir, "foo.bar.com.pem")
+	ioutil.WriteFile(csrPath, testCsrPem(t, "foo.bar.com", "rogue", nil), 0644)
+
+	notified := make(chan string, 5)
+	watcher := &interfaces.FsnotifyWatcher{
+		Add:    func(name string) error { return nil },
+		Close:  func() error { return nil },
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	sut, err := NewCertSigner(*cfg, CertSignerConfig{Backend: "native"}, log.New(&bytes.Buffer{}, "", 0), watcher, func(message string) {
+		notified <- message
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sut.Shutdown()
+
+	// Another machine's CSR for the subject is rejected, but doesn't use up the authorization.
+	resultChan := sut.SignWithOptions("foo.bar.com", false, SignOptions{ExpectedAttributes: &CsrAttributes{ChallengePassword: "s3cret"}})
+	expectCsrRejected(t, sut, cfg, notified, "CSR challengePassword does not match")
+
+	ioutil.WriteFile(csrPath, testCsrPem(t, "foo.bar.com", "s3cret", nil), 0644)
+	watcher.Events <- fsnotify.Event{Name: csrPath, Op: fsnotify.Create}
+	select {
+	case result := <-resultChan:
+		if !result.Success {
+			t.Errorf("The host's own CSR was not signed: %s", result.Message)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The host's own CSR was not signed after another was refused.")
+	}
+}
+
+func TestCertSigner_Sign_AcceptsMatchingCsr(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	ioutil.WriteFile(filepath.Join(cfg.CsrDir, "foo.bar.com.pem"), testCsrPem(t, "foo.bar.com", "s3cret", map[string]string{"pp_uuid": "1234"}), 0644)
+
+	watcher := &interfaces.FsnotifyWatcher{
+		Add:    func(name string) error { return nil },
+		Close:  func() error { return nil },
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	sut, err := NewCertSigner(*cfg, CertSignerConfig{Backend: "native"}, log.New(&bytes.Buffer{}, "", 0), watcher, func(message string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sut.Shutdown()
+
+	expected := &CsrAttributes{ChallengePassword: "s3cret", Extensions: map[string]string{"pp_uuid": "1234"}}
+	result := <-sut.SignWithOptions("foo.bar.com", false, SignOptions{ExpectedAttributes: expected})
+	if !result.Success {
+		t.Errorf("Matching CSR was not signed: %s", result.Message)
+	}
+}
@@ -0,0 +1,208 @@
+package certsign
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
+)
+
+// csrDirPoller stands in for an fsnotify watch of the CSR directory where inotify events don't fire, such as on
+// NFS, by periodically listing the directory and posting events for the differences from the last listing.
+type csrDirPoller struct {
+	interval time.Duration
+	log      *log.Logger
+	watcher  *interfaces.FsnotifyWatcher
+	stops    map[string]chan struct{}
+	lock     sync.Mutex
+}
+
+type polledFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// NewCsrDirPoller returns a FsnotifyWatcher that finds CSRs by scanning the watched directories every interval.
+// Each new file is reported as a Create, and each changed file as a Write. Files present when the directory is
+// added are not reported, as inotify would not report them either.
+func NewCsrDirPoller(interval time.Duration, log *log.Logger) *interfaces.FsnotifyWatcher {
+	poller := &csrDirPoller{interval: interval, log: log, stops: make(map[string]chan struct{})}
+	if poller.interval <= 0 {
+		poller.interval = 30 * time.Second
+	}
+	poller.watcher = &interfaces.FsnotifyWatcher{
+		Add:    poller.add,
+		Remove: poller.remove,
+		Close:  poller.close,
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	return poller.watcher
+}
+
+func (ctx *csrDirPoller) add(name string) error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if _, watching := ctx.stops[name]; watching {
+		return nil
+	}
+
+	// The first scan is taken synchronously, so that anything arriving after Add returns is reported.
+	previous, err := scanCsrDir(name)
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	ctx.stops[name] = stop
+	go ctx.poll(name, previous, stop)
+	return nil
+}
+
+func (ctx *csrDirPoller) remove(name string) error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if stop, watching := ctx.stops[name]; watching {
+		close(stop)
+		delete(ctx.stops, name)
+	}
+	return nil
+}
+
+func (ctx *csrDirPoller) close() error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	for name, stop := range ctx.stops {
+		close(stop)
+		delete(ctx.stops, name)
+	}
+	return nil
+}
+
+func (ctx *csrDirPoller) poll(dir string, previous map[string]polledFile, stop chan struct{}) {
+	ticker := time.NewTicker(ctx.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		current, err := scanCsrDir(dir)
+		if err != nil {
+			select {
+			case ctx.watcher.Errors <- err:
+			case <-stop:
+				return
+			}
+			continue
+		}
+
+		for name, file := range current {
+			var op fsnotify.Op
+			if previousFile, seen := previous[name]; !seen {
+				op = fsnotify.Create
+			} else if previousFile != file {
+				op = fsnotify.Write
+			} else {
+				continue
+			}
+			select {
+			case ctx.watcher.Events <- fsnotify.Event{Name: filepath.Join(dir, name), Op: op}:
+			case <-stop:
+				return
+			}
+		}
+		previous = current
+	}
+}
+
+func scanCsrDir(dir string) (map[string]polledFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]polledFile, len(entries))
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeType != 0 || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+		files[entry.Name()] = polledFile{size: entry.Size(), modTime: entry.ModTime()}
+	}
+	return files, nil
+}
+
+// MergeCsrWatchers combines watchers into one that reports the events and errors of all of them, for watching a
+// directory with both inotify and polling. The CertSigner disregards the resulting duplicate events.
+func MergeCsrWatchers(watchers ...*interfaces.FsnotifyWatcher) *interfaces.FsnotifyWatcher {
+	stop := make(chan struct{})
+	merged := &interfaces.FsnotifyWatcher{
+		Add: func(name string) error {
+			for _, watcher := range watchers {
+				if err := watcher.Add(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Remove: func(name string) error {
+			var firstErr error
+			for _, watcher := range watchers {
+				if err := watcher.Remove(name); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+			return firstErr
+		},
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	var closeOnce sync.Once
+	merged.Close = func() error {
+		closeOnce.Do(func() { close(stop) })
+		var firstErr error
+		for _, watcher := range watchers {
+			if err := watcher.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	for _, watcher := range watchers {
+		go func(watcher *interfaces.FsnotifyWatcher) {
+			for {
+				select {
+				case event, ok := <-watcher.Events:
+					if !ok {
+						return
+					}
+					select {
+					case merged.Events <- event:
+					case <-stop:
+						return
+					}
+				case err, ok := <-watcher.Errors:
+					if !ok {
+						return
+					}
+					select {
+					case merged.Errors <- err:
+					case <-stop:
+						return
+					}
+				case <-stop:
+					return
+				}
+			}
+		}(watcher)
+	}
+	return merged
+}
@@ -0,0 +1,106 @@
+package certsign
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
+)
+
+func expectEvent(t *testing.T, watcher *interfaces.FsnotifyWatcher, name string, op fsnotify.Op) {
+	select {
+	case event := <-watcher.Events:
+		if event.Name != name || event.Op != op {
+			t.Errorf("Expected %s event for %s, got %s", op, name, event)
+		}
+	case err := <-watcher.Errors:
+		t.Errorf("Expected %s event for %s, got error %s", op, name, err)
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected %s event for %s, got nothing", op, name)
+	}
+}
+
+func TestCsrDirPoller(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spp-csrdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "existing.bar.com.pem"), []byte("csr"), 0644)
+
+	sut := NewCsrDirPoller(10*time.Millisecond, log.New(&bytes.Buffer{}, "", 0))
+	defer sut.Close()
+	if err := sut.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	newCsr := filepath.Join(dir, "foo.bar.com.pem")
+	ioutil.WriteFile(filepath.Join(dir, "notacsr.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(newCsr, []byte("csr"), 0644)
+	expectEvent(t, sut, newCsr, fsnotify.Create)
+
+	ioutil.WriteFile(newCsr, []byte("a longer csr"), 0644)
+	expectEvent(t, sut, newCsr, fsnotify.Write)
+
+	// Nothing further changes, so nothing further is reported.
+	select {
+	case event := <-sut.Events:
+		t.Errorf("Unexpected event %s", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCsrDirPoller_MissingDir(t *testing.T) {
+	sut := NewCsrDirPoller(time.Second, log.New(&bytes.Buffer{}, "", 0))
+	if err := sut.Add("/nonexistent/csr"); err == nil {
+		t.Error("Expected an error adding a nonexistent directory.")
+	}
+}
+
+func TestMergeCsrWatchers(t *testing.T) {
+	var added []string
+	var closed int
+	newWatcher := func() *interfaces.FsnotifyWatcher {
+		return &interfaces.FsnotifyWatcher{
+			Add:    func(name string) error { added = append(added, name); return nil },
+			Remove: func(name string) error { return nil },
+			Close:  func() error { closed++; return nil },
+			Events: make(chan fsnotify.Event),
+			Errors: make(chan error),
+		}
+	}
+	first, second := newWatcher(), newWatcher()
+	sut := MergeCsrWatchers(first, second)
+
+	sut.Add("/testssl/csr")
+	if len(added) != 2 {
+		t.Errorf("Expected both watchers to be added to, got %v", added)
+	}
+
+	go func() { first.Events <- fsnotify.Event{Name: "/testssl/csr/foo.bar.com.pem", Op: fsnotify.Create} }()
+	expectEvent(t, sut, "/testssl/csr/foo.bar.com.pem", fsnotify.Create)
+	go func() { second.Events <- fsnotify.Event{Name: "/testssl/csr/baz.bar.com.pem", Op: fsnotify.Create} }()
+	expectEvent(t, sut, "/testssl/csr/baz.bar.com.pem", fsnotify.Create)
+
+	sut.Close()
+	if closed != 2 {
+		t.Errorf("Expected both watchers to be closed, got %d", closed)
+	}
+}
+
+func TestCertSigner_QueueCsr_Deduplicates(t *testing.T) {
+	sut := &CertSigner{signQueue: make(chan signChanMessage, 5), queuedCsrs: make(map[string]bool)}
+
+	sut.queueCsr("foo.bar.com")
+	sut.queueCsr("foo.bar.com")
+	sut.queueCsr("baz.bar.com")
+	if len(sut.signQueue) != 2 {
+		t.Errorf("Expected 2 queued CSRs, got %d", len(sut.signQueue))
+	}
+}
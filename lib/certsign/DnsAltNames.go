@@ -0,0 +1,112 @@
+package certsign
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DnsAltNameConfig decides which DNS alt names requested by CSRs may be signed. A CSR requesting any other alt name
+// is refused, since a certificate with the wrong alt names, such as "puppet", lets a node impersonate a puppet master.
+type DnsAltNameConfig struct {
+	// Regular expressions for alt names that may always be signed. An alt name must match one in whole.
+	Allow []string
+	// Also allow the alt names listed in the /provision request that authorized the certificate.
+	AllowRequested bool
+}
+
+type dnsAltNamePolicy struct {
+	allow          []*regexp.Regexp
+	allowRequested bool
+}
+
+// errDnsAltNamesUnsupported refuses CSRs with allowed DNS alt names when the backend can't be told to sign them.
+var errDnsAltNamesUnsupported = errors.New("the CertSigning Backend cannot sign certificates with DNS alt names")
+
+// dnsAltNameSigner is implemented by backends that can be told which DNS alt names a CSR may be signed with, as
+// "puppet cert sign --allow-dns-alt-names" can. The puppetserver ca tool and the CA API leave that to the CA's
+// configuration instead, which spp can't check, so CSRs with alt names are refused before they reach those backends.
+// (CSRs the CA autosigns are still approved, as the CA does the signing.)
+type dnsAltNameSigner interface {
+	// SignWithDnsAltNames signs the CSR for certSubject, which may request the approved DNS alt names.
+	SignWithDnsAltNames(certSubject string, approved []string) error
+}
+
+func compileDnsAltNamePolicy(config *DnsAltNameConfig) (dnsAltNamePolicy, error) {
+	var policy dnsAltNamePolicy
+	if config == nil {
+		return policy, nil
+	}
+	policy.allowRequested = config.AllowRequested
+	for _, pattern := range config.Allow {
+		compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return policy, fmt.Errorf("CertSigning DnsAltNames pattern \"%s\" is invalid: %s", pattern, err.Error())
+		}
+		policy.allow = append(policy.allow, compiled)
+	}
+	return policy, nil
+}
+
+// csrDnsAltNames returns the DNS alt names csr requests, other than certSubject itself, which puppet agents add.
+func csrDnsAltNames(certSubject string, csr *x509.CertificateRequest) []string {
+	var names []string
+	for _, name := range csr.DNSNames {
+		if !strings.EqualFold(name, certSubject) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// checkDnsAltNames returns the DNS alt names csr requests if the policy allows them all, given the names the
+// request for the certificate listed, or an error naming the ones it doesn't.
+func (ctx *CertSigner) checkDnsAltNames(certSubject string, csr *x509.CertificateRequest, requested []string) ([]string, error) {
+	names := csrDnsAltNames(certSubject, csr)
+	var denied []string
+	for _, name := range names {
+		if !ctx.dnsAltNames.allows(name, requested) {
+			denied = append(denied, fmt.Sprintf("\"%s\"", name))
+		}
+	}
+	if len(denied) == 1 {
+		return nil, fmt.Errorf("DNS alt name %s is not allowed", denied[0])
+	} else if len(denied) > 1 {
+		return nil, fmt.Errorf("DNS alt names %s are not allowed", strings.Join(denied, ", "))
+	}
+	return names, nil
+}
+
+func (ctx *dnsAltNamePolicy) allows(name string, requested []string) bool {
+	if ctx.allowRequested && containsFold(requested, name) {
+		return true
+	}
+	for _, pattern := range ctx.allow {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// signCsr has the backend sign the CSR for certSubject, whose DNS alt names have been approved.
+func (ctx *CertSigner) signCsr(certSubject string, dnsAltNames []string) error {
+	if len(dnsAltNames) > 0 {
+		if signer, ok := ctx.backend.(dnsAltNameSigner); ok {
+			return signer.SignWithDnsAltNames(certSubject, dnsAltNames)
+		}
+	}
+	return ctx.backend.Sign(certSubject)
+}
+
+// containsFold reports whether names contains name, ignoring case as DNS does.
+func containsFold(names []string, name string) bool {
+	for _, candidate := range names {
+		if strings.EqualFold(candidate, name) {
+			return true
+		}
+	}
+	return false
+}
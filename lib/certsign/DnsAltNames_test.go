@@ -0,0 +1,172 @@
+package certsign
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetconfig"
+)
+
+func dnsAltNamesSutFactory(t *testing.T, cfg *puppetconfig.PuppetConfig, config *DnsAltNameConfig, notify func(message string)) *CertSigner {
+	watcher := &interfaces.FsnotifyWatcher{
+		Add:    func(name string) error { return nil },
+		Close:  func() error { return nil },
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	sut, err := NewCertSigner(*cfg, CertSignerConfig{Backend: "native", DnsAltNames: config}, log.New(&bytes.Buffer{}, "", 0), watcher, notify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sut
+}
+
+// expectCsrRejected waits for the notification that the CSR for foo.bar.com was refused for reason and rejected,
+// then checks that its authorization is still pending and nothing was signed.
+func expectCsrRejected(t *testing.T, sut *CertSigner, cfg *puppetconfig.PuppetConfig, notified <-chan string, reason string) {
+	t.Helper()
+	expect := fmt.Sprintf("Refusing to sign certificate for \"foo.bar.com\": %s. The CSR was rejected, and the authorization remains pending for a CSR that matches.", reason)
+	select {
+	case message := <-notified:
+		if message != expect {
+			t.Errorf("Expected notification \"%s\", got \"%s\"", expect, message)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The refusal was not notified.")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.CsrDir, "foo.bar.com.pem")); !os.IsNotExist(err) {
+		t.Error("The refused CSR was not rejected.")
+	}
+	if pending := sut.PendingAuthorizations(); len(pending) != 1 || pending[0].Subject != "foo.bar.com" {
+		t.Errorf("Expected the authorization to remain pending, got %+v", pending)
+	}
+	if sut.certExists("foo.bar.com") {
+		t.Error("A certificate was written for a refused CSR.")
+	}
+}
+
+func TestCompileDnsAltNamePolicy_Invalid(t *testing.T) {
+	_, err := compileDnsAltNamePolicy(&DnsAltNameConfig{Allow: []string{"^puppet[0-9"}})
+	if err == nil || !strings.HasPrefix(err.Error(), "CertSigning DnsAltNames pattern \"^puppet[0-9\" is invalid") {
+		t.Errorf("Expected invalid pattern error, got %v", err)
+	}
+}
+
+func TestDnsAltNamePolicy_AllowsWholeNamesOnly(t *testing.T) {
+	policy, err := compileDnsAltNamePolicy(&DnsAltNameConfig{Allow: []string{`puppet\.my\.org`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.allows("puppet.my.org", nil) {
+		t.Error("Expected puppet.my.org to be allowed.")
+	}
+	for _, name := range []string{"puppet.my.org.evil.com", "evilpuppet.my.org"} {
+		if policy.allows(name, nil) {
+			t.Errorf("Expected %s not to be allowed by a pattern it only contains a match for.", name)
+		}
+	}
+}
+
+func TestCertSigner_Sign_RefusesDnsAltNamesByDefault(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsr(t, cfg, "foo.bar.com", []string{"foo.bar.com", "puppet", "puppet.bar.com"})
+
+	notified := make(chan string, 5)
+	sut := dnsAltNamesSutFactory(t, cfg, nil, func(message string) { notified <- message })
+	defer sut.Shutdown()
+	sut.SignWithOptions("foo.bar.com", false, SignOptions{DnsAltNames: []string{"puppet"}})
+
+	expectCsrRejected(t, sut, cfg, notified, "DNS alt names \"puppet\", \"puppet.bar.com\" are not allowed")
+}
+
+func TestCertSigner_Sign_AllowsDnsAltNames(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsr(t, cfg, "foo.bar.com", []string{"foo.bar.com", "foo-alias.bar.com", "puppet.bar.com"})
+
+	notified := make(chan string, 5)
+	sut := dnsAltNamesSutFactory(t, cfg, &DnsAltNameConfig{Allow: []string{`^puppet\.bar\.com$`}, AllowRequested: true}, func(message string) { notified <- message })
+
+	// Only one of the alt names is allowed without being requested.
+	sut.Sign("foo.bar.com", false)
+	expectCsrRejected(t, sut, cfg, notified, "DNS alt name \"foo-alias.bar.com\" is not allowed")
+
+	writeTestCsr(t, cfg, "foo.bar.com", []string{"foo.bar.com", "foo-alias.bar.com", "puppet.bar.com"})
+	result := <-sut.SignWithOptions("foo.bar.com", false, SignOptions{DnsAltNames: []string{"FOO-ALIAS.bar.com"}})
+	sut.Shutdown()
+	if !result.Success {
+		t.Fatalf("CSR with allowed DNS alt names was not signed: %s", result.Message)
+	}
+	cert, err := readCertFile(filepath.Join(cfg.SignedCertDir, "foo.bar.com.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.DNSNames) != 3 {
+		t.Errorf("Expected the certificate to carry 3 DNS names, got %v", cert.DNSNames)
+	}
+}
+
+// cliOnlyBackend hides the backend's support for signing DNS alt names, as the puppetserver ca tool lacks it.
+type cliOnlyBackend struct {
+	SigningBackend
+}
+
+func TestCertSigner_Sign_RefusesDnsAltNamesTheBackendCannotSign(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsr(t, cfg, "foo.bar.com", []string{"foo.bar.com", "foo-alias.bar.com"})
+
+	notified := make(chan string, 5)
+	sut := dnsAltNamesSutFactory(t, cfg, &DnsAltNameConfig{AllowRequested: true}, func(message string) { notified <- message })
+	defer sut.Shutdown()
+	sut.backend = cliOnlyBackend{sut.backend}
+	sut.SignWithOptions("foo.bar.com", false, SignOptions{DnsAltNames: []string{"foo-alias.bar.com"}})
+
+	expectCsrRejected(t, sut, cfg, notified, "the CertSigning Backend cannot sign certificates with DNS alt names")
+}
+
+func TestCertSigner_AutosignCheck_RefusesDnsAltNames(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	csrPem := testCsrPem(t, "foo.bar.com", "", nil)
+
+	sut := dnsAltNamesSutFactory(t, cfg, nil, func(message string) {})
+	defer sut.Shutdown()
+	sut.authorize(signChanMessage{certSubject: "foo.bar.com"})
+	if approved, info := sut.AutosignCheck("foo.bar.com", csrPem); !approved {
+		t.Errorf("Expected a CSR without alt names to be approved, got \"%s\"", info)
+	}
+
+	writeTestCsr(t, cfg, "baz.bar.com", []string{"puppet"})
+	csrPem, _ = ioutil.ReadFile(filepath.Join(cfg.CsrDir, "baz.bar.com.pem"))
+	sut.authorize(signChanMessage{certSubject: "baz.bar.com"})
+	approved, info := sut.AutosignCheck("baz.bar.com", csrPem)
+	if approved || info != "Refusing to sign certificate for \"baz.bar.com\": DNS alt name \"puppet\" is not allowed." {
+		t.Errorf("Expected the CSR with an alt name to be refused, got \"%s\"", info)
+	}
+}
+
+func TestNativeCaBackend_SignWithDnsAltNames(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsr(t, cfg, "foo.bar.com", []string{"foo.bar.com", "puppet", "puppet.bar.com"})
+
+	sut := newNativeCaBackend(cfg)
+	err := sut.SignWithDnsAltNames("foo.bar.com", []string{"puppet"})
+	if err == nil || !strings.Contains(err.Error(), "DNS alt name \"puppet.bar.com\"") {
+		t.Errorf("Expected refusal of the alt name that wasn't approved, got %v", err)
+	}
+	if err := sut.SignWithDnsAltNames("foo.bar.com", []string{"puppet", "puppet.bar.com"}); err != nil {
+		t.Errorf("Signing with approved alt names failed: %s", err.Error())
+	}
+}
@@ -0,0 +1,132 @@
+package certsign
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// States of the entries in the certificate inventory.
+const (
+	CertStateSigned     = "signed"     // A certificate in SignedCertDir.
+	CertStateRequested  = "requested"  // A CSR in CsrDir, waiting to be signed.
+	CertStateAuthorized = "authorized" // A pending SPP authorization, waiting on its CSR.
+)
+
+// InventoryEntry describes one certificate, CSR or authorization known to the CA.
+type InventoryEntry struct {
+	Subject string
+	State   string
+	// Hexadecimal serial number of a signed certificate.
+	Serial string
+	// SHA256 fingerprint of the certificate or CSR, as puppet displays it.
+	Fingerprint string
+	NotBefore   *time.Time
+	NotAfter    *time.Time
+	DnsAltNames []string
+	// "spp" or "policy" when SPP signed the certificate since it started, and the name of the policy if so.
+	SignedBy    string
+	Policy      string
+	RequestedBy string
+	// When a pending authorization expires.
+	Expires *time.Time
+}
+
+// Inventory lists the signed certificates, pending CSRs and pending authorizations, ordered by subject and state.
+// Files that can't be parsed are logged and left out.
+func (ctx *CertSigner) Inventory() ([]InventoryEntry, error) {
+	var entries []InventoryEntry
+
+	certFiles, err := listPemFiles(ctx.puppetConfig.SignedCertDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, certFile := range certFiles {
+		cert, err := readCertFile(certFile)
+		if err != nil {
+			ctx.log.Printf("Certificate inventory skipped %s: %s\n", certFile, err.Error())
+			continue
+		}
+		notBefore, notAfter := cert.NotBefore, cert.NotAfter
+		entry := InventoryEntry{
+			Subject:     cert.Subject.CommonName,
+			State:       CertStateSigned,
+			Serial:      fmt.Sprintf("%X", cert.SerialNumber),
+			Fingerprint: fingerprint(cert.Raw),
+			NotBefore:   &notBefore,
+			NotAfter:    &notAfter,
+			DnsAltNames: cert.DNSNames,
+		}
+		if record, present := ctx.SigningRecordFor(entry.Subject); present {
+			entry.SignedBy = "spp"
+			if record.Policy != "" {
+				entry.SignedBy = "policy"
+				entry.Policy = record.Policy
+			}
+			entry.RequestedBy = record.RequestedBy
+		}
+		entries = append(entries, entry)
+	}
+
+	csrFiles, err := listPemFiles(ctx.puppetConfig.CsrDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, csrFile := range csrFiles {
+		csr, err := readCsrFile(csrFile)
+		if err != nil {
+			ctx.log.Printf("Certificate inventory skipped %s: %s\n", csrFile, err.Error())
+			continue
+		}
+		entries = append(entries, InventoryEntry{
+			Subject:     csr.Subject.CommonName,
+			State:       CertStateRequested,
+			Fingerprint: fingerprint(csr.Raw),
+			DnsAltNames: csr.DNSNames,
+		})
+	}
+
+	for _, authorization := range ctx.PendingAuthorizations() {
+		entries = append(entries, InventoryEntry{
+			Subject:     authorization.Subject,
+			State:       CertStateAuthorized,
+			RequestedBy: authorization.RequestedBy,
+			Expires:     authorization.Expires,
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Subject < entries[j].Subject })
+	return entries, nil
+}
+
+// listPemFiles returns the paths of the .pem files in dir. A missing directory has none.
+func listPemFiles(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var paths []string
+	for _, file := range files {
+		if file.Mode().IsRegular() && strings.HasSuffix(file.Name(), ".pem") {
+			paths = append(paths, filepath.Join(dir, file.Name()))
+		}
+	}
+	return paths, nil
+}
+
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexBytes, ":")
+}
@@ -0,0 +1,74 @@
+package certsign
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
+)
+
+func TestCertSigner_Inventory(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsr(t, cfg, "signed.bar.com", nil)
+	writeTestCsr(t, cfg, "policy.bar.com", nil)
+	writeTestCsr(t, cfg, "pending.bar.com", []string{"pending.bar.com", "alias.bar.com"})
+	ioutil.WriteFile(filepath.Join(cfg.CsrDir, "garbage.bar.com.pem"), []byte("not a csr"), 0644)
+
+	watcher := &interfaces.FsnotifyWatcher{
+		Add:    func(name string) error { return nil },
+		Close:  func() error { return nil },
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	var logBuf bytes.Buffer
+	sut, err := NewCertSigner(*cfg, CertSignerConfig{Backend: "native"}, log.New(&logBuf, "", 0), watcher, func(message string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sut.Shutdown()
+
+	for _, subject := range []string{"signed.bar.com", "policy.bar.com"} {
+		if err := sut.backend.Sign(subject); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sut.recordSigning("signed.bar.com", SigningRecord{Signed: time.Now(), RequestedBy: "alice"})
+	sut.recordSigning("policy.bar.com", SigningRecord{Signed: time.Now(), Policy: "compute"})
+	sut.authorize(signChanMessage{certSubject: "waiting.bar.com", options: SignOptions{RequestedBy: "bob"}})
+
+	inventory, err := sut.Inventory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(map[string]InventoryEntry)
+	for _, entry := range inventory {
+		states[entry.Subject+" "+entry.State] = entry
+	}
+	if len(inventory) != 4 {
+		t.Errorf("Expected 4 inventory entries, got %+v", inventory)
+	}
+
+	signed, present := states["signed.bar.com signed"]
+	if !present || signed.SignedBy != "spp" || signed.RequestedBy != "alice" || signed.Serial == "" || signed.NotAfter == nil || len(signed.Fingerprint) != 95 {
+		t.Errorf("Unexpected signed entry %+v", signed)
+	}
+	if policy := states["policy.bar.com signed"]; policy.SignedBy != "policy" || policy.Policy != "compute" {
+		t.Errorf("Unexpected policy-signed entry %+v", policy)
+	}
+	pending, present := states["pending.bar.com requested"]
+	if !present || len(pending.DnsAltNames) != 2 || pending.Serial != "" || pending.Fingerprint == "" {
+		t.Errorf("Unexpected requested entry %+v", pending)
+	}
+	if waiting, present := states["waiting.bar.com authorized"]; !present || waiting.RequestedBy != "bob" || waiting.Expires == nil {
+		t.Errorf("Unexpected authorized entry %+v", waiting)
+	}
+	if !bytes.Contains(logBuf.Bytes(), []byte("garbage.bar.com.pem")) {
+		t.Error("Unparseable CSR was not logged.")
+	}
+}
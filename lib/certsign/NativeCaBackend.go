@@ -0,0 +1,286 @@
+package certsign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/atomicfile"
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetconfig"
+)
+
+// Puppet's registered OID arc. CSR extension requests under it (pp_uuid, pp_instance_id, ...) are copied into
+// signed certificates, as the puppet CA does.
+var puppetOidArc = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 34380, 1}
+
+// Puppet's authorization extensions (pp_authorization, pp_auth_role, pp_cli_auth, ...) grant rights such as CA
+// administration, so like the puppet CA the backend refuses CSRs requesting them unless explicitly allowed.
+var puppetAuthOidArc = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 34380, 1, 3}
+
+var oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// nativeCaBackend signs and revokes certificates by operating on the puppet CA's files directly, for masters
+// where the "puppet cert" face is no longer available.
+type nativeCaBackend struct {
+	puppetConfig *puppetconfig.PuppetConfig
+	now          func() time.Time
+	// Whether CSRs may request extensions under puppetAuthOidArc, as with puppet's allow-authorization-extensions.
+	allowAuthorizationExtensions bool
+	lock                         sync.Mutex // Serializes updates to the serial, inventory and CRL files.
+}
+
+func newNativeCaBackend(puppetConfig *puppetconfig.PuppetConfig) *nativeCaBackend {
+	return &nativeCaBackend{puppetConfig: puppetConfig, now: time.Now}
+}
+
+func (ctx *nativeCaBackend) Sign(certSubject string) error {
+	return ctx.sign(certSubject, nil)
+}
+
+func (ctx *nativeCaBackend) SignWithDnsAltNames(certSubject string, approved []string) error {
+	return ctx.sign(certSubject, approved)
+}
+
+// sign signs the CSR for certSubject, provided it requests no DNS alt names but certSubject and those approved, and
+// no authorization extensions unless they are allowed.
+func (ctx *nativeCaBackend) sign(certSubject string, approved []string) error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+
+	csrPath := filepath.Join(ctx.puppetConfig.CsrDir, certSubject+".pem")
+	csr, err := readCsrFile(csrPath)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("CSR signature is invalid: %s", err.Error())
+	}
+	if csr.Subject.CommonName != certSubject {
+		return fmt.Errorf("CSR subject \"%s\" does not match \"%s\"", csr.Subject.CommonName, certSubject)
+	}
+	for _, name := range csrDnsAltNames(certSubject, csr) {
+		if !containsFold(approved, name) {
+			return fmt.Errorf("CSR requests DNS alt name \"%s\", which is not allowed", name)
+		}
+	}
+	// Only DNS alt names are copied into certificates, so CSRs requesting others are refused rather than signed
+	// without them.
+	if len(csr.IPAddresses) > 0 {
+		return fmt.Errorf("CSR requests IP address alt name %s, which is not supported", csr.IPAddresses[0])
+	}
+	if len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return errors.New("CSR requests email or URI alt names, which are not supported")
+	}
+	if !ctx.allowAuthorizationExtensions {
+		for _, ext := range csr.Extensions {
+			if hasOidPrefix(ext.Id, puppetAuthOidArc) {
+				return fmt.Errorf("CSR requests authorization extension %s, which is not allowed", ext.Id.String())
+			}
+		}
+	}
+
+	caCert, caKey, err := ctx.loadCa()
+	if err != nil {
+		return err
+	}
+	serial, err := ctx.takeSerial()
+	if err != nil {
+		return err
+	}
+
+	now := ctx.now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: certSubject},
+		// Backdated a day to tolerate clock skew, as puppet does.
+		NotBefore:             now.Add(-24 * time.Hour),
+		NotAfter:              now.Add(time.Duration(ctx.puppetConfig.CaTtl) * time.Second),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              csr.DNSNames,
+		SubjectKeyId:          subjectKeyId(csr.RawSubjectPublicKeyInfo),
+	}
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+		if hasOidPrefix(ext.Id, puppetOidArc) {
+			template.ExtraExtensions = append(template.ExtraExtensions, ext)
+		}
+	}
+
+	certDer, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("Unable to create certificate: %s", err.Error())
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})
+	certPath := filepath.Join(ctx.puppetConfig.SignedCertDir, certSubject+".pem")
+	if err := atomicfile.WriteFile(certPath, certPem, 0644); err != nil {
+		return err
+	}
+	if err := ctx.appendInventory(template); err != nil {
+		return err
+	}
+
+	return os.Remove(csrPath)
+}
+
+// hasOidPrefix returns whether oid is under the arc prefix.
+func hasOidPrefix(oid asn1.ObjectIdentifier, prefix asn1.ObjectIdentifier) bool {
+	return len(oid) > len(prefix) && oid[:len(prefix)].Equal(prefix)
+}
+
+func (ctx *nativeCaBackend) Clean(certSubject string) error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+
+	certPath := filepath.Join(ctx.puppetConfig.SignedCertDir, certSubject+".pem")
+	cert, err := readCertFile(certPath)
+	if err != nil {
+		return err
+	}
+	caCert, caKey, err := ctx.loadCa()
+	if err != nil {
+		return err
+	}
+
+	crlPem, err := ioutil.ReadFile(ctx.puppetConfig.CaCrl)
+	if err != nil {
+		return err
+	}
+	crlBlock, rest := pem.Decode(crlPem)
+	if crlBlock == nil {
+		return fmt.Errorf("No CRL found in %s", ctx.puppetConfig.CaCrl)
+	}
+	crl, err := x509.ParseRevocationList(crlBlock.Bytes)
+	if err != nil {
+		return err
+	}
+
+	now := ctx.now()
+	number := big.NewInt(1)
+	if crl.Number != nil {
+		number.Add(crl.Number, number)
+	}
+	template := &x509.RevocationList{
+		Number:     number,
+		ThisUpdate: now,
+		NextUpdate: now.Add(time.Duration(ctx.puppetConfig.CaTtl) * time.Second),
+		RevokedCertificateEntries: append(crl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: now,
+		}),
+	}
+	newCrlDer, err := x509.CreateRevocationList(rand.Reader, template, caCert, caKey)
+	if err != nil {
+		return fmt.Errorf("Unable to create CRL: %s", err.Error())
+	}
+
+	// Any further CRLs in the file (e.g. a root CRL following an intermediate CA's) are carried over untouched.
+	var newCrlPem bytes.Buffer
+	pem.Encode(&newCrlPem, &pem.Block{Type: "X509 CRL", Bytes: newCrlDer})
+	newCrlPem.Write(rest)
+	if err := atomicfile.WriteFile(ctx.puppetConfig.CaCrl, newCrlPem.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Remove(certPath)
+}
+
+func (ctx *nativeCaBackend) loadCa() (*x509.Certificate, crypto.Signer, error) {
+	caCert, err := readCertFile(ctx.puppetConfig.CaCert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read CA certificate: %s", err.Error())
+	}
+
+	keyPem, err := ioutil.ReadFile(ctx.puppetConfig.CaKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read CA key: %s", err.Error())
+	}
+	keyBlock, _ := pem.Decode(keyPem)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("No PEM data found in %s", ctx.puppetConfig.CaKey)
+	}
+	var key interface{}
+	switch keyBlock.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(keyBlock.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to parse CA key: %s", err.Error())
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("CA key type is not supported")
+	}
+
+	return caCert, signer, nil
+}
+
+// takeSerial returns the serial number recorded in the CA's serial file and advances the file to the next one.
+func (ctx *nativeCaBackend) takeSerial() (*big.Int, error) {
+	serialData, err := ioutil.ReadFile(ctx.puppetConfig.CaSerial)
+	if err != nil {
+		return nil, err
+	}
+	serial, ok := new(big.Int).SetString(strings.TrimSpace(string(serialData)), 16)
+	if !ok {
+		return nil, fmt.Errorf("Invalid serial number in %s", ctx.puppetConfig.CaSerial)
+	}
+
+	next := new(big.Int).Add(serial, big.NewInt(1))
+	if err := atomicfile.WriteFile(ctx.puppetConfig.CaSerial, []byte(fmt.Sprintf("%04X\n", next)), 0644); err != nil {
+		return nil, err
+	}
+	return serial, nil
+}
+
+func (ctx *nativeCaBackend) appendInventory(cert *x509.Certificate) error {
+	fh, err := os.OpenFile(ctx.puppetConfig.CertInventory, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	const inventoryTimeFormat = "2006-01-02T15:04:05MST"
+	_, err = fmt.Fprintf(fh, "0x%04X %s %s /CN=%s\n",
+		cert.SerialNumber,
+		cert.NotBefore.UTC().Format(inventoryTimeFormat),
+		cert.NotAfter.UTC().Format(inventoryTimeFormat),
+		cert.Subject.CommonName,
+	)
+	return err
+}
+
+func subjectKeyId(rawSubjectPublicKeyInfo []byte) []byte {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(rawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return sum[:]
+}
@@ -0,0 +1,264 @@
+package certsign
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetconfig"
+)
+
+// testCa creates a throwaway puppet-like CA directory layout, returning a PuppetConfig that points into it.
+func testCa(t *testing.T) (*puppetconfig.PuppetConfig, *x509.Certificate, func()) {
+	sslDir, err := ioutil.TempDir("", "spp-testca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &puppetconfig.PuppetConfig{
+		SslDir:        sslDir,
+		CsrDir:        filepath.Join(sslDir, "ca", "requests"),
+		SignedCertDir: filepath.Join(sslDir, "ca", "signed"),
+	}
+	applyTestCaDefaults(cfg)
+	for _, dir := range []string{cfg.CsrDir, cfg.SignedCertDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	caKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Puppet CA: test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDer)
+	crlDer, _ := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}, caCert, caKey)
+
+	ioutil.WriteFile(cfg.CaCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), 0644)
+	ioutil.WriteFile(cfg.CaKey, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(caKey)}), 0600)
+	ioutil.WriteFile(cfg.CaCrl, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDer}), 0644)
+	ioutil.WriteFile(cfg.CaSerial, []byte("0002\n"), 0644)
+
+	return cfg, caCert, func() { os.RemoveAll(sslDir) }
+}
+
+func applyTestCaDefaults(cfg *puppetconfig.PuppetConfig) {
+	cfg.CaDir = filepath.Join(cfg.SslDir, "ca")
+	cfg.CaCert = filepath.Join(cfg.CaDir, "ca_crt.pem")
+	cfg.CaKey = filepath.Join(cfg.CaDir, "ca_key.pem")
+	cfg.CaCrl = filepath.Join(cfg.CaDir, "ca_crl.pem")
+	cfg.CaSerial = filepath.Join(cfg.CaDir, "serial")
+	cfg.CertInventory = filepath.Join(cfg.CaDir, "inventory.txt")
+	cfg.CaTtl = 3600
+}
+
+func writeTestCsr(t *testing.T, cfg *puppetconfig.PuppetConfig, subject string, dnsNames []string) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: subject},
+		DNSNames: dnsNames,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDer})
+	if err := ioutil.WriteFile(filepath.Join(cfg.CsrDir, subject+".pem"), csrPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNativeCaBackend_Sign(t *testing.T) {
+	cfg, caCert, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsr(t, cfg, "foo.bar.com", nil)
+
+	sut := newNativeCaBackend(cfg)
+	if err := sut.Sign("foo.bar.com"); err != nil {
+		t.Fatalf("Signing failed: %s", err.Error())
+	}
+
+	cert, err := readCertFile(filepath.Join(cfg.SignedCertDir, "foo.bar.com.pem"))
+	if err != nil {
+		t.Fatalf("Signed certificate could not be read: %s", err.Error())
+	}
+	if err := cert.CheckSignatureFrom(caCert); err != nil {
+		t.Errorf("Signed certificate was not signed by the CA: %s", err.Error())
+	}
+	if cert.Subject.CommonName != "foo.bar.com" {
+		t.Errorf("Expected certificate subject foo.bar.com, got %s", cert.Subject.CommonName)
+	}
+	if cert.SerialNumber.Int64() != 2 {
+		t.Errorf("Expected certificate serial 2, got %s", cert.SerialNumber.String())
+	}
+
+	serial, _ := ioutil.ReadFile(cfg.CaSerial)
+	if strings.TrimSpace(string(serial)) != "0003" {
+		t.Errorf("Expected serial file to advance to 0003, got %s", serial)
+	}
+	inventory, _ := ioutil.ReadFile(cfg.CertInventory)
+	if !strings.HasPrefix(string(inventory), "0x0002 ") || !strings.HasSuffix(string(inventory), " /CN=foo.bar.com\n") {
+		t.Errorf("Unexpected inventory contents \"%s\"", inventory)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.CsrDir, "foo.bar.com.pem")); !os.IsNotExist(err) {
+		t.Error("CSR was not removed after signing.")
+	}
+}
+
+func TestNativeCaBackend_Sign_NoCsr(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+
+	sut := newNativeCaBackend(cfg)
+	if err := sut.Sign("foo.bar.com"); err != ErrCsrNotFound {
+		t.Errorf("Expected ErrCsrNotFound, got %v", err)
+	}
+}
+
+func TestNativeCaBackend_Sign_RefusesDnsAltNames(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsr(t, cfg, "foo.bar.com", []string{"foo.bar.com", "puppet"})
+
+	sut := newNativeCaBackend(cfg)
+	err := sut.Sign("foo.bar.com")
+	if err == nil || !strings.Contains(err.Error(), "DNS alt name \"puppet\"") {
+		t.Errorf("Expected refusal to sign a CSR with DNS alt names, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.SignedCertDir, "foo.bar.com.pem")); !os.IsNotExist(err) {
+		t.Error("A certificate was written for a refused CSR.")
+	}
+}
+
+func TestNativeCaBackend_Sign_RefusesIpAddressAltNames(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "foo.bar.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(cfg.CsrDir, "foo.bar.com.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDer}), 0644)
+
+	sut := newNativeCaBackend(cfg)
+	err = sut.Sign("foo.bar.com")
+	if err == nil || err.Error() != "CSR requests IP address alt name 10.0.0.1, which is not supported" {
+		t.Errorf("Expected refusal to sign a CSR with an IP address alt name, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.SignedCertDir, "foo.bar.com.pem")); !os.IsNotExist(err) {
+		t.Error("A certificate was written without the IP address alt name the CSR requested.")
+	}
+}
+
+func TestNativeCaBackend_Clean(t *testing.T) {
+	cfg, caCert, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsr(t, cfg, "foo.bar.com", nil)
+
+	sut := newNativeCaBackend(cfg)
+	if err := sut.Sign("foo.bar.com"); err != nil {
+		t.Fatalf("Signing failed: %s", err.Error())
+	}
+	if err := sut.Clean("foo.bar.com"); err != nil {
+		t.Fatalf("Revocation failed: %s", err.Error())
+	}
+
+	if _, err := os.Stat(filepath.Join(cfg.SignedCertDir, "foo.bar.com.pem")); !os.IsNotExist(err) {
+		t.Error("Signed certificate was not removed after revocation.")
+	}
+
+	crlPem, _ := ioutil.ReadFile(cfg.CaCrl)
+	crlBlock, _ := pem.Decode(crlPem)
+	crl, err := x509.ParseRevocationList(crlBlock.Bytes)
+	if err != nil {
+		t.Fatalf("Updated CRL could not be parsed: %s", err.Error())
+	}
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		t.Errorf("Updated CRL was not signed by the CA: %s", err.Error())
+	}
+	revoked := crl.RevokedCertificateEntries
+	if len(revoked) != 1 || revoked[0].SerialNumber.Int64() != 2 {
+		t.Errorf("Expected CRL to revoke serial 2, got %v", revoked)
+	}
+	if crl.Number.Int64() != 2 {
+		t.Errorf("Expected the CRL number to advance to 2, got %s", crl.Number)
+	}
+}
+
+// writeTestCsrWithExtension writes a CSR for subject requesting the extension id with a UTF8String value.
+func writeTestCsrWithExtension(t *testing.T, cfg *puppetconfig.PuppetConfig, subject string, id asn1.ObjectIdentifier, value string) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	extValue, _ := asn1.MarshalWithParams(value, "utf8")
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:         pkix.Name{CommonName: subject},
+		ExtraExtensions: []pkix.Extension{{Id: id, Value: extValue}},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDer})
+	if err := ioutil.WriteFile(filepath.Join(cfg.CsrDir, subject+".pem"), csrPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var oidPpCliAuth = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 34380, 1, 3, 39}
+
+func TestNativeCaBackend_Sign_RefusesAuthorizationExtensions(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsrWithExtension(t, cfg, "foo.bar.com", oidPpCliAuth, "true")
+
+	sut := newNativeCaBackend(cfg)
+	err := sut.Sign("foo.bar.com")
+	if err == nil || !strings.Contains(err.Error(), "authorization extension 1.3.6.1.4.1.34380.1.3.39") {
+		t.Errorf("Expected refusal to sign a CSR requesting pp_cli_auth, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.SignedCertDir, "foo.bar.com.pem")); !os.IsNotExist(err) {
+		t.Error("A certificate was written for a CSR requesting pp_cli_auth.")
+	}
+}
+
+func TestNativeCaBackend_Sign_AllowedAuthorizationExtensions(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsrWithExtension(t, cfg, "foo.bar.com", oidPpCliAuth, "true")
+
+	backend, _ := newSigningBackend(CertSignerConfig{Backend: "native", AllowAuthorizationExtensions: true}, cfg)
+	if err := backend.Sign("foo.bar.com"); err != nil {
+		t.Fatalf("Signing failed: %s", err.Error())
+	}
+	cert, err := readCertFile(filepath.Join(cfg.SignedCertDir, "foo.bar.com.pem"))
+	if err != nil {
+		t.Fatalf("Signed certificate could not be read: %s", err.Error())
+	}
+	copied := false
+	for _, ext := range cert.Extensions {
+		copied = copied || ext.Id.Equal(oidPpCliAuth)
+	}
+	if !copied {
+		t.Error("Expected the allowed pp_cli_auth extension to be copied into the certificate.")
+	}
+}
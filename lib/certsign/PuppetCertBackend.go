@@ -0,0 +1,96 @@
+package certsign
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetconfig"
+)
+
+// puppetCertBackend shells out to the "puppet cert" face, which is only available through Puppet 5.
+type puppetCertBackend struct {
+	cliBackend
+	puppetConfig *puppetconfig.PuppetConfig
+}
+
+// cliBackend holds the command running plumbing shared by backends that drive a command line tool.
+type cliBackend struct {
+	cmdFactory func(name string, arg ...string) *exec.Cmd
+}
+
+func newPuppetCertBackend(puppetConfig *puppetconfig.PuppetConfig) *puppetCertBackend {
+	backend := puppetCertBackend{puppetConfig: puppetConfig}
+	backend.cmdFactory = backend.puppetCmdFactory
+	return &backend
+}
+
+func (ctx *puppetCertBackend) Sign(certSubject string) error {
+	return ctx.sign(ctx.cmdFactory("puppet", "cert", "sign", certSubject), certSubject)
+}
+
+// SignWithDnsAltNames lets puppet sign the CSR's DNS alt names. Puppet can't be told which, so the CSR could in
+// principle be swapped for one with others after the CertSigner checked it.
+func (ctx *puppetCertBackend) SignWithDnsAltNames(certSubject string, approved []string) error {
+	return ctx.sign(ctx.cmdFactory("puppet", "cert", "sign", "--allow-dns-alt-names", certSubject), certSubject)
+}
+
+func (ctx *puppetCertBackend) sign(signCmd *exec.Cmd, certSubject string) error {
+	// puppet cert sign appears to exit 0 on successfully signed, nonzero otherwise.
+	err := signCmd.Run()
+	if err != nil {
+		_, stderr := cmdOutput(signCmd)
+		if strings.Contains(stderr, fmt.Sprintf("Could not find CSR for: \"%s\"", certSubject)) {
+			return ErrCsrNotFound
+		}
+		return cmdError(signCmd)
+	}
+	return nil
+}
+
+func (ctx *puppetCertBackend) Clean(certSubject string) error {
+	// puppet cert clean appears to exit 0 on successfully signed, nonzero otherwise.
+	cleanCmd := ctx.cmdFactory("puppet", "cert", "clean", certSubject)
+	if err := cleanCmd.Run(); err != nil {
+		return cmdError(cleanCmd)
+	}
+	return nil
+}
+
+func (ctx *puppetCertBackend) puppetCmdFactory(name string, arg ...string) *exec.Cmd {
+	if name == "puppet" {
+		name = ctx.puppetConfig.PuppetExecutable
+		// Need to pass these for non-root puppet cli to act on puppet master file locations :|
+		origArg := arg
+		arg = []string{origArg[0], "--config", "/etc/puppetlabs/puppet/puppet.conf", "--confdir", "/etc/puppetlabs/puppet"}
+		arg = append(arg, origArg[1:]...)
+	}
+	return ctx.bufferedCmd(name, arg...)
+}
+
+// bufferedCmd creates a command whose output is captured for cmdOutput. Each command gets its own buffers, so
+// that commands for different subjects may run at the same time.
+func (ctx *cliBackend) bufferedCmd(name string, arg ...string) *exec.Cmd {
+	cmd := exec.Command(name, arg...)
+	cmd.Stdout = &bytes.Buffer{}
+	cmd.Stderr = &bytes.Buffer{}
+	return cmd
+}
+
+// cmdOutput returns what a command created by bufferedCmd wrote to stdout and stderr.
+func cmdOutput(cmd *exec.Cmd) (string, string) {
+	var stdout, stderr string
+	if buffer, ok := cmd.Stdout.(*bytes.Buffer); ok {
+		stdout = buffer.String()
+	}
+	if buffer, ok := cmd.Stderr.(*bytes.Buffer); ok {
+		stderr = buffer.String()
+	}
+	return stdout, stderr
+}
+
+func cmdError(cmd *exec.Cmd) error {
+	stdout, stderr := cmdOutput(cmd)
+	return fmt.Errorf("*** Stdout:\n%s\n*** Stderr:\n%s", stdout, stderr)
+}
@@ -0,0 +1,77 @@
+package certsign
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetconfig"
+)
+
+// puppetserver ca exits with this code when none of the named certnames could be found.
+const puppetserverCaNotFoundExitCode = 24
+
+// puppetserverCaBackend drives the "puppetserver ca" command line tool that replaced "puppet cert" in Puppet 6.
+type puppetserverCaBackend struct {
+	cliBackend
+	puppetConfig           *puppetconfig.PuppetConfig
+	puppetserverExecutable string
+}
+
+func newPuppetserverCaBackend(puppetConfig *puppetconfig.PuppetConfig, puppetserverExecutable string) *puppetserverCaBackend {
+	backend := puppetserverCaBackend{puppetConfig: puppetConfig, puppetserverExecutable: puppetserverExecutable}
+	backend.cmdFactory = backend.puppetserverCmdFactory
+	return &backend
+}
+
+func (ctx *puppetserverCaBackend) Sign(certSubject string) error {
+	signCmd := ctx.cmdFactory("puppetserver", "ca", "sign", "--certname", certSubject)
+	err := signCmd.Run()
+	stdout, stderr := cmdOutput(signCmd)
+	output := stdout + stderr
+	if err != nil {
+		if exitCode(err) == puppetserverCaNotFoundExitCode || strings.Contains(output, fmt.Sprintf("Could not find certificate request for %s", certSubject)) {
+			return ErrCsrNotFound
+		}
+		return cmdError(signCmd)
+	}
+	// Older releases exit 0 even when a certname in the batch failed, so confirm the success message too.
+	if !strings.Contains(output, fmt.Sprintf("Successfully signed certificate request for %s", certSubject)) {
+		return cmdError(signCmd)
+	}
+	return nil
+}
+
+func (ctx *puppetserverCaBackend) Clean(certSubject string) error {
+	cleanCmd := ctx.cmdFactory("puppetserver", "ca", "clean", "--certname", certSubject)
+	err := cleanCmd.Run()
+	if err != nil {
+		stdout, stderr := cmdOutput(cleanCmd)
+		output := stdout + stderr
+		// Nothing to clean is as good as cleaned.
+		if exitCode(err) == puppetserverCaNotFoundExitCode || strings.Contains(output, fmt.Sprintf("Could not find files for %s", certSubject)) {
+			return nil
+		}
+		return cmdError(cleanCmd)
+	}
+	return nil
+}
+
+func (ctx *puppetserverCaBackend) puppetserverCmdFactory(name string, arg ...string) *exec.Cmd {
+	if name == "puppetserver" {
+		name = ctx.puppetserverExecutable
+		arg = append(arg, "--config", ctx.puppetConfig.ConfFile)
+	}
+	return ctx.bufferedCmd(name, arg...)
+}
+
+// exitCode returns the exit status of a command that failed to run successfully, or -1 if it is unavailable.
+func exitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
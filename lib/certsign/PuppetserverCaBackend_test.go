@@ -0,0 +1,115 @@
+package certsign
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetconfig"
+)
+
+func puppetserverCaSutFactory(run string) *puppetserverCaBackend {
+	sut := newPuppetserverCaBackend(&puppetconfig.PuppetConfig{ConfFile: "/testconf/puppet.conf"}, "puppetserver")
+	sut.cmdFactory = func(name string, arg ...string) *exec.Cmd {
+		// Trickery per https://npf.io/2015/06/testing-exec-command/
+		cs := []string{fmt.Sprintf("-test.run=%s", run), "--", name}
+		cs = append(cs, arg...)
+		cmd := sut.bufferedCmd(os.Args[0], cs...)
+		cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
+		return cmd
+	}
+	return sut
+}
+
+func TestPuppetserverCaBackend_Sign(t *testing.T) {
+	sut := puppetserverCaSutFactory("TestHelperPuppetserverCaSignOk")
+	if err := sut.Sign("foo.bar.com"); err != nil {
+		t.Errorf("Expected successful signing, got %s", err.Error())
+	}
+}
+
+func TestPuppetserverCaBackend_Sign_NoCsr(t *testing.T) {
+	sut := puppetserverCaSutFactory("TestHelperPuppetserverCaSignNoCsr")
+	if err := sut.Sign("foo.bar.com"); err != ErrCsrNotFound {
+		t.Errorf("Expected ErrCsrNotFound, got %v", err)
+	}
+}
+
+func TestPuppetserverCaBackend_Sign_Fail(t *testing.T) {
+	sut := puppetserverCaSutFactory("TestHelperPuppetserverCaSignFail")
+	err := sut.Sign("foo.bar.com")
+	if err == nil || err == ErrCsrNotFound {
+		t.Fatalf("Expected signing failure, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "received: code 409") {
+		t.Errorf("Expected error to include puppetserver ca output, got %s", err.Error())
+	}
+}
+
+func TestPuppetserverCaBackend_Clean(t *testing.T) {
+	sut := puppetserverCaSutFactory("TestHelperPuppetserverCaCleanOk")
+	if err := sut.Clean("foo.bar.com"); err != nil {
+		t.Errorf("Expected successful revocation, got %s", err.Error())
+	}
+}
+
+func TestPuppetserverCaBackend_Clean_NotFound(t *testing.T) {
+	sut := puppetserverCaSutFactory("TestHelperPuppetserverCaCleanNotFound")
+	if err := sut.Clean("foo.bar.com"); err != nil {
+		t.Errorf("Expected revocation of an unknown certificate to be treated as done, got %s", err.Error())
+	}
+}
+
+// Mock process exec bodies
+func expectPuppetserverCaArgs(action string) {
+	expect := fmt.Sprintf("puppetserver ca %s --certname foo.bar.com", action)
+	actual := strings.Join(os.Args[3:], " ")
+	if actual != expect {
+		os.Stderr.WriteString(fmt.Sprintf("Expected arguments %s, got %s\n", expect, actual))
+		os.Exit(2)
+	}
+}
+
+func TestHelperPuppetserverCaSignOk(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	expectPuppetserverCaArgs("sign")
+	fmt.Println("Successfully signed certificate request for foo.bar.com")
+	os.Exit(0)
+}
+func TestHelperPuppetserverCaSignNoCsr(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	expectPuppetserverCaArgs("sign")
+	os.Stderr.WriteString("Error:\n    Could not find certificate request for foo.bar.com\n")
+	os.Exit(24)
+}
+func TestHelperPuppetserverCaSignFail(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	expectPuppetserverCaArgs("sign")
+	os.Stderr.WriteString("Error:\n    When attempting to sign certificate request 'foo.bar.com', received: code 409, body Conflict\n")
+	os.Exit(1)
+}
+func TestHelperPuppetserverCaCleanOk(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	expectPuppetserverCaArgs("clean")
+	fmt.Println("Revoked certificate with serial 7")
+	fmt.Println("Cleaned files related to foo.bar.com")
+	os.Exit(0)
+}
+func TestHelperPuppetserverCaCleanNotFound(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	expectPuppetserverCaArgs("clean")
+	os.Stderr.WriteString("Error:\n    Could not find files for foo.bar.com\n")
+	os.Exit(24)
+}
@@ -0,0 +1,128 @@
+package certsign
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetconfig"
+)
+
+// ErrCsrNotFound is returned by a SigningBackend when it was asked to sign a subject the CA has no CSR for yet.
+// The CertSigner treats this as a deferral rather than a failure and signs when the CSR arrives.
+var ErrCsrNotFound = errors.New("no certificate signing request was found")
+
+// ErrQueueFull is returned when a certificate operation could not be queued because the queue stayed full.
+var ErrQueueFull = errors.New("The certificate signing queue is full. Try again later.")
+
+// ErrStopped is returned when a certificate operation is requested after the CertSigner was shut down.
+var ErrStopped = errors.New("The certificate signing manager has been stopped. Shutting down?")
+
+// SigningBackend performs the actual certificate authority operations on behalf of a CertSigner.
+type SigningBackend interface {
+	Sign(certSubject string) error
+	Clean(certSubject string) error
+}
+
+// signedCertChecker is implemented by backends that cannot be checked for an existing certificate by looking in
+// the local signed certificate directory.
+type signedCertChecker interface {
+	HasSignedCert(certSubject string) (bool, error)
+	// SignedCertFingerprint identifies the subject's signed certificate, or returns "" if there is none.
+	SignedCertFingerprint(certSubject string) (string, error)
+}
+
+// csrFetcher is implemented by backends whose pending CSRs are not in the local CSR directory.
+type csrFetcher interface {
+	FetchCsr(certSubject string) (*x509.CertificateRequest, error)
+}
+
+// CertSignerConfig is the CertSigning section of the application configuration.
+type CertSignerConfig struct {
+	// Backend selects the SigningBackend: "puppet-cert" (the default), "puppetserver-ca", "native" or "ca-api".
+	Backend string
+	// Location of the puppetserver executable used by the puppetserver-ca backend.
+	PuppetserverExecutable string
+	// Whether the native backend signs CSRs requesting puppet's authorization extensions, such as pp_cli_auth, which
+	// grant the certificate's holder rights like CA administration. Default false, refusing them as the puppet CA does.
+	AllowAuthorizationExtensions bool
+	// Remote CA used by the ca-api backend.
+	CaApi *CaApiConfig
+	// How long a signing authorization waits for its CSR before it expires. Default 24h; negative never expires.
+	AuthorizationTtl time.Duration
+	// File pending authorizations are saved in, so they survive restarts. Not saved if empty. The service's
+	// configuration defaults this to /var/lib/spp/authorizations.json, and takes "none" to mean empty.
+	AuthorizationStore string
+	// Standing rules for signing CSRs that arrive without a /provision request.
+	Policies []SigningPolicy
+	// Which DNS alt names CSRs may request. None are allowed by default.
+	DnsAltNames *DnsAltNameConfig
+	// What to do about CSRs that arrive without an authorization or matching policy.
+	UnsolicitedCsrs *UnsolicitedCsrConfig
+	// How CSRs arriving in the CSR directory are noticed: "inotify" (the default), "poll" or "both". Polling works
+	// on filesystems such as NFS where inotify events don't fire. Not used by the ca-api backend.
+	CsrWatch string
+	// How often the CSR directory is scanned when polling. Default 30s.
+	CsrPollInterval time.Duration
+	// Number of certificate operations carried out at once, for different subjects. Default 1.
+	Workers int
+	// Number of certificate operations that may wait their turn. Default 50.
+	QueueSize int
+	// How long a request for a certificate operation waits for room when the queue is full before failing with
+	// ErrQueueFull. Default 0, failing right away.
+	QueueTimeout time.Duration
+	// Notifications about signed certificates and the CA certificate nearing expiry.
+	ExpiryWarnings *ExpiryWarningConfig
+}
+
+func newSigningBackend(config CertSignerConfig, puppetConfig *puppetconfig.PuppetConfig) (SigningBackend, error) {
+	switch config.Backend {
+	case "", "puppet-cert":
+		return newPuppetCertBackend(puppetConfig), nil
+	case "puppetserver-ca":
+		puppetserverExecutable := config.PuppetserverExecutable
+		if puppetserverExecutable == "" {
+			puppetserverExecutable = "/opt/puppetlabs/bin/puppetserver"
+		}
+		return newPuppetserverCaBackend(puppetConfig, puppetserverExecutable), nil
+	case "native":
+		backend := newNativeCaBackend(puppetConfig)
+		backend.allowAuthorizationExtensions = config.AllowAuthorizationExtensions
+		return backend, nil
+	case "ca-api":
+		return newCaApiBackend(config.CaApi)
+	default:
+		return nil, fmt.Errorf("CertSigning Backend \"%s\" is unsupported", config.Backend)
+	}
+}
+
+func readCsrFile(csrPath string) (*x509.CertificateRequest, error) {
+	csrPem, err := ioutil.ReadFile(csrPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCsrNotFound
+		}
+		return nil, err
+	}
+	csrBlock, _ := pem.Decode(csrPem)
+	if csrBlock == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", csrPath)
+	}
+	return x509.ParseCertificateRequest(csrBlock.Bytes)
+}
+
+func readCertFile(certPath string) (*x509.Certificate, error) {
+	certPem, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	certBlock, _ := pem.Decode(certPem)
+	if certBlock == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", certPath)
+	}
+	return x509.ParseCertificate(certBlock.Bytes)
+}
@@ -0,0 +1,124 @@
+package certsign
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+)
+
+// SigningPolicy is a standing rule allowing CSRs to be signed as they arrive, without a call to /provision.
+type SigningPolicy struct {
+	Name string
+	// Regular expression the whole certname must match, e.g. compute-[0-9]+\.cluster\.org
+	Hostname string
+	// Optional CIDR network, e.g. 10.20.0.0/16. Puppet doesn't record where a CSR was submitted from, so instead
+	// every address the certname resolves to must be in this network.
+	Network string
+}
+
+type compiledSigningPolicy struct {
+	name     string
+	hostname *regexp.Regexp
+	network  *net.IPNet
+}
+
+// SigningRecord notes how a certificate came to be signed.
+type SigningRecord struct {
+	Signed time.Time
+	// Name of the SigningPolicy that allowed the signing, or empty if it was signed on request.
+	Policy      string
+	RequestedBy string
+}
+
+func compileSigningPolicies(policies []SigningPolicy) ([]compiledSigningPolicy, error) {
+	compiled := make([]compiledSigningPolicy, 0, len(policies))
+	for i, policy := range policies {
+		if policy.Name == "" {
+			policy.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if policy.Hostname == "" {
+			return nil, fmt.Errorf("CertSigning Policy \"%s\" has no Hostname pattern", policy.Name)
+		}
+		hostname, err := regexp.Compile("^(?:" + policy.Hostname + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("CertSigning Policy \"%s\" has an invalid Hostname pattern: %s", policy.Name, err.Error())
+		}
+		compiledPolicy := compiledSigningPolicy{name: policy.Name, hostname: hostname}
+		if policy.Network != "" {
+			_, compiledPolicy.network, err = net.ParseCIDR(policy.Network)
+			if err != nil {
+				return nil, fmt.Errorf("CertSigning Policy \"%s\" has an invalid Network: %s", policy.Name, err.Error())
+			}
+		}
+		compiled = append(compiled, compiledPolicy)
+	}
+	return compiled, nil
+}
+
+// matchingPolicy finds the first policy that allows certSubject to be signed, if any.
+func (ctx *CertSigner) matchingPolicy(certSubject string) *compiledSigningPolicy {
+	for i := range ctx.policies {
+		policy := &ctx.policies[i]
+		if !policy.hostname.MatchString(certSubject) {
+			continue
+		}
+		if policy.network != nil && !ctx.resolvesWithin(certSubject, policy.network) {
+			continue
+		}
+		return policy
+	}
+	return nil
+}
+
+func (ctx *CertSigner) resolvesWithin(certSubject string, network *net.IPNet) bool {
+	addresses, err := ctx.lookupHost(certSubject)
+	if err != nil {
+		ctx.log.Printf("Unable to resolve %s to check it against signing policies: %s\n", certSubject, err.Error())
+		return false
+	}
+	if len(addresses) == 0 {
+		return false
+	}
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil || !network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ctx *CertSigner) signByPolicy(certSubject string, policy *compiledSigningPolicy) {
+	dnsAltNames, err := ctx.verifyCsr(certSubject, SignOptions{})
+	if err != nil && err != ErrCsrNotFound {
+		info := fmt.Sprintf("Refusing to sign certificate for \"%s\" under signing policy \"%s\": %s.", certSubject, policy.name, err.Error())
+		ctx.notify(info)
+		ctx.log.Println(info)
+		return
+	}
+	if err := ctx.signCsr(certSubject, dnsAltNames); err != nil {
+		ctx.log.Printf("Certificate signing for %s under signing policy \"%s\" failed. %s\n", certSubject, policy.name, err.Error())
+		ctx.notify(fmt.Sprintf("Certificate signing for \"%s\" under signing policy \"%s\" failed! More info in log.", certSubject, policy.name))
+		return
+	}
+
+	ctx.recordSigning(certSubject, SigningRecord{Signed: ctx.now(), Policy: policy.name})
+	info := fmt.Sprintf("Certificate for \"%s\" has been signed, as allowed by signing policy \"%s\".", certSubject, policy.name)
+	ctx.notify(info)
+	ctx.log.Println(info)
+}
+
+func (ctx *CertSigner) recordSigning(certSubject string, record SigningRecord) {
+	ctx.signingRecordsLock.Lock()
+	defer ctx.signingRecordsLock.Unlock()
+	ctx.signingRecords[certSubject] = record
+}
+
+// SigningRecordFor tells how the certificate for certSubject was signed, if it was signed since this process started.
+func (ctx *CertSigner) SigningRecordFor(certSubject string) (SigningRecord, bool) {
+	ctx.signingRecordsLock.Lock()
+	defer ctx.signingRecordsLock.Unlock()
+	record, present := ctx.signingRecords[certSubject]
+	return record, present
+}
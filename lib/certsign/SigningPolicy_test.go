@@ -0,0 +1,127 @@
+package certsign
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
+)
+
+func TestCompileSigningPolicies_Invalid(t *testing.T) {
+	cases := []struct {
+		policy SigningPolicy
+		expect string
+	}{
+		{SigningPolicy{Name: "compute"}, "CertSigning Policy \"compute\" has no Hostname pattern"},
+		{SigningPolicy{Name: "compute", Hostname: "compute-[0-9"}, "CertSigning Policy \"compute\" has an invalid Hostname pattern"},
+		{SigningPolicy{Hostname: "^compute", Network: "10.20.0.0"}, "CertSigning Policy \"#1\" has an invalid Network"},
+	}
+	for _, c := range cases {
+		_, err := compileSigningPolicies([]SigningPolicy{c.policy})
+		if err == nil || !strings.HasPrefix(err.Error(), c.expect) {
+			t.Errorf("Expected error \"%s\", got %v", c.expect, err)
+		}
+	}
+}
+
+func TestCertSigner_MatchingPolicy(t *testing.T) {
+	sut, err, _ := sutFactory(nil, nil, nil)
+	if err != nil {
+		t.FailNow()
+	}
+	sut.Shutdown()
+
+	sut.policies, _ = compileSigningPolicies([]SigningPolicy{
+		{Name: "compute", Hostname: `^compute-[0-9]+\.cluster\.org$`, Network: "10.20.0.0/16"},
+		{Name: "lab", Hostname: `[a-z0-9-]+\.lab\.org`},
+		{Name: "web", Hostname: `web\d+\.my\.org`},
+	})
+	addresses := map[string][]string{
+		"compute-1.cluster.org": {"10.20.3.4"},
+		"compute-2.cluster.org": {"10.20.3.5", "192.168.1.5"},
+	}
+	sut.lookupHost = func(host string) ([]string, error) {
+		if found, ok := addresses[host]; ok {
+			return found, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	expectations := []struct {
+		subject string
+		policy  string
+	}{
+		{"compute-1.cluster.org", "compute"},
+		{"compute-2.cluster.org", ""}, // One address is outside the network.
+		{"compute-3.cluster.org", ""}, // Doesn't resolve.
+		{"web.cluster.org", ""},
+		{"box.lab.org", "lab"},
+		{"web1.my.org", "web"},
+		// Patterns must match the whole certname, not just part of it.
+		{"web1.my.org.attacker.net", ""},
+		{"box.lab.org.attacker.net", ""},
+		{"myweb1.my.org", ""},
+	}
+	for _, expectation := range expectations {
+		policy := sut.matchingPolicy(expectation.subject)
+		if expectation.policy == "" && policy != nil {
+			t.Errorf("Expected no policy to match %s, got \"%s\"", expectation.subject, policy.name)
+		} else if expectation.policy != "" && (policy == nil || policy.name != expectation.policy) {
+			t.Errorf("Expected policy \"%s\" to match %s, got %v", expectation.policy, expectation.subject, policy)
+		}
+	}
+}
+
+func TestCertSigner_SignsCsrsAllowedByPolicy(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsr(t, cfg, "compute-1.cluster.org", nil)
+	writeTestCsr(t, cfg, "web.cluster.org", nil)
+
+	notified := make(chan string, 5)
+	watcher := &interfaces.FsnotifyWatcher{
+		Add:    func(name string) error { return nil },
+		Close:  func() error { return nil },
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	config := CertSignerConfig{
+		Backend:  "native",
+		Policies: []SigningPolicy{{Name: "compute", Hostname: `^compute-[0-9]+\.cluster\.org$`}},
+	}
+	sut, err := NewCertSigner(*cfg, config, log.New(&bytes.Buffer{}, "", 0), watcher, func(message string) { notified <- message })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher.Events <- fsnotify.Event{Name: filepath.Join(cfg.CsrDir, "web.cluster.org.pem"), Op: fsnotify.Create}
+	watcher.Events <- fsnotify.Event{Name: filepath.Join(cfg.CsrDir, "compute-1.cluster.org.pem"), Op: fsnotify.Create}
+
+	expect := "Certificate for \"compute-1.cluster.org\" has been signed, as allowed by signing policy \"compute\"."
+	select {
+	case message := <-notified:
+		if message != expect {
+			t.Errorf("Expected notification \"%s\", got \"%s\"", expect, message)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("CSR allowed by policy was not signed.")
+	}
+	sut.Shutdown()
+
+	if !sut.certExists("compute-1.cluster.org") {
+		t.Error("No certificate was written for the CSR allowed by policy.")
+	}
+	if sut.certExists("web.cluster.org") {
+		t.Error("A CSR matching no policy was signed.")
+	}
+	record, present := sut.SigningRecordFor("compute-1.cluster.org")
+	if !present || record.Policy != "compute" {
+		t.Errorf("Expected a signing record naming the compute policy, got %+v", record)
+	}
+}
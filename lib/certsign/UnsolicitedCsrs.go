@@ -0,0 +1,203 @@
+package certsign
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// UnsolicitedCsrConfig controls what happens to CSRs that arrive without an authorization or matching policy.
+type UnsolicitedCsrConfig struct {
+	// Send a notification when one arrives.
+	Notify bool
+	// Minimum time between notifications about the same subject. Default 1h.
+	NotifyInterval time.Duration
+	// Get rid of unsolicited CSRs that are still unsolicited after GracePeriod (default 1h), using Action.
+	Quarantine  bool
+	GracePeriod time.Duration
+	// "reject" (the default) deletes the CSR; "clean" also revokes and deletes any certificate for the subject.
+	Action string
+	// How long an unsolicited CSR that isn't quarantined stays listed after it was last seen. Default 168h (7 days).
+	// CSRs that have gone away, having been dealt with outside spp, are forgotten sooner.
+	Retention time.Duration
+}
+
+type unsolicitedCsr struct {
+	firstSeen    time.Time
+	lastSeen     time.Time
+	lastNotified time.Time
+	queued       bool // Queued for quarantine.
+}
+
+// UnsolicitedCsr describes a CSR that arrived without being asked for.
+type UnsolicitedCsr struct {
+	Subject   string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// When the CSR will be quarantined, if quarantine is enabled.
+	QuarantineAt *time.Time
+}
+
+// csrRejecter is implemented by backends whose pending CSRs are not deleted from the local CSR directory.
+type csrRejecter interface {
+	RejectCsr(certSubject string) error
+}
+
+// UnsolicitedCsrs lists the CSRs that have arrived without an authorization or matching policy, ordered by subject.
+func (ctx *CertSigner) UnsolicitedCsrs() []UnsolicitedCsr {
+	ctx.unsolicitedCsrsLock.Lock()
+	defer ctx.unsolicitedCsrsLock.Unlock()
+
+	csrs := make([]UnsolicitedCsr, 0, len(ctx.unsolicitedCsrs))
+	for subject, csr := range ctx.unsolicitedCsrs {
+		listing := UnsolicitedCsr{Subject: subject, FirstSeen: csr.firstSeen, LastSeen: csr.lastSeen}
+		if ctx.unsolicitedCsrConfig.Quarantine {
+			quarantineAt := csr.firstSeen.Add(ctx.unsolicitedCsrConfig.GracePeriod)
+			listing.QuarantineAt = &quarantineAt
+		}
+		csrs = append(csrs, listing)
+	}
+	sort.Slice(csrs, func(i, j int) bool { return csrs[i].Subject < csrs[j].Subject })
+	return csrs
+}
+
+func (ctx *CertSigner) unsolicitedCsrArrived(certSubject string) {
+	now := ctx.now()
+
+	ctx.unsolicitedCsrsLock.Lock()
+	csr, present := ctx.unsolicitedCsrs[certSubject]
+	if !present {
+		csr = &unsolicitedCsr{firstSeen: now}
+		ctx.unsolicitedCsrs[certSubject] = csr
+	}
+	csr.lastSeen = now
+	notify := ctx.unsolicitedCsrConfig.Notify && (csr.lastNotified.IsZero() || now.Sub(csr.lastNotified) >= ctx.unsolicitedCsrConfig.NotifyInterval)
+	if notify {
+		csr.lastNotified = now
+	}
+	ctx.unsolicitedCsrsLock.Unlock()
+
+	info := fmt.Sprintf("Received a CSR for \"%s\", which was not expected.", certSubject)
+	if ctx.unsolicitedCsrConfig.Quarantine {
+		info = fmt.Sprintf("%s It will be quarantined if it is not authorized by %s.", info, csr.firstSeen.Add(ctx.unsolicitedCsrConfig.GracePeriod).Format(time.RFC1123))
+	}
+	ctx.log.Println(info)
+	if notify {
+		ctx.notify(info)
+	}
+}
+
+// forgetUnsolicitedCsr drops certSubject from the unsolicited CSRs, because it has since been authorized.
+func (ctx *CertSigner) forgetUnsolicitedCsr(certSubject string) {
+	ctx.unsolicitedCsrsLock.Lock()
+	defer ctx.unsolicitedCsrsLock.Unlock()
+	delete(ctx.unsolicitedCsrs, certSubject)
+}
+
+// pruneUnsolicitedCsrs forgets the unsolicited CSRs that have gone away, and those that won't be quarantined and
+// haven't been seen again within the Retention period, so that they don't pile up for as long as the service runs.
+func (ctx *CertSigner) pruneUnsolicitedCsrs() {
+	now := ctx.now()
+
+	lastSeen := make(map[string]time.Time)
+	ctx.unsolicitedCsrsLock.Lock()
+	for subject, csr := range ctx.unsolicitedCsrs {
+		if csr.queued {
+			continue
+		}
+		if !ctx.unsolicitedCsrConfig.Quarantine && now.Sub(csr.lastSeen) > ctx.unsolicitedCsrConfig.Retention {
+			delete(ctx.unsolicitedCsrs, subject)
+		} else {
+			lastSeen[subject] = csr.lastSeen
+		}
+	}
+	ctx.unsolicitedCsrsLock.Unlock()
+
+	// Looking for the CSRs may mean asking a remote CA, so it is done without holding the lock. A CSR seen again
+	// meanwhile is kept.
+	for subject, seen := range lastSeen {
+		if ctx.csrExists(subject) {
+			continue
+		}
+		ctx.unsolicitedCsrsLock.Lock()
+		if csr, present := ctx.unsolicitedCsrs[subject]; present && !csr.queued && csr.lastSeen.Equal(seen) {
+			delete(ctx.unsolicitedCsrs, subject)
+		}
+		ctx.unsolicitedCsrsLock.Unlock()
+	}
+}
+
+// queueQuarantines passes the unsolicited CSRs whose grace period is over to the signing worker to be quarantined.
+func (ctx *CertSigner) queueQuarantines() {
+	if !ctx.unsolicitedCsrConfig.Quarantine {
+		return
+	}
+	now := ctx.now()
+
+	var due []string
+	ctx.unsolicitedCsrsLock.Lock()
+	for subject, csr := range ctx.unsolicitedCsrs {
+		if !csr.queued && now.Sub(csr.firstSeen) >= ctx.unsolicitedCsrConfig.GracePeriod {
+			csr.queued = true
+			due = append(due, subject)
+		}
+	}
+	ctx.unsolicitedCsrsLock.Unlock()
+
+	for _, subject := range due {
+		select {
+		case ctx.signQueue <- signChanMessage{certSubject: subject, quarantine: true}:
+		default:
+			// The queue is full; try again next time.
+			ctx.unsolicitedCsrsLock.Lock()
+			if csr, present := ctx.unsolicitedCsrs[subject]; present {
+				csr.queued = false
+			}
+			ctx.unsolicitedCsrsLock.Unlock()
+		}
+	}
+}
+
+func (ctx *CertSigner) quarantineCsr(certSubject string) {
+	ctx.unsolicitedCsrsLock.Lock()
+	_, present := ctx.unsolicitedCsrs[certSubject]
+	delete(ctx.unsolicitedCsrs, certSubject)
+	ctx.unsolicitedCsrsLock.Unlock()
+
+	// It may have been authorized, or its CSR removed, since it was queued.
+	if _, authorized := ctx.authorization(certSubject); !present || authorized {
+		return
+	}
+	if !ctx.csrExists(certSubject) {
+		return
+	}
+
+	var err error
+	if ctx.unsolicitedCsrConfig.Action == "clean" {
+		err = ctx.backend.Clean(certSubject)
+	} else {
+		err = ctx.rejectCsr(certSubject)
+	}
+	if err != nil {
+		ctx.log.Printf("Quarantine of the unsolicited CSR for %s failed. %s\n", certSubject, err.Error())
+		ctx.notify(fmt.Sprintf("Quarantine of the unsolicited CSR for \"%s\" failed! More info in log.", certSubject))
+		return
+	}
+
+	info := fmt.Sprintf("The unsolicited CSR for \"%s\" was not authorized within %s, so it was quarantined (%s).", certSubject, ctx.unsolicitedCsrConfig.GracePeriod, ctx.unsolicitedCsrConfig.Action)
+	ctx.notify(info)
+	ctx.log.Println(info)
+}
+
+func (ctx *CertSigner) rejectCsr(certSubject string) error {
+	if rejecter, ok := ctx.backend.(csrRejecter); ok {
+		return rejecter.RejectCsr(certSubject)
+	}
+	err := os.Remove(filepath.Join(ctx.puppetConfig.CsrDir, certSubject+".pem"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
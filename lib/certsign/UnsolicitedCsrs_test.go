@@ -0,0 +1,179 @@
+package certsign
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mbaynton/SimplePuppetProvisioner/interfaces"
+	"github.com/mbaynton/SimplePuppetProvisioner/lib/puppetconfig"
+)
+
+// testClock is a settable stand-in for time.Now that is safe to use from the CertSigner's goroutines.
+type testClock struct {
+	lock sync.Mutex
+	time time.Time
+}
+
+func (ctx *testClock) now() time.Time {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.time
+}
+
+func (ctx *testClock) advance(d time.Duration) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.time = ctx.time.Add(d)
+}
+
+func TestCertSigner_UnsolicitedCsrArrived_RateLimitsNotifications(t *testing.T) {
+	var notifications []string
+	sut, err, _ := sutFactory(nil, func(message string) { notifications = append(notifications, message) }, nil)
+	if err != nil {
+		t.FailNow()
+	}
+	sut.Shutdown()
+
+	clock := &testClock{time: time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)}
+	sut.now = clock.now
+	sut.unsolicitedCsrConfig.Notify = true
+
+	sut.unsolicitedCsrArrived("rogue.bar.com")
+	clock.advance(10 * time.Minute)
+	sut.unsolicitedCsrArrived("rogue.bar.com")
+	clock.advance(time.Hour)
+	sut.unsolicitedCsrArrived("rogue.bar.com")
+
+	expect := "Received a CSR for \"rogue.bar.com\", which was not expected."
+	if len(notifications) != 2 || notifications[0] != expect || notifications[1] != expect {
+		t.Errorf("Expected 2 notifications \"%s\", got %v", expect, notifications)
+	}
+
+	csrs := sut.UnsolicitedCsrs()
+	if len(csrs) != 1 || csrs[0].Subject != "rogue.bar.com" || !csrs[0].LastSeen.Equal(clock.now()) {
+		t.Errorf("Unexpected unsolicited CSR listing %+v", csrs)
+	}
+	if csrs[0].QuarantineAt != nil {
+		t.Error("Unsolicited CSR lists a quarantine time when quarantine is disabled.")
+	}
+}
+
+func TestCertSigner_UnsolicitedCsr_ForgottenWhenAuthorized(t *testing.T) {
+	sut, deferred, _ := deferredSutFactory(t, time.Now())
+	defer sut.Shutdown()
+
+	sut.unsolicitedCsrArrived("foo.bar.com")
+	sut.Sign("foo.bar.com", false)
+	<-deferred
+
+	if len(sut.UnsolicitedCsrs()) != 0 {
+		t.Error("Authorized subject is still listed as an unsolicited CSR.")
+	}
+}
+
+func TestCertSigner_PrunesUnsolicitedCsrs(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsr(t, cfg, "stays.bar.com", nil)
+	writeTestCsr(t, cfg, "old.bar.com", nil)
+
+	sut := dnsAltNamesSutFactory(t, cfg, nil, func(message string) {})
+	sut.Shutdown()
+	clock := &testClock{time: time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)}
+	sut.now = clock.now
+
+	sut.unsolicitedCsrArrived("old.bar.com")
+	clock.advance(7 * 24 * time.Hour)
+	sut.unsolicitedCsrArrived("stays.bar.com")
+	sut.unsolicitedCsrArrived("gone.bar.com")
+	clock.advance(time.Hour)
+	sut.pruneUnsolicitedCsrs()
+
+	// The CSR for gone.bar.com was never written, as if it had been removed; old.bar.com wasn't seen again.
+	if csrs := sut.UnsolicitedCsrs(); len(csrs) != 1 || csrs[0].Subject != "stays.bar.com" {
+		t.Errorf("Expected only stays.bar.com to remain listed, got %+v", csrs)
+	}
+
+	// CSRs waiting to be quarantined are kept however long ago they were seen, but not once they're gone.
+	sut.unsolicitedCsrConfig.Quarantine = true
+	sut.unsolicitedCsrArrived("gone.bar.com")
+	clock.advance(30 * 24 * time.Hour)
+	sut.pruneUnsolicitedCsrs()
+	if csrs := sut.UnsolicitedCsrs(); len(csrs) != 1 || csrs[0].Subject != "stays.bar.com" {
+		t.Errorf("Expected only stays.bar.com to remain listed with quarantine on, got %+v", csrs)
+	}
+}
+
+func TestCertSigner_QuarantinesUnsolicitedCsrs(t *testing.T) {
+	cfg, _, cleanup := testCa(t)
+	defer cleanup()
+	writeTestCsr(t, cfg, "rogue.bar.com", nil)
+
+	notified := make(chan string, 5)
+	watcher := &interfaces.FsnotifyWatcher{
+		Add:    func(name string) error { return nil },
+		Close:  func() error { return nil },
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	config := CertSignerConfig{
+		Backend:         "native",
+		UnsolicitedCsrs: &UnsolicitedCsrConfig{Notify: true, Quarantine: true, GracePeriod: 30 * time.Minute},
+	}
+	sut, err := NewCertSigner(*cfg, config, log.New(&bytes.Buffer{}, "", 0), watcher, func(message string) { notified <- message })
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{time: time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)}
+	sut.now = clock.now
+
+	watcher.Events <- fsnotify.Event{Name: filepath.Join(cfg.CsrDir, "rogue.bar.com.pem"), Op: fsnotify.Create}
+	expect := "Received a CSR for \"rogue.bar.com\", which was not expected. It will be quarantined if it is not authorized by Thu, 01 Mar 2018 12:30:00 UTC."
+	if message := <-notified; message != expect {
+		t.Errorf("Expected notification \"%s\", got \"%s\"", expect, message)
+	}
+
+	// Not due yet.
+	clock.advance(20 * time.Minute)
+	sut.queueQuarantines()
+	clock.advance(20 * time.Minute)
+	sut.queueQuarantines()
+
+	expect = "The unsolicited CSR for \"rogue.bar.com\" was not authorized within 30m0s, so it was quarantined (reject)."
+	select {
+	case message := <-notified:
+		if message != expect {
+			t.Errorf("Expected notification \"%s\", got \"%s\"", expect, message)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Unsolicited CSR was not quarantined.")
+	}
+	sut.Shutdown()
+
+	if _, err := os.Stat(filepath.Join(cfg.CsrDir, "rogue.bar.com.pem")); !os.IsNotExist(err) {
+		t.Error("Quarantined CSR was not deleted.")
+	}
+	if len(sut.UnsolicitedCsrs()) != 0 {
+		t.Error("Quarantined CSR is still listed as unsolicited.")
+	}
+}
+
+func TestNewCertSigner_InvalidUnsolicitedCsrAction(t *testing.T) {
+	watcher := &interfaces.FsnotifyWatcher{
+		Add:    func(name string) error { return nil },
+		Close:  func() error { return nil },
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+	}
+	config := CertSignerConfig{UnsolicitedCsrs: &UnsolicitedCsrConfig{Action: "shred"}}
+	_, err := NewCertSigner(puppetconfig.PuppetConfig{CsrDir: "/testssl/csr"}, config, log.New(&bytes.Buffer{}, "", 0), watcher, func(message string) {})
+	if err == nil || err.Error() != "UnsolicitedCsrs Action \"shred\" is unsupported" {
+		t.Errorf("Expected unsupported action error, got %v", err)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"log"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 )
 
 type PuppetConfigParser struct {
@@ -19,6 +21,17 @@ type PuppetConfig struct {
 	SslDir           string
 	CsrDir           string
 	SignedCertDir    string
+
+	// Certificate authority file locations. These are only consulted by signing backends that act on the CA's files
+	// directly, and for the CA certificate's expiry; when puppet does not report them, they are derived from SslDir
+	// the way puppet itself would.
+	CaDir         string
+	CaCert        string
+	CaKey         string
+	CaCrl         string
+	CaSerial      string
+	CertInventory string
+	CaTtl         int64 // Seconds
 }
 
 func NewPuppetConfigParser(log *log.Logger) *PuppetConfigParser {
@@ -48,6 +61,7 @@ func (ctx PuppetConfigParser) LoadPuppetConfig(puppetExecutable string, puppetCo
 	// have we read everything we need?
 	if validateParsedConfig(ctx.parsedConfig) {
 		ctx.parsedConfig.PuppetExecutable = puppetExecutable
+		applyCaDefaults(ctx.parsedConfig)
 		return ctx.parsedConfig
 	} else {
 		ctx.log.Print("Output of \"puppet config print\" was not in the correct format.")
@@ -85,6 +99,23 @@ func (ctx PuppetConfigParser) parseConfig(configData *bytes.Buffer) {
 				parsedConfig.ConfFile = value
 			case "confdir":
 				parsedConfig.ConfDir = value
+			case "cadir":
+				parsedConfig.CaDir = value
+			case "cacert":
+				parsedConfig.CaCert = value
+			case "cakey":
+				parsedConfig.CaKey = value
+			case "cacrl":
+				parsedConfig.CaCrl = value
+			case "serial":
+				parsedConfig.CaSerial = value
+			case "cert_inventory":
+				parsedConfig.CertInventory = value
+			case "ca_ttl":
+				ttl, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					parsedConfig.CaTtl = ttl
+				}
 			}
 		}
 	}
@@ -100,3 +131,28 @@ func validateParsedConfig(cfg *PuppetConfig) bool {
 
 	return ok
 }
+
+func applyCaDefaults(cfg *PuppetConfig) {
+	if cfg.CaDir == "" {
+		cfg.CaDir = filepath.Join(cfg.SslDir, "ca")
+	}
+	defaults := []struct {
+		value    *string
+		fileName string
+	}{
+		{&cfg.CaCert, "ca_crt.pem"},
+		{&cfg.CaKey, "ca_key.pem"},
+		{&cfg.CaCrl, "ca_crl.pem"},
+		{&cfg.CaSerial, "serial"},
+		{&cfg.CertInventory, "inventory.txt"},
+	}
+	for _, d := range defaults {
+		if *d.value == "" {
+			*d.value = filepath.Join(cfg.CaDir, d.fileName)
+		}
+	}
+	if cfg.CaTtl <= 0 {
+		// Puppet's default ca_ttl of 5 years.
+		cfg.CaTtl = 5 * 365 * 24 * 60 * 60
+	}
+}
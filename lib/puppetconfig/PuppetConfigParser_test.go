@@ -87,3 +87,35 @@ ssldir = %s`,
 	}
 	return result
 }
+
+func TestParser_CaSettings(t *testing.T) {
+	var logBuf bytes.Buffer
+	testLog := log.New(&logBuf, "", 0)
+
+	sut := NewPuppetConfigParser(testLog)
+	confData := bytes.NewBufferString(`ssldir = /ssl
+cadir = /ca
+cakey = /keys/ca_key.pem
+ca_ttl = 3600
+`)
+	sut.parseConfig(confData)
+	applyCaDefaults(sut.parsedConfig)
+
+	expects := [][2]string{
+		{sut.parsedConfig.CaDir, "/ca"},
+		{sut.parsedConfig.CaKey, "/keys/ca_key.pem"},
+		{sut.parsedConfig.CaCert, "/ca/ca_crt.pem"},
+		{sut.parsedConfig.CaCrl, "/ca/ca_crl.pem"},
+		{sut.parsedConfig.CaSerial, "/ca/serial"},
+		{sut.parsedConfig.CertInventory, "/ca/inventory.txt"},
+	}
+	for _, pair := range expects {
+		actual, expect := pair[0], pair[1]
+		if actual != expect {
+			t.Errorf("Expected CA setting %s, got %s\n", expect, actual)
+		}
+	}
+	if sut.parsedConfig.CaTtl != 3600 {
+		t.Errorf("Expected ca_ttl 3600, got %d\n", sut.parsedConfig.CaTtl)
+	}
+}
@@ -0,0 +1,211 @@
+package puppetdb
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config locates PuppetDB's HTTP API and the client credentials used to authenticate to it.
+type Config struct {
+	Url        string // e.g. https://puppetdb.my.org:8081
+	ClientCert string
+	ClientKey  string
+	CaCert     string        // Used to verify PuppetDB's certificate.
+	Timeout    time.Duration // How long to wait for PuppetDB to respond. Default 30s.
+
+	// What /provision does when asked to sign a certificate for a hostname that already has an active node in
+	// PuppetDB which reported within ActiveWithin: "warn" or "refuse". By default PuppetDB is not checked.
+	ProvisionCheck string
+	ActiveWithin   time.Duration
+}
+
+// ErrNodeNotFound is returned when PuppetDB knows nothing about a node.
+var ErrNodeNotFound = errors.New("PuppetDB has no information about this node")
+
+// Node is what PuppetDB knows about a node's status.
+type Node struct {
+	Certname           string
+	Deactivated        *time.Time
+	Expired            *time.Time
+	ReportTimestamp    *time.Time
+	CatalogTimestamp   *time.Time
+	FactsTimestamp     *time.Time
+	CatalogEnvironment string
+	LatestReportStatus string
+}
+
+type nodeStatus struct {
+	Certname           string     `json:"certname"`
+	Deactivated        *time.Time `json:"deactivated"`
+	Expired            *time.Time `json:"expired"`
+	ReportTimestamp    *time.Time `json:"report_timestamp"`
+	CatalogTimestamp   *time.Time `json:"catalog_timestamp"`
+	FactsTimestamp     *time.Time `json:"facts_timestamp"`
+	CatalogEnvironment string     `json:"catalog_environment"`
+	LatestReportStatus string     `json:"latest_report_status"`
+}
+
+type fact struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// Client makes requests against the PuppetDB HTTP API.
+type Client struct {
+	baseUrl    string
+	httpClient *http.Client
+}
+
+func NewClient(config *Config) (*Client, error) {
+	if config == nil || config.Url == "" {
+		return nil, errors.New("PuppetDb Url is not configured")
+	}
+	switch config.ProvisionCheck {
+	case "", "warn", "refuse":
+	default:
+		return nil, fmt.Errorf("PuppetDb ProvisionCheck \"%s\" is unsupported", config.ProvisionCheck)
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.ClientCert != "" || config.ClientKey != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load PuppetDB client credentials: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+	if config.CaCert != "" {
+		caPem, err := ioutil.ReadFile(config.CaCert)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read PuppetDB CA certificate: %s", err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("No certificates found in %s", config.CaCert)
+		}
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = time.Second * 30
+	}
+	client := Client{
+		baseUrl: strings.TrimRight(config.Url, "/"),
+		httpClient: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+	return &client, nil
+}
+
+// DeactivateNode submits PuppetDB's deactivate node command for certname, so that its resources stop being
+// collected and it no longer appears among the active nodes. PuppetDB processes commands asynchronously; a nil
+// error means the command was accepted.
+func (ctx *Client) DeactivateNode(certname string) error {
+	requestBody, _ := json.Marshal(map[string]string{
+		"certname":           certname,
+		"producer_timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+	query := url.Values{}
+	query.Set("command", "deactivate_node")
+	query.Set("version", "3")
+	query.Set("certname", certname)
+
+	status, body, err := ctx.do(http.MethodPost, ctx.baseUrl+"/pdb/cmd/v1?"+query.Encode(), requestBody)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("PuppetDB responded HTTP %d: %s", status, body)
+	}
+	return nil
+}
+
+// Node looks up the status of certname, returning ErrNodeNotFound if PuppetDB has never heard of it. Deactivated
+// and expired nodes are still found.
+func (ctx *Client) Node(certname string) (*Node, error) {
+	status, body, err := ctx.do(http.MethodGet, ctx.nodeUrl(certname), nil)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusOK:
+		var node nodeStatus
+		if err := json.Unmarshal(body, &node); err != nil {
+			return nil, err
+		}
+		result := Node(node)
+		return &result, nil
+	case http.StatusNotFound:
+		return nil, ErrNodeNotFound
+	default:
+		return nil, fmt.Errorf("PuppetDB responded HTTP %d: %s", status, body)
+	}
+}
+
+// Facts returns the facts most recently submitted for certname, by name. A node without facts has none.
+func (ctx *Client) Facts(certname string) (map[string]interface{}, error) {
+	status, body, err := ctx.do(http.MethodGet, ctx.nodeUrl(certname)+"/facts", nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("PuppetDB responded HTTP %d: %s", status, body)
+	}
+
+	var facts []fact
+	if err := json.Unmarshal(body, &facts); err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{}, len(facts))
+	for _, fact := range facts {
+		result[fact.Name] = fact.Value
+	}
+	return result, nil
+}
+
+// ReportedSince reports whether the node is active and submitted a report after t.
+func (node *Node) ReportedSince(t time.Time) bool {
+	return node.Deactivated == nil && node.Expired == nil && node.ReportTimestamp != nil && node.ReportTimestamp.After(t)
+}
+
+func (ctx *Client) nodeUrl(certname string) string {
+	return fmt.Sprintf("%s/pdb/query/v4/nodes/%s", ctx.baseUrl, url.PathEscape(certname))
+}
+
+func (ctx *Client) do(method string, requestUrl string, requestBody []byte) (int, []byte, error) {
+	var bodyReader io.Reader
+	if requestBody != nil {
+		bodyReader = bytes.NewReader(requestBody)
+	}
+	request, err := http.NewRequest(method, requestUrl, bodyReader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if requestBody != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	request.Header.Set("Accept", "application/json")
+
+	response, err := ctx.httpClient.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(io.LimitReader(response.Body, 1024*1024))
+	if err != nil {
+		return 0, nil, err
+	}
+	return response.StatusCode, responseBody, nil
+}
@@ -0,0 +1,129 @@
+package puppetdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewClient_RequiresUrl(t *testing.T) {
+	if _, err := NewClient(&Config{}); err == nil {
+		t.Error("Expected an error when no Url is configured.")
+	}
+	if _, err := NewClient(&Config{Url: "https://puppetdb.my.org:8081", CaCert: "/nonexistent/ca.pem"}); err == nil {
+		t.Error("Expected an error for an unreadable CaCert.")
+	}
+}
+
+func TestClient_DeactivateNode(t *testing.T) {
+	var query map[string][]string
+	var body map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost || request.URL.Path != "/pdb/cmd/v1" {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query = request.URL.Query()
+		json.NewDecoder(request.Body).Decode(&body)
+		response.Write([]byte(`{"uuid": "c4e1b8a2-8d34-4d4b-9c57-2b8d1c0e9f31"}`))
+	}))
+	defer server.Close()
+
+	sut, err := NewClient(&Config{Url: server.URL + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sut.DeactivateNode("foo.bar.com"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if query["command"][0] != "deactivate_node" || query["version"][0] != "3" || query["certname"][0] != "foo.bar.com" {
+		t.Errorf("Unexpected command query %v", query)
+	}
+	if body["certname"] != "foo.bar.com" || body["producer_timestamp"] == "" {
+		t.Errorf("Unexpected command body %v", body)
+	}
+}
+
+func TestClient_DeactivateNode_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(http.StatusServiceUnavailable)
+		response.Write([]byte("PuppetDB is in maintenance mode"))
+	}))
+	defer server.Close()
+
+	sut, _ := NewClient(&Config{Url: server.URL})
+	err := sut.DeactivateNode("foo.bar.com")
+	if err == nil || !strings.Contains(err.Error(), "HTTP 503: PuppetDB is in maintenance mode") {
+		t.Errorf("Expected the PuppetDB error to be reported, got %v", err)
+	}
+}
+
+// fakePuppetDb answers node and fact queries for a single node, foo.bar.com.
+func fakePuppetDb() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/pdb/query/v4/nodes/foo.bar.com":
+			response.Write([]byte(`{"certname": "foo.bar.com", "deactivated": null, "expired": null,
+				"report_timestamp": "2018-10-01T12:00:00.000Z", "catalog_environment": "production",
+				"latest_report_status": "unchanged"}`))
+		case "/pdb/query/v4/nodes/foo.bar.com/facts":
+			response.Write([]byte(`[{"certname": "foo.bar.com", "name": "osfamily", "value": "RedHat", "environment": "production"},
+				{"certname": "foo.bar.com", "name": "processorcount", "value": 4, "environment": "production"}]`))
+		default:
+			response.WriteHeader(http.StatusNotFound)
+			response.Write([]byte(`{"error": "No information is known about node"}`))
+		}
+	}))
+}
+
+func TestClient_Node(t *testing.T) {
+	server := fakePuppetDb()
+	defer server.Close()
+	sut, _ := NewClient(&Config{Url: server.URL})
+
+	node, err := sut.Node("foo.bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Certname != "foo.bar.com" || node.CatalogEnvironment != "production" || node.LatestReportStatus != "unchanged" {
+		t.Errorf("Unexpected node %+v", node)
+	}
+	reported := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	if node.ReportTimestamp == nil || !node.ReportTimestamp.Equal(reported) || node.Deactivated != nil {
+		t.Errorf("Unexpected node timestamps %+v", node)
+	}
+	if !node.ReportedSince(reported.Add(-time.Hour)) || node.ReportedSince(reported) {
+		t.Error("ReportedSince did not compare with the report timestamp.")
+	}
+
+	if _, err := sut.Node("baz.bar.com"); err != ErrNodeNotFound {
+		t.Errorf("Expected ErrNodeNotFound, got %v", err)
+	}
+}
+
+func TestClient_Facts(t *testing.T) {
+	server := fakePuppetDb()
+	defer server.Close()
+	sut, _ := NewClient(&Config{Url: server.URL})
+
+	facts, err := sut.Facts("foo.bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(facts) != 2 || facts["osfamily"] != "RedHat" || facts["processorcount"] != float64(4) {
+		t.Errorf("Unexpected facts %v", facts)
+	}
+}
+
+func TestNewClient_ProvisionCheck(t *testing.T) {
+	if _, err := NewClient(&Config{Url: "https://puppetdb.my.org:8081", ProvisionCheck: "refuse"}); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	_, err := NewClient(&Config{Url: "https://puppetdb.my.org:8081", ProvisionCheck: "block"})
+	if err == nil || err.Error() != "PuppetDb ProvisionCheck \"block\" is unsupported" {
+		t.Errorf("Expected an unsupported ProvisionCheck error, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+#!/bin/sh
+#
+# Puppet server's policy-based autosign executable. Set puppet's autosign setting to this script's path; puppet
+# runs it with the certname as the only argument and the CSR on stdin, and signs the CSR if it exits 0.
+#
+# SimplePuppetProvisioner must be on the PATH, and be running with AutosignSocket set to the same SOCKET.
+
+SOCKET=/var/run/spp/autosign.sock
+
+exec SimplePuppetProvisioner autosign-check -socket "$SOCKET" "$1"